@@ -1,5 +1,6 @@
 import { useSearchParams, useNavigate } from 'react-router-dom';
 import { useState } from 'react';
+import { authHeaders } from './auth';
 
 const SuccessfulPage = () => {
   const [searchParams] = useSearchParams();
@@ -15,9 +16,7 @@ const SuccessfulPage = () => {
       setIsButtonDisabled(true);
       const response = await fetch('http://localhost:8081/execute-strategy-orders', {
         method: 'POST',
-        headers: {
-          'Content-Type': 'application/json',
-        },
+        headers: authHeaders(),
         body: JSON.stringify({
           strategyName: selectedStrategy,
           amount: parseFloat(amount),
@@ -34,6 +33,10 @@ const SuccessfulPage = () => {
         setTimeout(() => {
           navigate('/home');
         }, 5000);
+      } else if (response.status === 401) {
+        // The session has expired, the user has to log in again
+        alert('Your session has expired, please log in again.');
+        navigate('/');
       } else {
         console.error('Failed to execute strategy orders');
         alert('Failed to execute strategy orders. Please try again.');
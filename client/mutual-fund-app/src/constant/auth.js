@@ -0,0 +1,14 @@
+// Session token of the logged in user, set by the OTP login
+export const getToken = () => localStorage.getItem('token');
+
+// Headers of requests to the RTA acting on the logged in user's account
+export const authHeaders = () => ({
+    'Content-Type': 'application/json',
+    'Authorization': `Bearer ${getToken()}`,
+});
+
+// Clears the logged in user, e.g. on logout or when the session has expired
+export const clearSession = () => {
+    localStorage.removeItem('token');
+    localStorage.removeItem('phoneNumber');
+};
@@ -1,6 +1,7 @@
 import React, { useState, useEffect } from 'react';
 import { useNavigate } from 'react-router-dom';
 import { transformToStrategyWise } from '../constant/strategies'
+import { authHeaders, clearSession } from '../constant/auth';
 
 // Component for displaying holding strategy
 const HoldingStrategy = ({ strategy, funds, investedAmount, marketValue }) => {
@@ -45,12 +46,16 @@ const HomePage = () => {
         // Fetch aggregated orders by phone number
         fetch(`http://localhost:8081/aggregated-orders-by-phone?phoneNumber=${phoneNumber}`, {
             method: 'POST',
-            headers: {
-                'Content-Type': 'application/json'
-            },
+            headers: authHeaders(),
             body: JSON.stringify({})
         })
         .then(response => {
+            if (response.status === 401) {
+                // The session has expired or was ended, log in again
+                clearSession();
+                navigate('/');
+                throw new Error('Session expired');
+            }
             if (!response.ok) {
                 throw new Error('Error fetching aggregated orders');
             }
@@ -69,14 +74,24 @@ const HomePage = () => {
         .finally(() => {
             setLoading(false);
         });
-    }, []);
+    }, [navigate]);
 
     // Function to handle logout
     const handleLogout = () => {
-        // Clear user data from local storage
-        localStorage.removeItem('phoneNumber');
-        // Navigate to the login page
-        navigate('/');
+        // End the session, the user is logged out locally even if the request fails
+        fetch('http://localhost:8081/logout', {
+            method: 'POST',
+            headers: authHeaders()
+        })
+        .catch(error => {
+            console.error('Error logging out:', error);
+        })
+        .finally(() => {
+            // Clear user data from local storage
+            clearSession();
+            // Navigate to the login page
+            navigate('/');
+        });
     };
 
     // Function to navigate to Select Strategy page
@@ -4,21 +4,65 @@ import axios from 'axios';
 
 function LoginPage() {
     const [phoneNumber, setPhoneNumber] = useState('');
+    const [otp, setOtp] = useState('');
+    const [otpSent, setOtpSent] = useState(false);
     const navigate = useNavigate();
 
     const handlePhoneNumberChange = (event) => {
         setPhoneNumber(event.target.value);
     };
 
+    const handleOtpChange = (event) => {
+        setOtp(event.target.value);
+    };
+
+    // Sends an OTP to the phone number, it is verified to start a session
+    const requestOtp = async () => {
+        try {
+            const response = await axios.post('http://localhost:8081/login/otp',
+                { phoneNumber },
+                {
+                    headers: {
+                        'Content-Type': 'application/json',
+                    }
+                }
+            );
+
+            if (response.status === 200) {
+                setOtpSent(true);
+            } else {
+                alert('Login failed. Please try again.');
+            }
+        } catch (error) {
+            console.error('Error requesting OTP:', error);
+            if (error.response && error.response.status === 404) {
+                alert('User Not exist, Please sign up');
+            } else if (error.response && error.response.status === 429) {
+                alert('Too many OTPs requested, please try again later.');
+            } else {
+                alert('Internal Error retry');
+            }
+        }
+    };
+
     const handleLogin = async () => {
         if (!phoneNumber.trim()) {
             alert('Please enter a phone number.');
             return;
         }
 
+        await requestOtp();
+    };
+
+    const handleVerify = async () => {
+        if (!otp.trim()) {
+            alert('Please enter the OTP.');
+            return;
+        }
+
         try {
-            const response = await axios.post('http://localhost:8081/login',
-                { phoneNumber },
+            const response = await axios.post('http://localhost:8081/login/verify',
+                { phoneNumber, otp },
                 {
                     headers: {
                         'Content-Type': 'application/json',
@@ -27,7 +71,8 @@ function LoginPage() {
             );
 
             if (response.status === 200) {
-                // Store the phone number in local storage
+                // Store the session token and phone number in local storage
+                localStorage.setItem('token', response.data.data.token);
                 localStorage.setItem('phoneNumber', phoneNumber);
 
                 // Redirect to home page upon successful login
@@ -36,8 +81,8 @@ function LoginPage() {
                 alert('Login failed. Please try again.');
             }
         } catch (error) {
-            console.error('Error logging in:', error);
-            alert('User Not exist, Please sign up');
+            console.error('Error verifying OTP:', error);
+            alert('Invalid OTP, please try again or request a new one.');
         }
     };
 
@@ -51,11 +96,8 @@ function LoginPage() {
             const response = await axios.post('http://localhost:8081/signup', { phoneNumber });
 
             if (response.status === 201) {
-                // Store the phone number in local storage
-                localStorage.setItem('phoneNumber', phoneNumber);
-
-                // Redirect to home page upon successful signup
-                navigate('/home');
+                // Signed up users log in with an OTP like everyone else
+                await requestOtp();
             } else {
                 // Handle signup failure
                 alert('Signup failed. Please try again.');
@@ -76,11 +118,28 @@ function LoginPage() {
                     onChange={handlePhoneNumberChange}
                     placeholder="Enter your phone number"
                     style={styles.input}
+                    disabled={otpSent}
                 />
-                <div style={styles.buttonContainer}>
-                    <button onClick={handleLogin} style={styles.button}>Login</button>
-                    <button onClick={handleSignup} style={styles.button}>Signup</button>
-                </div>
+                {otpSent ? (
+                    <>
+                        <input
+                            type="text"
+                            value={otp}
+                            onChange={handleOtpChange}
+                            placeholder="Enter the OTP sent to your phone"
+                            style={styles.input}
+                        />
+                        <div style={styles.buttonContainer}>
+                            <button onClick={handleVerify} style={styles.button}>Verify</button>
+                            <button onClick={requestOtp} style={styles.button}>Resend OTP</button>
+                        </div>
+                    </>
+                ) : (
+                    <div style={styles.buttonContainer}>
+                        <button onClick={handleLogin} style={styles.button}>Login</button>
+                        <button onClick={handleSignup} style={styles.button}>Signup</button>
+                    </div>
+                )}
             </div>
         </div>
     );
@@ -2,6 +2,7 @@
 import React, { useState } from 'react';
 import { useLocation, useNavigate } from 'react-router-dom';
 import axios from 'axios';
+import { authHeaders } from '../constant/auth';
 
 const TransitPage = () => {
     const location = useLocation();
@@ -17,18 +18,31 @@ const TransitPage = () => {
             return;
         }
     
-        // Construct the request body
-        const requestBody = {
-            accountNumber: '11200222',
-            ifscCode: 'UBIT22222',
-            amount: parseInt(investmentAmount),
-            redirectUrl: 'http://localhost:3000',
-            strategyName: strategy.name
-        };
-    
-        // Make a POST request to the payment endpoint
-        axios.post('http://localhost:8080/payment', requestBody)
+        // The payment gateway only takes payments from verified bank accounts of the user
+        axios.get('http://localhost:8081/bank-accounts', { headers: authHeaders() })
             .then(response => {
+                const account = response.data.data.find(account => account.status === 'Verified');
+                if (!account) {
+                    alert('Please add and verify a bank account before investing.');
+                    return null;
+                }
+
+                // Construct the request body
+                const requestBody = {
+                    accountNumber: account.accountNumber,
+                    ifscCode: account.ifscCode,
+                    amount: parseInt(investmentAmount),
+                    redirectUrl: 'http://localhost:3000',
+                    strategyName: strategy.name
+                };
+
+                // Make a POST request to the payment endpoint
+                return axios.post('http://localhost:8080/payment', requestBody);
+            })
+            .then(response => {
+                if (!response) {
+                    return;
+                }
                 console.log('Response data:', response.data);
                 const { paymentLink } = response.data;
                 const completeURL = paymentLink;
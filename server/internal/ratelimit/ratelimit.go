@@ -0,0 +1,247 @@
+// Package ratelimit limits the requests of every client on every route of a service with a token
+// bucket each. The services pass their default limits, the RATE_LIMITS environment variable
+// overrides them.
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit lets Burst requests through at once and refills Rate requests a second
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+// parse reads limits like "POST /order=30/m:10;*=120/m" as route=requests/period:burst,
+// the period is s, m or h and the burst defaults to the requests. 0 requests turn the limit off.
+func parse(v string) (map[string]Limit, error) {
+	limits := map[string]Limit{}
+	for _, entry := range strings.Split(v, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, spec, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected route=requests/period", entry)
+		}
+		spec, burst, hasBurst := strings.Cut(spec, ":")
+		count, period, ok := strings.Cut(spec, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected route=requests/period", entry)
+		}
+		requests, err := strconv.ParseFloat(count, 64)
+		if err != nil || requests < 0 {
+			return nil, fmt.Errorf("invalid requests in rate limit %q", entry)
+		}
+		seconds, ok := map[string]float64{"s": 1, "m": 60, "h": 3600}[period]
+		if !ok {
+			return nil, fmt.Errorf("invalid period in rate limit %q, must be s, m or h", entry)
+		}
+		limit := Limit{Rate: requests / seconds, Burst: requests}
+		if hasBurst {
+			limit.Burst, err = strconv.ParseFloat(burst, 64)
+			if err != nil || limit.Burst < 1 {
+				return nil, fmt.Errorf("invalid burst in rate limit %q", entry)
+			}
+		}
+		limits[strings.TrimSpace(route)] = limit
+	}
+	return limits, nil
+}
+
+// bucketKey is a client on a route
+type bucketKey struct {
+	route  string
+	client string
+}
+
+// tokenBucket holds the requests a client can still make on a route
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// routeStats counts the requests of a route
+type routeStats struct {
+	Allowed int64 `json:"allowed"`
+	Limited int64 `json:"limited"`
+}
+
+// Limiter limits the requests of every client on every route with a token bucket each
+type Limiter struct {
+	mu      sync.Mutex
+	limits  map[string]Limit
+	buckets map[bucketKey]*tokenBucket
+	stats   map[string]*routeStats
+	swept   time.Time
+	// key identifies the client of a request
+	key func(r *http.Request) string
+}
+
+// New returns a limiter with the defaults overridden by the RATE_LIMITS environment variable.
+// The limits are keyed by route pattern, "*" is the limit of every other route. key identifies
+// the client of a request.
+func New(defaults map[string]Limit, key func(r *http.Request) string) *Limiter {
+	limits := map[string]Limit{}
+	for route, limit := range defaults {
+		limits[route] = limit
+	}
+	if v := os.Getenv("RATE_LIMITS"); v != "" {
+		overrides, err := parse(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for route, limit := range overrides {
+			limits[route] = limit
+		}
+	}
+	return &Limiter{
+		limits:  limits,
+		buckets: map[bucketKey]*tokenBucket{},
+		stats:   map[string]*routeStats{},
+		swept:   time.Now(),
+		key:     key,
+	}
+}
+
+// allow takes a token from the client's bucket on the route. It returns false with how long
+// to wait when the bucket is empty.
+func (l *Limiter) allow(route, client string, now time.Time) (bool, time.Duration, Limit, float64) {
+	limit := l.limitOf(route)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := l.stats[route]
+	if stats == nil {
+		stats = &routeStats{}
+		l.stats[route] = stats
+	}
+	if limit.Rate <= 0 {
+		stats.Allowed++
+		return true, 0, limit, math.Inf(1)
+	}
+
+	l.sweep(now)
+
+	key := bucketKey{route, client}
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: limit.Burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		stats.Limited++
+		wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		return false, wait, limit, b.tokens
+	}
+	b.tokens--
+	stats.Allowed++
+	return true, 0, limit, b.tokens
+}
+
+// limitOf returns the limit of the route, the "*" limit unless it has its own
+func (l *Limiter) limitOf(route string) Limit {
+	if limit, ok := l.limits[route]; ok {
+		return limit
+	}
+	return l.limits["*"]
+}
+
+// sweep drops the buckets of clients idle for long enough to have refilled, once a minute
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		limit := l.limitOf(key.route)
+		if limit.Rate <= 0 || now.Sub(b.last).Seconds()*limit.Rate+b.tokens >= limit.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Middleware limits the requests to the routes of the mux, before the route's handler and
+// any middleware registered with it run. Rejected requests get 429 with a Retry-After header.
+func (l *Limiter) Middleware(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "*"
+		}
+		client := l.key(r)
+
+		ok, wait, limit, remaining := l.allow(route, client, time.Now())
+		if limit.Rate > 0 {
+			w.Header().Set("X-RateLimit-Limit", strconv.FormatFloat(limit.Burst, 'f', -1, 64))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(remaining)))
+		}
+		if !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			log.Default().Println("Rate limited", r.Method, r.URL.Path, "for", client)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}
+}
+
+// MetricsHandler is the handler function to get the rate limits, the requests allowed and
+// limited on every route and the number of clients being tracked
+func (l *Limiter) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	routes := map[string]routeStats{}
+	for route, stats := range l.stats {
+		routes[route] = *stats
+	}
+	clients := len(l.buckets)
+	limits := map[string]Limit{}
+	for route, limit := range l.limits {
+		limits[route] = limit
+	}
+	l.mu.Unlock()
+
+	resp := map[string]interface{}{
+		"data": map[string]interface{}{
+			"limits":        limits,
+			"routes":        routes,
+			"activeBuckets": clients,
+		},
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ClientIP is the address the request came from. X-Forwarded-For is only used when
+// RATE_LIMIT_TRUST_PROXY is true, i.e. the service runs behind a proxy that sets it.
+func ClientIP(r *http.Request) string {
+	if os.Getenv("RATE_LIMIT_TRUST_PROXY") == "true" {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			ip, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// loadAPIKeys reads the API keys issued to the services calling the gateway, a comma separated
+// list in the API_KEYS environment variable
+func loadAPIKeys() map[string]bool {
+	keys := map[string]bool{}
+	for _, key := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys[key] = true
+		}
+	}
+	if len(keys) == 0 {
+		log.Default().Println("API_KEYS is not set, requests that need an API key are refused")
+	}
+	return keys
+}
+
+// requireAPIKey lets a request through only when its X-API-Key header is an issued key, for the
+// routes only services like the RTA call
+func (a *App) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.apiKeys[r.Header.Get("X-API-Key")] {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"payment-gateway/internal/ratelimit"
 
 	"database/sql"
 	"log"
@@ -73,6 +77,92 @@ func initializeDatabase() (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Create the refunds table if it doesn't exist, money sent back for successful payments
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS refunds (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		uuid TEXT UNIQUE,
+		payment_id TEXT,
+		amount INTEGER,
+		reference TEXT UNIQUE,
+		status TEXT,
+		utr TEXT,
+		date TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the penny drop table if it doesn't exist, the checks of bank accounts
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS penny_drops (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		uuid TEXT UNIQUE,
+		account_number TEXT,
+		ifsc_code TEXT,
+		name TEXT,
+		beneficiary_name TEXT,
+		name_match_score REAL,
+		name_match BOOLEAN,
+		status TEXT,
+		failure_reason TEXT,
+		utr TEXT,
+		date TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_penny_drops_account ON penny_drops (account_number, ifsc_code)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the simulated bank accounts table if it doesn't exist, the holders known to the simulated bank
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS simulated_bank_accounts (
+		account_number TEXT,
+		ifsc_code TEXT,
+		holder_name TEXT,
+		PRIMARY KEY (account_number, ifsc_code)
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the payout table if it doesn't exist
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS payouts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		uuid TEXT UNIQUE,
+		account_number TEXT,
+		ifsc_code TEXT,
+		amount INTEGER,
+		reference TEXT,
+		status TEXT,
+		utr TEXT,
+		date TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the schema migrations table if it doesn't exist, the data migrations already applied
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	// Amounts are stored as integer paise
+	err = migrateToPaise(db)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
 	return db, nil
 }
 
@@ -80,14 +170,30 @@ type App struct {
 	db *sql.DB
 	// base url for the payment gateway
 	baseURL string
+	limiter *ratelimit.Limiter
+	// apiKeys are the keys issued to the services calling the gateway, see apikeys.go
+	apiKeys map[string]bool
 }
 
 func NewApp(db *sql.DB) *App {
-	return &App{
+	a := &App{
 		db: db,
 		// baseurl from the environment variable
 		baseURL: os.Getenv("BASE_URL"),
+		apiKeys: loadAPIKeys(),
+	}
+	a.limiter = ratelimit.New(defaultRateLimits, a.rateLimitKey)
+	return a
+}
+
+// rateLimitKey identifies the client of a request for rate limiting: the X-API-Key header when
+// it is an issued key, else the IP address. Unknown keys share the bucket of their IP address.
+func (a *App) rateLimitKey(r *http.Request) string {
+	if apiKey := r.Header.Get("X-API-Key"); a.apiKeys[apiKey] {
+		sum := sha256.Sum256([]byte(apiKey))
+		return "key:" + hex.EncodeToString(sum[:8])
 	}
+	return "ip:" + ratelimit.ClientIP(r)
 }
 
 func (a *App) Run() {
@@ -97,8 +203,20 @@ func (a *App) Run() {
 	mux.HandleFunc("GET /payment/{id}", randomFailureMiddleware(a.getPayment))
 	mux.HandleFunc("GET /payment/pg/{id}", randomFailureMiddleware(a.paymentExecuteHandler))
 	mux.HandleFunc("GET /payment/callback/{id}", a.paymentCallbackHandler)
+	// Penny drops, payouts and refunds are requested by the RTA with its API key
+	mux.HandleFunc("POST /payment/{id}/refund", randomFailureMiddleware(a.requireAPIKey(a.createRefundHandler)))
+	mux.HandleFunc("POST /penny-drop", randomFailureMiddleware(a.requireAPIKey(a.pennyDropHandler)))
+	mux.HandleFunc("GET /penny-drop/{id}", randomFailureMiddleware(a.requireAPIKey(a.getPennyDrop)))
+	mux.HandleFunc("POST /payout", randomFailureMiddleware(a.requireAPIKey(a.createPayoutHandler)))
+	mux.HandleFunc("GET /payout/{id}", randomFailureMiddleware(a.requireAPIKey(a.getPayout)))
+	// The simulated bank is only open to try things out locally
+	if os.Getenv("ENABLE_SIMULATOR") == "true" {
+		mux.HandleFunc("POST /simulator/bank-accounts", a.simulateBankAccountHandler)
+	}
+	mux.HandleFunc("GET /metrics/rate-limits", a.requireAPIKey(a.limiter.MetricsHandler))
 
-	handler := allowCORS(mux)
+	// Rate limits apply to every route, before its handler and randomFailureMiddleware run
+	handler := allowCORS(a.limiter.Middleware(mux))
 
 	log.Default().Println("Server started at :8080")
 	err := http.ListenAndServe(":8080", handler)
@@ -112,7 +230,8 @@ func allowCORS(h http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -125,7 +244,7 @@ type PaymentRequest struct {
 	ID            string  `json:"id"`
 	AccountNumber string  `json:"accountNumber"`
 	IfscCode      string  `json:"ifscCode"`
-	Amount        int64   `json:"amount"`
+	Amount        Money   `json:"amount"`
 	RedirectUrl   string  `json:"redirectUrl"`
 	Strategy_name string  `json:"strategyName"`
 	Status        string  `json:"status"`
@@ -141,6 +260,18 @@ func (a *App) generatePaymentLinkHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	// Payments can only be made from accounts that passed a penny drop with a matching name
+	paymentReq.IfscCode = strings.ToUpper(strings.TrimSpace(paymentReq.IfscCode))
+	verified, err := a.isVerifiedAccount(paymentReq.AccountNumber, paymentReq.IfscCode)
+	if err != nil {
+		log.Default().Println("Error checking penny drops:", err)
+		http.Error(w, "Error generating payment link", http.StatusInternalServerError)
+		return
+	}
+	if !verified {
+		http.Error(w, "Bank account is not verified", http.StatusUnprocessableEntity)
+		return
+	}
 	// log.Default().Println("Error")
 	// Generate the payment link using the bank account number and IFSC code
 	paymentLink, err := a.generatePaymentLink(paymentReq)
@@ -260,7 +391,7 @@ func (a *App) paymentCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var redirectUrl string
-	var amount int64
+	var amount Money
 	var strategyName string
 	a.db.QueryRow("SELECT redirect_url, amount, strategy_name FROM payments WHERE uuid = ?", transactionID).Scan(&redirectUrl, &amount, &strategyName)
 
@@ -274,7 +405,7 @@ func (a *App) paymentCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	if status == "success" {
 		// Construct the complete redirect URL for the investment success page
 		// redirectURL := redirectUrl + "/investmentSuccessful"
-		redirectURL := fmt.Sprintf("%s/investmentSuccessful?paymentId=%s&selectedStrategy=%s&amount=%d", redirectUrl, transactionID, strategyName, amount)
+		redirectURL := fmt.Sprintf("%s/investmentSuccessful?paymentId=%s&selectedStrategy=%s&amount=%s", redirectUrl, transactionID, strategyName, amount)
 		// Redirect to the investment success page
 		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
 	} else {
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Money is an amount in paise. Amounts are kept in whole paise so sums and comparisons are
+// exact, and are encoded in json as rupees with two decimals. Amounts given in rupees are
+// rounded to the nearest paisa, halves away from zero.
+type Money int64
+
+// Rupee is one rupee
+const Rupee Money = 100
+
+// rupees converts an amount in rupees to Money
+func rupees(v float64) Money {
+	return Money(math.Round(v * float64(Rupee)))
+}
+
+// String formats the amount in rupees with two decimals
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, int64(m/Rupee), int64(m%Rupee))
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts rupees as a number or a string
+func (m *Money) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		s = string(b)
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("invalid amount %s", b)
+	}
+	*m = rupees(v)
+	return nil
+}
+
+// Scan implements sql.Scanner, columns hold paise. Columns created before amounts were stored
+// in paise have a REAL type, so whole numbers stored in them come back as floats.
+func (m *Money) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+	case int64:
+		*m = Money(v)
+	case float64:
+		*m = Money(math.Round(v))
+	case []byte:
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		*m = Money(n)
+		return err
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		*m = Money(n)
+		return err
+	default:
+		return fmt.Errorf("unsupported amount %T", src)
+	}
+	return nil
+}
+
+// Value implements driver.Valuer
+func (m Money) Value() (driver.Value, error) {
+	return int64(m), nil
+}
+
+// migrateToPaise converts the payment amounts stored in whole rupees and the payout amounts
+// stored as floats to integer paise. It runs once, recorded in schema_migrations.
+func migrateToPaise(db *sql.DB) error {
+	const name = "money_in_paise"
+	var applied int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE name = ?", name).Scan(&applied); err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		`UPDATE payments SET amount = CAST(ROUND(amount * 100) AS INTEGER)`,
+		`UPDATE payouts SET amount = CAST(ROUND(amount * 100) AS INTEGER)`,
+		`UPDATE refunds SET amount = CAST(ROUND(amount * 100) AS INTEGER)`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO schema_migrations (name, applied_at) VALUES (?, ?)", name, time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
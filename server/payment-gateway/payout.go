@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Payout is money sent to a bank account, e.g. the proceeds of a redemption
+type Payout struct {
+	ID            string `json:"id"`
+	AccountNumber string `json:"accountNumber"`
+	IfscCode      string `json:"ifscCode"`
+	Amount        Money  `json:"amount"`
+	// Reference is the id of what is being paid out in the caller's system
+	Reference string  `json:"reference"`
+	Status    string  `json:"status"`
+	Utr       *string `json:"utr"`
+	CreatedAt string  `json:"createdAt"`
+}
+
+// handler function to pay out to a bank account. Only accounts that passed a penny drop with
+// a matching name can be paid out to.
+func (a *App) createPayoutHandler(w http.ResponseWriter, r *http.Request) {
+	var req Payout
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.IfscCode = strings.ToUpper(strings.TrimSpace(req.IfscCode))
+	if req.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+
+	verified, err := a.isVerifiedAccount(req.AccountNumber, req.IfscCode)
+	if err != nil {
+		log.Default().Println("Error checking penny drops:", err)
+		http.Error(w, "Error creating payout", http.StatusInternalServerError)
+		return
+	}
+	if !verified {
+		http.Error(w, "Bank account is not verified", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Payouts are simulated, the money reaches the account right away
+	req.ID = uuid.New().String()
+	req.Status = "Success"
+	utr := fmt.Sprintf("ABCDBANK%s", req.ID)
+	req.Utr = &utr
+	_, err = a.db.Exec("INSERT INTO payouts (uuid, account_number, ifsc_code, amount, reference, status, utr) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		req.ID, req.AccountNumber, req.IfscCode, req.Amount, req.Reference, req.Status, req.Utr)
+	if err != nil {
+		log.Default().Println("Error creating payout:", err)
+		http.Error(w, "Error creating payout", http.StatusInternalServerError)
+		return
+	}
+	log.Default().Println("Paid out", req.Amount, "to", req.AccountNumber, "for", req.Reference)
+
+	a.writePayout(w, req.ID)
+}
+
+// handler function to get a payout as json
+func (a *App) getPayout(w http.ResponseWriter, r *http.Request) {
+	a.writePayout(w, r.PathValue("id"))
+}
+
+func (a *App) writePayout(w http.ResponseWriter, id string) {
+	var payout Payout
+	err := a.db.QueryRow("SELECT uuid, account_number, ifsc_code, amount, reference, status, utr, date FROM payouts WHERE uuid = ?", id).
+		Scan(&payout.ID, &payout.AccountNumber, &payout.IfscCode, &payout.Amount, &payout.Reference, &payout.Status, &payout.Utr, &payout.CreatedAt)
+	if err != nil {
+		log.Default().Println(err)
+		http.Error(w, "Payout not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payout)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ifscPattern is 4 letters of the bank, a 0 and 6 characters of the branch
+	ifscPattern = regexp.MustCompile(`^[A-Z]{4}0[A-Z0-9]{6}$`)
+	// accountNumberPattern is 9 to 18 digits
+	accountNumberPattern = regexp.MustCompile(`^[0-9]{9,18}$`)
+)
+
+// nameMatchThreshold is the least score for the beneficiary name to match the expected name
+const nameMatchThreshold = 0.8
+
+// PennyDrop is a deposit of 1 rupee to a bank account to check it exists and who holds it
+type PennyDrop struct {
+	ID            string `json:"id"`
+	AccountNumber string `json:"accountNumber"`
+	IfscCode      string `json:"ifscCode"`
+	// Name is the name the account holder is expected to have
+	Name string `json:"name"`
+	// BeneficiaryName is the name the bank has on record for the account
+	BeneficiaryName *string `json:"beneficiaryName"`
+	// NameMatchScore is how much of the names match, from 0 to 1
+	NameMatchScore float64 `json:"nameMatchScore"`
+	NameMatch      bool    `json:"nameMatch"`
+	// Status is Success when the rupee was deposited, Failed otherwise
+	Status        string  `json:"status"`
+	FailureReason *string `json:"failureReason"`
+	Utr           *string `json:"utr"`
+	CreatedAt     string  `json:"createdAt"`
+}
+
+// handler function to verify a bank account with a penny drop and match the name of its holder
+func (a *App) pennyDropHandler(w http.ResponseWriter, r *http.Request) {
+	var req PennyDrop
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.IfscCode = strings.ToUpper(strings.TrimSpace(req.IfscCode))
+	req.AccountNumber = strings.TrimSpace(req.AccountNumber)
+	if !accountNumberPattern.MatchString(req.AccountNumber) {
+		http.Error(w, "Account number must be 9 to 18 digits", http.StatusBadRequest)
+		return
+	}
+	if !ifscPattern.MatchString(req.IfscCode) {
+		http.Error(w, "IFSC code must be 4 letters, a 0 and 6 letters or digits, e.g. HDFC0001234", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	drop, err := a.pennyDrop(req)
+	if err != nil {
+		log.Default().Println("Error doing penny drop:", err)
+		http.Error(w, "Error verifying bank account", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drop)
+}
+
+// pennyDrop simulates the deposit. Account numbers ending in 0000 don't exist at the bank.
+// The holder of other accounts is the one registered with the simulator, or the expected
+// name if none was registered.
+func (a *App) pennyDrop(req PennyDrop) (*PennyDrop, error) {
+	drop := PennyDrop{
+		ID:            uuid.New().String(),
+		AccountNumber: req.AccountNumber,
+		IfscCode:      req.IfscCode,
+		Name:          req.Name,
+		Status:        "Success",
+	}
+
+	if strings.HasSuffix(req.AccountNumber, "0000") {
+		drop.Status = "Failed"
+		reason := "account does not exist"
+		drop.FailureReason = &reason
+	} else {
+		holder := req.Name
+		err := a.db.QueryRow("SELECT holder_name FROM simulated_bank_accounts WHERE account_number = ? AND ifsc_code = ?", req.AccountNumber, req.IfscCode).Scan(&holder)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		drop.BeneficiaryName = &holder
+		drop.NameMatchScore = nameMatchScore(req.Name, holder)
+		drop.NameMatch = drop.NameMatchScore >= nameMatchThreshold
+		utr := fmt.Sprintf("ABCDBANK%s", drop.ID)
+		drop.Utr = &utr
+	}
+
+	_, err := a.db.Exec(`INSERT INTO penny_drops (uuid, account_number, ifsc_code, name, beneficiary_name, name_match_score, name_match, status, failure_reason, utr)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		drop.ID, drop.AccountNumber, drop.IfscCode, drop.Name, drop.BeneficiaryName, drop.NameMatchScore, drop.NameMatch, drop.Status, drop.FailureReason, drop.Utr)
+	if err != nil {
+		return nil, err
+	}
+	err = a.db.QueryRow("SELECT date FROM penny_drops WHERE uuid = ?", drop.ID).Scan(&drop.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	log.Default().Println("Penny drop", drop.ID, "to", drop.AccountNumber, drop.Status, "name match", drop.NameMatchScore)
+	return &drop, nil
+}
+
+// isVerifiedAccount reports whether the account passed a penny drop with a matching name, only
+// these accounts can pay or be paid out to
+func (a *App) isVerifiedAccount(accountNumber, ifscCode string) (bool, error) {
+	var verified int
+	err := a.db.QueryRow("SELECT COUNT(*) FROM penny_drops WHERE account_number = ? AND ifsc_code = ? AND status = 'Success' AND name_match",
+		accountNumber, strings.ToUpper(strings.TrimSpace(ifscCode))).Scan(&verified)
+	return verified > 0, err
+}
+
+// handler function to get a penny drop as json
+func (a *App) getPennyDrop(w http.ResponseWriter, r *http.Request) {
+	var drop PennyDrop
+	err := a.db.QueryRow(`SELECT uuid, account_number, ifsc_code, name, beneficiary_name, name_match_score, name_match, status, failure_reason, utr, date
+		FROM penny_drops WHERE uuid = ?`, r.PathValue("id")).
+		Scan(&drop.ID, &drop.AccountNumber, &drop.IfscCode, &drop.Name, &drop.BeneficiaryName, &drop.NameMatchScore, &drop.NameMatch, &drop.Status, &drop.FailureReason, &drop.Utr, &drop.CreatedAt)
+	if err != nil {
+		log.Default().Println(err)
+		http.Error(w, "Penny drop not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drop)
+}
+
+// handler function to register who holds an account at the simulated bank, e.g. to try out
+// penny drops whose name doesn't match
+func (a *App) simulateBankAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		AccountNumber string `json:"accountNumber"`
+		IfscCode      string `json:"ifscCode"`
+		HolderName    string `json:"holderName"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.IfscCode = strings.ToUpper(strings.TrimSpace(req.IfscCode))
+	if !accountNumberPattern.MatchString(req.AccountNumber) || !ifscPattern.MatchString(req.IfscCode) || req.HolderName == "" {
+		http.Error(w, "Account number, IFSC code and holder name are required", http.StatusBadRequest)
+		return
+	}
+
+	_, err := a.db.Exec("INSERT OR REPLACE INTO simulated_bank_accounts (account_number, ifsc_code, holder_name) VALUES (?, ?, ?)", req.AccountNumber, req.IfscCode, req.HolderName)
+	if err != nil {
+		log.Default().Println("Error saving simulated bank account:", err)
+		http.Error(w, "Error saving bank account", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, "Bank account created successfully")
+}
+
+// nameTitles are dropped before matching names
+var nameTitles = map[string]bool{"MR": true, "MRS": true, "MS": true, "MISS": true, "DR": true, "SHRI": true, "SMT": true, "KUMARI": true}
+
+// nameTokens splits a name into upper case words without punctuation and titles
+func nameTokens(name string) []string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return ' '
+	}, name)
+	var tokens []string
+	for _, t := range strings.Fields(name) {
+		if !nameTitles[t] {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// nameMatchScore compares two names word by word, in any order. A word matches the same word
+// or its initial, e.g. "A Kumar Rao" matches "Asha Kumar Rao". The score is the share of the
+// words of the shorter name found in the longer one, so a missing middle name still matches,
+// but a lone word is halved.
+func nameMatchScore(expected, actual string) float64 {
+	shorter, longer := nameTokens(expected), nameTokens(actual)
+	if len(shorter) > len(longer) {
+		shorter, longer = longer, shorter
+	}
+	if len(shorter) == 0 {
+		return 0
+	}
+
+	used := make([]bool, len(longer))
+	score := 0.0
+	for _, s := range shorter {
+		best, bestIndex := 0.0, -1
+		for i, l := range longer {
+			if used[i] {
+				continue
+			}
+			var m float64
+			switch {
+			case s == l:
+				m = 1
+			case len(s) == 1 && s[0] == l[0], len(l) == 1 && l[0] == s[0]:
+				m = 0.9
+			}
+			if m > best {
+				best, bestIndex = m, i
+			}
+		}
+		if bestIndex >= 0 {
+			used[bestIndex] = true
+			score += best
+		}
+	}
+	score /= float64(len(shorter))
+	// a single word, like a surname, is not enough to tell who holds the account
+	if len(shorter) == 1 && len(longer) > 1 {
+		score /= 2
+	}
+	return score
+}
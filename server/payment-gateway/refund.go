@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// Refund is money sent back to the account a payment was made from, e.g. for a cancelled order
+type Refund struct {
+	ID        string `json:"id"`
+	PaymentID string `json:"paymentId"`
+	Amount    Money  `json:"amount"`
+	// Reference is the id of what is being refunded in the caller's system, a refund is made once per reference
+	Reference string  `json:"reference"`
+	Status    string  `json:"status"`
+	Utr       *string `json:"utr"`
+	CreatedAt string  `json:"createdAt"`
+}
+
+// handler function to refund part or all of a successful payment. The refunds of a payment
+// can't add up to more than its amount.
+func (a *App) createRefundHandler(w http.ResponseWriter, r *http.Request) {
+	var req Refund
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.PaymentID = r.PathValue("id")
+	if req.Amount <= 0 || req.Reference == "" {
+		http.Error(w, "Amount must be positive and reference is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		log.Default().Println("Error creating refund:", err)
+		http.Error(w, "Error creating refund", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// retries of a refund get the one already made
+	var existing string
+	err = tx.QueryRow("SELECT uuid FROM refunds WHERE reference = ?", req.Reference).Scan(&existing)
+	if err == nil {
+		a.writeRefund(w, existing)
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Default().Println("Error checking refunds:", err)
+		http.Error(w, "Error creating refund", http.StatusInternalServerError)
+		return
+	}
+
+	var status string
+	var amount, refunded Money
+	err = tx.QueryRow("SELECT status, amount, (SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE payment_id = ?) FROM payments WHERE uuid = ?",
+		req.PaymentID, req.PaymentID).Scan(&status, &amount, &refunded)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Default().Println("Error getting payment:", err)
+		http.Error(w, "Error creating refund", http.StatusInternalServerError)
+		return
+	}
+	if status != "Success" {
+		http.Error(w, "Payment is not successful, there is nothing to refund", http.StatusUnprocessableEntity)
+		return
+	}
+	if refunded+req.Amount > amount {
+		http.Error(w, fmt.Sprintf("Refunds can't exceed the payment amount %s, %s is already refunded", amount, refunded), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Refunds are simulated, the money reaches the account right away
+	req.ID = uuid.New().String()
+	req.Status = "Success"
+	utr := fmt.Sprintf("ABCDBANK%s", req.ID)
+	req.Utr = &utr
+	_, err = tx.Exec("INSERT INTO refunds (uuid, payment_id, amount, reference, status, utr) VALUES (?, ?, ?, ?, ?, ?)",
+		req.ID, req.PaymentID, req.Amount, req.Reference, req.Status, req.Utr)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Default().Println("Error creating refund:", err)
+		http.Error(w, "Error creating refund", http.StatusInternalServerError)
+		return
+	}
+	log.Default().Println("Refunded", req.Amount, "of payment", req.PaymentID, "for", req.Reference)
+
+	a.writeRefund(w, req.ID)
+}
+
+func (a *App) writeRefund(w http.ResponseWriter, id string) {
+	var refund Refund
+	err := a.db.QueryRow("SELECT uuid, payment_id, amount, reference, status, utr, date FROM refunds WHERE uuid = ?", id).
+		Scan(&refund.ID, &refund.PaymentID, &refund.Amount, &refund.Reference, &refund.Status, &refund.Utr, &refund.CreatedAt)
+	if err != nil {
+		log.Default().Println(err)
+		http.Error(w, "Refund not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refund)
+}
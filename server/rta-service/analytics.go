@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// analyticsPeriod is a lookback period of the fund analytics, e.g. 1y
+type analyticsPeriod struct {
+	Name   string
+	Years  int
+	Months int
+}
+
+// start returns the first date of the period ending on the date of the given time
+func (p analyticsPeriod) start(t time.Time) string {
+	return t.In(ist).AddDate(-p.Years, -p.Months, 0).Format(time.DateOnly)
+}
+
+// yearsLong returns the length of the period in years
+func (p analyticsPeriod) yearsLong() float64 {
+	return float64(p.Years) + float64(p.Months)/12
+}
+
+var analyticsPeriods = []analyticsPeriod{
+	{"1m", 0, 1}, {"3m", 0, 3}, {"6m", 0, 6}, {"1y", 1, 0}, {"3y", 3, 0}, {"5y", 5, 0},
+}
+
+// rollingWindows are the windows rolling returns are computed over, the ones shorter than the period are used
+var rollingWindows = analyticsPeriods[:5]
+
+// periodMax analyses the whole nav history of the fund
+const periodMax = "max"
+
+// FundAnalytics are the risk and return metrics of a fund over a period, computed from the last
+// nav of each day and adjusted for the dividends paid. Returns, volatility and drawdowns are in
+// percent, metrics needing more history than there is are null.
+type FundAnalytics struct {
+	Fund   string `json:"fund"`
+	Period string `json:"period"`
+	// From and To are the first and last dates with a nav, Observations the number of them
+	From         *string `json:"from"`
+	To           *string `json:"to"`
+	Observations int     `json:"observations"`
+	RiskFreeRate float64 `json:"riskFreeRate"`
+	// AbsoluteReturn is the return over the period, AnnualisedReturn its compound annual rate,
+	// set when the history spans a year or more
+	AbsoluteReturn   *float64 `json:"absoluteReturn"`
+	AnnualisedReturn *float64 `json:"annualisedReturn"`
+	// Volatility is the annualised standard deviation of the daily returns
+	Volatility   *float64  `json:"volatility"`
+	SharpeRatio  *float64  `json:"sharpeRatio"`
+	SortinoRatio *float64  `json:"sortinoRatio"`
+	MaxDrawdown  *Drawdown `json:"maxDrawdown"`
+	// Beta is measured against Benchmark, proxied by the average daily return of its peers
+	Beta           *float64        `json:"beta"`
+	Benchmark      Benchmark       `json:"benchmark"`
+	RollingReturns []RollingReturn `json:"rollingReturns"`
+}
+
+// Drawdown is the largest fall of the fund from a peak, Percentage is negative
+type Drawdown struct {
+	Percentage float64 `json:"percentage"`
+	PeakDate   string  `json:"peakDate"`
+	TroughDate string  `json:"troughDate"`
+	// RecoveryDate is the first date the fund is back at its peak, nil when it hasn't recovered
+	RecoveryDate *string `json:"recoveryDate"`
+}
+
+// Benchmark describes what the beta of a fund is measured against. Index levels aren't recorded,
+// so the fund's stated benchmark is proxied by the average of Funds, its peers described by Proxy.
+type Benchmark struct {
+	Name  string   `json:"name"`
+	Proxy string   `json:"proxy"`
+	Funds []string `json:"funds"`
+}
+
+// RollingReturn summarises the returns over every window of a length within the period.
+// Returns over windows of a year or more are annualised.
+type RollingReturn struct {
+	Window  string  `json:"window"`
+	Count   int     `json:"count"`
+	Average float64 `json:"average"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	// Positive is the percentage of the windows with a positive return
+	Positive float64 `json:"positive"`
+}
+
+// analyticsCache keeps the analytics computed since the last nav declaration, which resets it.
+// Results computed while a declaration happens are not kept, the generation tells them apart.
+type analyticsCache struct {
+	sync.Mutex
+	generation int
+	results    map[string]*FundAnalytics
+}
+
+var analyticsC = analyticsCache{results: map[string]*FundAnalytics{}}
+
+func (c *analyticsCache) get(key string) (*FundAnalytics, int) {
+	c.Lock()
+	defer c.Unlock()
+	return c.results[key], c.generation
+}
+
+func (c *analyticsCache) put(key string, generation int, fa *FundAnalytics) {
+	c.Lock()
+	defer c.Unlock()
+	if generation == c.generation {
+		c.results[key] = fa
+	}
+}
+
+// reset drops the cached analytics, they are stale once a nav is declared
+func (c *analyticsCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	c.results = map[string]*FundAnalytics{}
+}
+
+// loadRiskFreeRate reads the annual risk free rate in percent the Sharpe and Sortino ratios are measured against
+func loadRiskFreeRate() float64 {
+	rate := 6.5
+	if v := os.Getenv("RISK_FREE_RATE"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 || r > 100 {
+			log.Fatal("invalid RISK_FREE_RATE: must be a percentage between 0 and 100")
+		}
+		rate = r
+	}
+	return rate
+}
+
+// handler function to get the risk metrics of a fund over a period, e.g. ?period=1y
+func (a *App) fundAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	fundName := r.PathValue("fund")
+	fundC.Lock()
+	fund, ok := fundC.Funds[fundName]
+	funds := make([]Fund, 0, len(fundC.Funds))
+	for _, f := range fundC.Funds {
+		funds = append(funds, f)
+	}
+	fundC.Unlock()
+	if !ok {
+		http.Error(w, "Fund not found", http.StatusNotFound)
+		return
+	}
+	benchmark := benchmarkPeers(fund, funds)
+
+	periodName := r.URL.Query().Get("period")
+	if periodName == "" {
+		periodName = "1y"
+	}
+	var period *analyticsPeriod
+	for _, p := range analyticsPeriods {
+		if p.Name == periodName {
+			period = &p
+		}
+	}
+	if period == nil && periodName != periodMax {
+		http.Error(w, "Invalid period, must be one of 1m, 3m, 6m, 1y, 3y, 5y or max", http.StatusBadRequest)
+		return
+	}
+
+	key := fundName + "|" + periodName
+	fa, generation := analyticsC.get(key)
+	if fa == nil {
+		var err error
+		fa, err = a.fundAnalytics(fund, benchmark, periodName, period, time.Now())
+		if err != nil {
+			log.Default().Println("Error computing fund analytics:", err)
+			http.Error(w, "Error computing fund analytics", http.StatusInternalServerError)
+			return
+		}
+		analyticsC.put(key, generation, fa)
+	}
+
+	resp := map[string]interface{}{
+		"data":    fa,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// navPoint is the last nav of a fund on a date, with the dividends per unit paid that date
+type navPoint struct {
+	date     string
+	nav      float64
+	dividend float64
+}
+
+// dailyNavs returns the last nav declared on each IST date from the given one, and the
+// dividends paid on those dates, of the given funds. An empty from reads the whole history.
+func (a *App) dailyNavs(funds []string, from string) (map[string][]navPoint, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(funds)), ", ")
+	args := []any{}
+	for _, f := range funds {
+		args = append(args, f)
+	}
+	args = append(args, from)
+
+	// declared_at and paid_at are in UTC, the dates are taken in IST
+	rows, err := a.db.Query(`SELECT fund, nav, date(declared_at, '+330 minutes') FROM nav_history WHERE id IN (
+			SELECT MAX(id) FROM nav_history WHERE fund IN (`+placeholders+`) AND date(declared_at, '+330 minutes') >= ?
+			GROUP BY fund, date(declared_at, '+330 minutes'))
+		ORDER BY fund, declared_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	navs := map[string][]navPoint{}
+	for rows.Next() {
+		var fund string
+		var p navPoint
+		if err := rows.Scan(&fund, &p.nav, &p.date); err != nil {
+			return nil, err
+		}
+		navs[fund] = append(navs[fund], p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = a.db.Query(`SELECT fund, amount_per_unit, date(paid_at, '+330 minutes') FROM dividends
+		WHERE status = ? AND fund IN (`+placeholders+`) AND date(paid_at, '+330 minutes') >= ?`,
+		append([]any{DividendStatusPaid}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fund, date string
+		var amount float64
+		if err := rows.Scan(&fund, &amount, &date); err != nil {
+			return nil, err
+		}
+		points := navs[fund]
+		if i, ok := slices.BinarySearchFunc(points, date, func(p navPoint, d string) int { return strings.Compare(p.date, d) }); ok {
+			points[i].dividend += amount
+		}
+	}
+	return navs, rows.Err()
+}
+
+// dailyReturns returns the return of each date over the date before it, counting the dividends paid
+func dailyReturns(points []navPoint) map[string]float64 {
+	returns := map[string]float64{}
+	for i := 1; i < len(points); i++ {
+		if points[i-1].nav > 0 {
+			returns[points[i].date] = (points[i].nav+points[i].dividend)/points[i-1].nav - 1
+		}
+	}
+	return returns
+}
+
+// benchmarkPeers picks the funds whose average stands in for the benchmark of the fund: the other
+// funds with the same benchmark, else with the same sub-category, else with the same category.
+// The fund is never its own peer, it has no benchmark to measure beta against without peers.
+func benchmarkPeers(fund Fund, funds []Fund) Benchmark {
+	benchmark := Benchmark{Name: fund.Benchmark, Funds: []string{}}
+	if benchmark.Name == "" {
+		benchmark.Name = fund.Category + " category"
+	}
+	for _, group := range []struct {
+		proxy string
+		field func(Fund) string
+	}{
+		{"funds benchmarked against " + fund.Benchmark, func(f Fund) string { return f.Benchmark }},
+		{fund.SubCategory + " funds", func(f Fund) string { return f.SubCategory }},
+		{fund.Category + " funds", func(f Fund) string { return f.Category }},
+	} {
+		if group.field(fund) == "" {
+			continue
+		}
+		var peers []string
+		for _, f := range funds {
+			if f.Name != fund.Name && group.field(f) == group.field(fund) {
+				peers = append(peers, f.Name)
+			}
+		}
+		if len(peers) > 0 {
+			slices.Sort(peers)
+			benchmark.Proxy, benchmark.Funds = "average of the "+group.proxy, peers
+			break
+		}
+	}
+	return benchmark
+}
+
+// fundAnalytics computes the analytics of the fund over the period ending at now, nil period for the whole history
+func (a *App) fundAnalytics(fund Fund, benchmark Benchmark, periodName string, period *analyticsPeriod, now time.Time) (*FundAnalytics, error) {
+	fa := &FundAnalytics{
+		Fund:           fund.Name,
+		Period:         periodName,
+		RiskFreeRate:   a.riskFreeRate,
+		Benchmark:      benchmark,
+		RollingReturns: []RollingReturn{},
+	}
+	from := ""
+	if period != nil {
+		from = period.start(now)
+	}
+	navs, err := a.dailyNavs(slices.Concat([]string{fund.Name}, benchmark.Funds), from)
+	if err != nil {
+		return nil, err
+	}
+	points := navs[fund.Name]
+	fa.Observations = len(points)
+	if len(points) < 2 {
+		return fa, nil
+	}
+	fa.From, fa.To = &points[0].date, &points[len(points)-1].date
+
+	// the total return index reinvests the dividends
+	index := make([]float64, len(points))
+	index[0] = points[0].nav
+	returns := make([]float64, 0, len(points)-1)
+	for i := 1; i < len(points); i++ {
+		r := (points[i].nav+points[i].dividend)/points[i-1].nav - 1
+		returns = append(returns, r)
+		index[i] = index[i-1] * (1 + r)
+	}
+	dates := make([]time.Time, len(points))
+	for i, p := range points {
+		dates[i], _ = time.ParseInLocation(time.DateOnly, p.date, ist)
+	}
+	years := dates[len(dates)-1].Sub(dates[0]).Hours() / 24 / 365
+
+	absolute := (index[len(index)-1]/index[0] - 1) * 100
+	fa.AbsoluteReturn = &absolute
+	if years >= 1 {
+		annualised := (math.Pow(index[len(index)-1]/index[0], 1/years) - 1) * 100
+		fa.AnnualisedReturn = &annualised
+	}
+	fa.MaxDrawdown = maxDrawdown(points, index)
+
+	// navs are declared daily, the returns are annualised by how many there were a year
+	if len(returns) >= 2 && years > 0 {
+		perYear := float64(len(returns)) / years
+		riskFree := a.riskFreeRate / 100 / perYear
+		mean, sd := meanAndDeviation(returns)
+		downside := 0.0
+		for _, r := range returns {
+			downside += math.Pow(min(r-riskFree, 0), 2)
+		}
+		downside = math.Sqrt(downside / float64(len(returns)))
+
+		volatility := sd * math.Sqrt(perYear) * 100
+		fa.Volatility = &volatility
+		if sd > 0 {
+			sharpe := (mean - riskFree) / sd * math.Sqrt(perYear)
+			fa.SharpeRatio = &sharpe
+		}
+		if downside > 0 {
+			sortino := (mean - riskFree) / downside * math.Sqrt(perYear)
+			fa.SortinoRatio = &sortino
+		}
+	}
+
+	fa.Beta = beta(fund.Name, navs)
+	fa.RollingReturns = rollingReturns(dates, index, period)
+	return fa, nil
+}
+
+// meanAndDeviation returns the mean and the sample standard deviation of the values
+func meanAndDeviation(values []float64) (float64, float64) {
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(values)-1))
+}
+
+// maxDrawdown finds the largest fall of the total return index from its running peak
+func maxDrawdown(points []navPoint, index []float64) *Drawdown {
+	var dd *Drawdown
+	peak, worst, worstPeak := 0, 0.0, 0
+	for i, v := range index {
+		if v > index[peak] {
+			peak = i
+		}
+		if fall := v/index[peak] - 1; fall < worst {
+			worst, worstPeak = fall, peak
+			dd = &Drawdown{Percentage: fall * 100, PeakDate: points[peak].date, TroughDate: points[i].date}
+		}
+	}
+	if dd == nil {
+		return nil
+	}
+	trough := slices.IndexFunc(points, func(p navPoint) bool { return p.date == dd.TroughDate })
+	for i := trough + 1; i < len(index); i++ {
+		if index[i] >= index[worstPeak] {
+			dd.RecoveryDate = &points[i].date
+			break
+		}
+	}
+	return dd
+}
+
+// beta is the covariance of the daily returns of the fund with the benchmark over the variance
+// of the benchmark, on the dates both have a return. The benchmark return of a date is the
+// average of the peers, the other funds in navs, with a nav that date and the one before.
+func beta(fund string, navs map[string][]navPoint) *float64 {
+	fundReturns := dailyReturns(navs[fund])
+	sums, counts := map[string]float64{}, map[string]int{}
+	for name, points := range navs {
+		if name == fund {
+			continue
+		}
+		for date, r := range dailyReturns(points) {
+			sums[date] += r
+			counts[date]++
+		}
+	}
+
+	var xs, ys []float64
+	for date, r := range fundReturns {
+		if counts[date] == 0 {
+			continue
+		}
+		xs = append(xs, sums[date]/float64(counts[date]))
+		ys = append(ys, r)
+	}
+	if len(xs) < 2 {
+		return nil
+	}
+	meanX, sdX := meanAndDeviation(xs)
+	meanY, _ := meanAndDeviation(ys)
+	if sdX == 0 {
+		return nil
+	}
+	covariance := 0.0
+	for i := range xs {
+		covariance += (xs[i] - meanX) * (ys[i] - meanY)
+	}
+	covariance /= float64(len(xs) - 1)
+	b := covariance / (sdX * sdX)
+	return &b
+}
+
+// rollingReturns summarises the returns over each window shorter than the period that fits in the history
+func rollingReturns(dates []time.Time, index []float64, period *analyticsPeriod) []RollingReturn {
+	summaries := []RollingReturn{}
+	for _, window := range rollingWindows {
+		if period != nil && window.yearsLong() >= period.yearsLong() {
+			break
+		}
+		var returns []float64
+		start := 0
+		for end := range dates {
+			since := dates[end].AddDate(-window.Years, -window.Months, 0)
+			if since.Before(dates[0]) {
+				continue
+			}
+			// the window starts at the last nav on or before its first date
+			for start+1 < end && !dates[start+1].After(since) {
+				start++
+			}
+			r := index[end]/index[start] - 1
+			if window.Years > 0 {
+				r = math.Pow(1+r, 1/window.yearsLong()) - 1
+			}
+			returns = append(returns, r*100)
+		}
+		if len(returns) == 0 {
+			break
+		}
+
+		s := RollingReturn{Window: window.Name, Count: len(returns), Min: slices.Min(returns), Max: slices.Max(returns)}
+		positive := 0
+		for _, r := range returns {
+			s.Average += r
+			if r > 0 {
+				positive++
+			}
+		}
+		s.Average /= float64(len(returns))
+		s.Positive = float64(positive) / float64(len(returns)) * 100
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
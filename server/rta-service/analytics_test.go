@@ -0,0 +1,323 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// dailySeries returns the navs as points on consecutive dates from the given one
+func dailySeries(from string, navs ...float64) []navPoint {
+	start, _ := time.Parse(time.DateOnly, from)
+	points := make([]navPoint, len(navs))
+	for i, nav := range navs {
+		points[i] = navPoint{date: start.AddDate(0, 0, i).Format(time.DateOnly), nav: nav}
+	}
+	return points
+}
+
+// compounded returns the navs growing from 100 by each of the returns in turn
+func compounded(returns ...float64) []float64 {
+	navs := []float64{100}
+	for _, r := range returns {
+		navs = append(navs, navs[len(navs)-1]*(1+r))
+	}
+	return navs
+}
+
+func scaled(returns []float64, factor float64) []float64 {
+	s := make([]float64, len(returns))
+	for i, r := range returns {
+		s[i] = r * factor
+	}
+	return s
+}
+
+func TestMaxDrawdown(t *testing.T) {
+	date := func(day int) string {
+		return time.Date(2024, time.January, 1+day, 0, 0, 0, 0, time.UTC).Format(time.DateOnly)
+	}
+	recovered := func(day int) *string {
+		d := date(day)
+		return &d
+	}
+
+	tests := []struct {
+		name string
+		navs []float64
+		want *Drawdown
+	}{
+		{
+			name: "only rising",
+			navs: []float64{100, 101, 105, 110},
+		},
+		{
+			name: "flat",
+			navs: []float64{100, 100, 100},
+		},
+		{
+			name: "recovered above the peak",
+			navs: []float64{100, 120, 90, 110, 125},
+			want: &Drawdown{Percentage: -25, PeakDate: date(1), TroughDate: date(2), RecoveryDate: recovered(4)},
+		},
+		{
+			name: "recovered at the peak",
+			navs: []float64{100, 50, 100},
+			want: &Drawdown{Percentage: -50, PeakDate: date(0), TroughDate: date(1), RecoveryDate: recovered(2)},
+		},
+		{
+			name: "not recovered",
+			navs: []float64{100, 80, 90},
+			want: &Drawdown{Percentage: -20, PeakDate: date(0), TroughDate: date(1)},
+		},
+		{
+			name: "the larger of two drawdowns",
+			navs: []float64{100, 120, 90, 130, 104},
+			want: &Drawdown{Percentage: -25, PeakDate: date(1), TroughDate: date(2), RecoveryDate: recovered(3)},
+		},
+		{
+			name: "a later, larger drawdown from a new peak",
+			navs: []float64{100, 90, 110, 77, 100},
+			want: &Drawdown{Percentage: -30, PeakDate: date(2), TroughDate: date(3)},
+		},
+		{
+			name: "trough after several falls",
+			navs: []float64{100, 95, 90, 80, 85},
+			want: &Drawdown{Percentage: -20, PeakDate: date(0), TroughDate: date(3)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := maxDrawdown(dailySeries(date(0), tt.navs...), tt.navs)
+			switch {
+			case got == nil && tt.want == nil:
+				return
+			case got == nil || tt.want == nil:
+				t.Fatalf("maxDrawdown() = %+v, want %+v", got, tt.want)
+			}
+			if math.Abs(got.Percentage-tt.want.Percentage) > 1e-9 || got.PeakDate != tt.want.PeakDate || got.TroughDate != tt.want.TroughDate {
+				t.Errorf("maxDrawdown() = %v%% from %s to %s, want %v%% from %s to %s",
+					got.Percentage, got.PeakDate, got.TroughDate, tt.want.Percentage, tt.want.PeakDate, tt.want.TroughDate)
+			}
+			switch {
+			case got.RecoveryDate == nil && tt.want.RecoveryDate == nil:
+			case got.RecoveryDate == nil || tt.want.RecoveryDate == nil || *got.RecoveryDate != *tt.want.RecoveryDate:
+				t.Errorf("maxDrawdown() recovered on %v, want %v", got.RecoveryDate, tt.want.RecoveryDate)
+			}
+		})
+	}
+}
+
+func TestBeta(t *testing.T) {
+	returns := []float64{0.01, -0.02, 0.03, 0.005, -0.01, 0.015}
+	other := []float64{-0.005, 0.01, 0.02, -0.015, 0.0, 0.01}
+	average := make([]float64, len(returns))
+	for i := range returns {
+		average[i] = (returns[i] + other[i]) / 2
+	}
+
+	tests := []struct {
+		name string
+		navs map[string][]navPoint
+		want *float64
+	}{
+		{
+			name: "moves with the benchmark",
+			navs: map[string][]navPoint{
+				"fund": dailySeries("2024-01-01", compounded(returns...)...),
+				"peer": dailySeries("2024-01-01", compounded(returns...)...),
+			},
+			want: ptr(1),
+		},
+		{
+			name: "twice the moves of the benchmark",
+			navs: map[string][]navPoint{
+				"fund": dailySeries("2024-01-01", compounded(scaled(returns, 2)...)...),
+				"peer": dailySeries("2024-01-01", compounded(returns...)...),
+			},
+			want: ptr(2),
+		},
+		{
+			name: "against the benchmark",
+			navs: map[string][]navPoint{
+				"fund": dailySeries("2024-01-01", compounded(scaled(returns, -0.5)...)...),
+				"peer": dailySeries("2024-01-01", compounded(returns...)...),
+			},
+			want: ptr(-0.5),
+		},
+		{
+			name: "benchmark is the average of the peers",
+			navs: map[string][]navPoint{
+				"fund":  dailySeries("2024-01-01", compounded(average...)...),
+				"peer1": dailySeries("2024-01-01", compounded(returns...)...),
+				"peer2": dailySeries("2024-01-01", compounded(other...)...),
+			},
+			want: ptr(1),
+		},
+		{
+			name: "steady fund",
+			navs: map[string][]navPoint{
+				"fund": dailySeries("2024-01-01", compounded(0.001, 0.001, 0.001, 0.001, 0.001, 0.001)...),
+				"peer": dailySeries("2024-01-01", compounded(returns...)...),
+			},
+			want: ptr(0),
+		},
+		{
+			name: "only the dates both have returns",
+			navs: map[string][]navPoint{
+				// the fund has a history before the peer, its returns then don't count
+				"fund": dailySeries("2023-12-29", compounded(append([]float64{0.2, -0.3, 0.1}, scaled(returns, 2)...)...)...),
+				"peer": dailySeries("2024-01-01", compounded(returns...)...),
+			},
+			want: ptr(2),
+		},
+		{
+			name: "no peers",
+			navs: map[string][]navPoint{
+				"fund": dailySeries("2024-01-01", compounded(returns...)...),
+			},
+		},
+		{
+			name: "flat benchmark",
+			navs: map[string][]navPoint{
+				"fund": dailySeries("2024-01-01", compounded(returns...)...),
+				"peer": dailySeries("2024-01-01", 100, 100, 100, 100),
+			},
+		},
+		{
+			name: "a single shared return",
+			navs: map[string][]navPoint{
+				"fund": dailySeries("2024-01-01", compounded(returns...)...),
+				"peer": dailySeries("2024-01-06", 100, 101),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := beta("fund", tt.navs)
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil:
+				t.Errorf("beta() = nil, want %v", *tt.want)
+			case tt.want == nil:
+				t.Errorf("beta() = %v, want nil", *got)
+			case math.Abs(*got-*tt.want) > 1e-9:
+				t.Errorf("beta() = %v, want %v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestRollingReturns(t *testing.T) {
+	// 400 days from 1 January 2021 growing 10% a year, no leap day in between
+	var growing, falling []float64
+	for i := 0; i < 400; i++ {
+		growing = append(growing, 100*math.Pow(1.1, float64(i)/365))
+		falling = append(falling, 100*math.Pow(0.9, float64(i)/365))
+	}
+	daily := make([]time.Time, 400)
+	for i := range daily {
+		daily[i] = time.Date(2021, time.January, 1+i, 0, 0, 0, 0, ist)
+	}
+	// the return of the series over the days
+	over := func(rate float64, days int) float64 {
+		return (math.Pow(rate, float64(days)/365) - 1) * 100
+	}
+	period := func(name string) *analyticsPeriod {
+		for _, p := range analyticsPeriods {
+			if p.Name == name {
+				return &p
+			}
+		}
+		t.Fatalf("no period %s", name)
+		return nil
+	}
+	gapped := []time.Time{
+		time.Date(2024, time.January, 1, 0, 0, 0, 0, ist),
+		time.Date(2024, time.January, 15, 0, 0, 0, 0, ist),
+		time.Date(2024, time.February, 1, 0, 0, 0, 0, ist),
+		time.Date(2024, time.February, 20, 0, 0, 0, 0, ist),
+	}
+
+	tests := []struct {
+		name   string
+		dates  []time.Time
+		index  []float64
+		period *analyticsPeriod
+		want   []RollingReturn
+	}{
+		{
+			name:  "every window that fits the history",
+			dates: daily,
+			index: growing,
+			want: []RollingReturn{
+				// a month back is 28 to 31 days, the windows ending the first 31 days start before the history
+				{Window: "1m", Count: 369, Min: over(1.1, 28), Max: over(1.1, 31), Positive: 100},
+				{Window: "3m", Count: 310, Min: over(1.1, 89), Max: over(1.1, 92), Positive: 100},
+				{Window: "6m", Count: 219, Min: over(1.1, 181), Max: over(1.1, 184), Positive: 100},
+				{Window: "1y", Count: 35, Min: 10, Max: 10, Average: 10, Positive: 100},
+			},
+		},
+		{
+			name:   "windows shorter than the period",
+			dates:  daily,
+			index:  growing,
+			period: period("3m"),
+			want: []RollingReturn{
+				{Window: "1m", Count: 369, Min: over(1.1, 28), Max: over(1.1, 31), Positive: 100},
+			},
+		},
+		{
+			name:   "falling",
+			dates:  daily,
+			index:  falling,
+			period: period("3y"),
+			want: []RollingReturn{
+				{Window: "1m", Count: 369, Min: over(0.9, 31), Max: over(0.9, 28)},
+				{Window: "3m", Count: 310, Min: over(0.9, 92), Max: over(0.9, 89)},
+				{Window: "6m", Count: 219, Min: over(0.9, 184), Max: over(0.9, 181)},
+				{Window: "1y", Count: 35, Min: -10, Max: -10, Average: -10},
+			},
+		},
+		{
+			name:  "window starts at the last nav on or before its first date",
+			dates: gapped,
+			index: []float64{100, 110, 121, 133.1},
+			want: []RollingReturn{
+				// 1 February from 1 January and 20 February from 15 January
+				{Window: "1m", Count: 2, Min: 21, Max: 21, Average: 21, Positive: 100},
+			},
+		},
+		{
+			name:  "history shorter than a month",
+			dates: daily[:20],
+			index: growing[:20],
+			want:  []RollingReturn{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rollingReturns(tt.dates, tt.index, tt.period)
+			if got == nil {
+				t.Fatal("rollingReturns() = nil, want a slice")
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("rollingReturns() = %+v, want %+v", got, tt.want)
+			}
+			for i, want := range tt.want {
+				g := got[i]
+				if g.Window != want.Window || g.Count != want.Count || math.Abs(g.Min-want.Min) > 1e-9 || math.Abs(g.Max-want.Max) > 1e-9 ||
+					math.Abs(g.Positive-want.Positive) > 1e-9 {
+					t.Errorf("rollingReturns()[%d] = %+v, want %+v", i, g, want)
+				}
+				// the average is checked when the windows all have the same length
+				if want.Average != 0 && math.Abs(g.Average-want.Average) > 1e-9 {
+					t.Errorf("rollingReturns()[%d].Average = %v, want %v", i, g.Average, want.Average)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"payment-gateway/internal/ratelimit"
+)
+
+// Identity is the logged in user making a request, resolved from their session token
+type Identity struct {
+	PhoneNumber string
+	SessionID   int64
+	// Roles always include investor, see roles.go
+	Roles []string
+}
+
+type identityKey struct{}
+
+// authenticate only lets requests with a valid `Authorization: Bearer <token>` session token
+// through, with the user's Identity in the request context
+func (a *App) authenticate(f func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.serveAuthenticated(w, r, bearerToken(r), f)
+	}
+}
+
+// authenticateStream is authenticate for GET /stream, which also takes the token in the
+// access_token query parameter since EventSource can't set headers
+func (a *App) authenticateStream(f func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			token = r.URL.Query().Get("access_token")
+		}
+		a.serveAuthenticated(w, r, token, f)
+	}
+}
+
+func (a *App) serveAuthenticated(w http.ResponseWriter, r *http.Request, token string, f func(w http.ResponseWriter, r *http.Request)) {
+	sessionID, phoneNumber, err := a.session(token)
+	if errors.Is(err, errSessionNotFound) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rta"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Default().Println("Error getting session:", err)
+		http.Error(w, "Error checking session", http.StatusInternalServerError)
+		return
+	}
+
+	roles, err := userRoles(a.db, phoneNumber)
+	if err != nil {
+		log.Default().Println("Error getting roles:", err)
+		http.Error(w, "Error checking session", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), identityKey{}, &Identity{PhoneNumber: phoneNumber, SessionID: sessionID, Roles: roles})
+	f(w, r.WithContext(ctx))
+}
+
+// identity returns the user of a request that went through authenticate
+func identity(r *http.Request) *Identity {
+	id, _ := r.Context().Value(identityKey{}).(*Identity)
+	return id
+}
+
+// callerPhoneNumber returns the phone number of the logged in user. A phone number supplied
+// by the client is optional, but must be theirs, otherwise the request is refused with 403.
+// Users allowed to view every account can read, but not change, the account of another user.
+func callerPhoneNumber(w http.ResponseWriter, r *http.Request, supplied string) (string, bool) {
+	id := identity(r)
+	if id == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	if supplied != "" && supplied != id.PhoneNumber {
+		if r.Method == http.MethodGet && id.can(PermViewAccounts) {
+			log.Default().Println("User", id.PhoneNumber, "with roles", id.Roles, "viewed", supplied, "on", r.URL.Path)
+			return supplied, true
+		}
+		log.Default().Println("User", id.PhoneNumber, "asked for", supplied, "on", r.Method, r.URL.Path)
+		http.Error(w, "Phone number does not match the logged in user", http.StatusForbidden)
+		return "", false
+	}
+	return id.PhoneNumber, true
+}
+
+// rateLimitKey identifies the client of a request for rate limiting: the logged in user, else
+// the X-API-Key header when it is an issued key, else the IP address. Expired sessions and
+// unknown keys share the bucket of their IP address.
+func (a *App) rateLimitKey(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		var phoneNumber string
+		err := a.db.QueryRow("SELECT phone_number FROM sessions WHERE token_hash = ? AND revoked_at IS NULL AND expires_at > ?",
+			hashSecret(token), time.Now().UTC().Format(time.DateTime)).Scan(&phoneNumber)
+		if err == nil {
+			return "user:" + phoneNumber
+		}
+	}
+	if apiKey := r.Header.Get("X-API-Key"); a.apiKeys[apiKey] {
+		return "key:" + hashSecret(apiKey)[:16]
+	}
+	return "ip:" + ratelimit.ClientIP(r)
+}
+
+// loadAPIKeys reads the API keys issued to clients of the RTA, a comma separated list in the
+// API_KEYS environment variable. Requests with one are rate limited by their key.
+func loadAPIKeys() map[string]bool {
+	keys := map[string]bool{}
+	for _, key := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys[key] = true
+		}
+	}
+	return keys
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bank account statuses. An account is Verified when the penny drop reached it and the
+// name the bank has for it matches the KYC name of the user.
+const (
+	BankAccountStatusVerified = "Verified"
+	BankAccountStatusFailed   = "Failed"
+)
+
+// Payout statuses of redemption orders, set once the redemption has Succeeded
+const (
+	PayoutStatusSuccess = "Success"
+	PayoutStatusFailed  = "Failed"
+)
+
+// BankAccount is an account of a user, payments are taken from and payouts sent to verified accounts
+type BankAccount struct {
+	ID            int64  `json:"id"`
+	PhoneNumber   string `json:"phoneNumber"`
+	AccountNumber string `json:"accountNumber"`
+	IfscCode      string `json:"ifscCode"`
+	// BeneficiaryName is the name the bank has on record for the account
+	BeneficiaryName *string `json:"beneficiaryName"`
+	Status          string  `json:"status"`
+	// FailureReason is set only when the account is Failed
+	FailureReason *string `json:"failureReason"`
+	PennyDropID   *string `json:"pennyDropId"`
+	CreatedAt     string  `json:"createdAt"`
+	VerifiedAt    *string `json:"verifiedAt"`
+}
+
+// PennyDrop is the result of a penny drop at the payment gateway
+type PennyDrop struct {
+	ID              string  `json:"id"`
+	BeneficiaryName *string `json:"beneficiaryName"`
+	NameMatchScore  float64 `json:"nameMatchScore"`
+	NameMatch       bool    `json:"nameMatch"`
+	Status          string  `json:"status"`
+	FailureReason   *string `json:"failureReason"`
+}
+
+// Payout is money sent to a bank account by the payment gateway
+type Payout struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+var (
+	errBankAccountNotFound    = errors.New("bank account not found")
+	errBankAccountNotVerified = errors.New("bank account is not verified")
+	errBankAccountVerified    = errors.New("bank account is already verified")
+)
+
+const bankAccountColumns = "id, phone_number, account_number, ifsc_code, beneficiary_name, status, failure_reason, penny_drop_id, created_at, verified_at"
+
+func scanBankAccount(row interface{ Scan(...any) error }, b *BankAccount) error {
+	return row.Scan(&b.ID, &b.PhoneNumber, &b.AccountNumber, &b.IfscCode, &b.BeneficiaryName, &b.Status, &b.FailureReason, &b.PennyDropID, &b.CreatedAt, &b.VerifiedAt)
+}
+
+// handler function to add a bank account of a user, verified right away with a penny drop against
+// their KYC name. An account that failed verification can be added again to retry it.
+func (a *App) addBankAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PhoneNumber   string `json:"phoneNumber"`
+		AccountNumber string `json:"accountNumber"`
+		IfscCode      string `json:"ifscCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	phoneNumber, ok := callerPhoneNumber(w, r, req.PhoneNumber)
+	if !ok {
+		return
+	}
+	req.AccountNumber = strings.TrimSpace(req.AccountNumber)
+	req.IfscCode = strings.ToUpper(strings.TrimSpace(req.IfscCode))
+	if req.AccountNumber == "" || req.IfscCode == "" {
+		http.Error(w, "Account number and IFSC code are required", http.StatusBadRequest)
+		return
+	}
+
+	// the name on the account is matched against the verified KYC name
+	if err := a.checkKYC(phoneNumber); err != nil {
+		if errors.Is(err, errKYCNotVerified) {
+			writeErrorCode(w, http.StatusForbidden, ErrorCodeKYCNotVerified, err.Error())
+			return
+		}
+		log.Default().Println("Error checking KYC:", err)
+		http.Error(w, "Error adding bank account", http.StatusInternalServerError)
+		return
+	}
+	kyc, err := a.kycProfile(phoneNumber)
+	if err != nil {
+		log.Default().Println("Error getting KYC:", err)
+		http.Error(w, "Error adding bank account", http.StatusInternalServerError)
+		return
+	}
+
+	var existing BankAccount
+	err = scanBankAccount(a.db.QueryRow("SELECT "+bankAccountColumns+" FROM bank_accounts WHERE phone_number = ? AND account_number = ? AND ifsc_code = ?",
+		phoneNumber, req.AccountNumber, req.IfscCode), &existing)
+	if err == nil && existing.Status == BankAccountStatusVerified {
+		http.Error(w, errBankAccountVerified.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Default().Println("Error getting bank account:", err)
+		http.Error(w, "Error adding bank account", http.StatusInternalServerError)
+		return
+	}
+
+	drop, status, err := a.requestPennyDrop(req.AccountNumber, req.IfscCode, kyc.Name)
+	if err != nil {
+		log.Default().Println("Error requesting penny drop:", err)
+		if status == http.StatusBadRequest {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Couldn't verify the bank account, try again later", http.StatusBadGateway)
+		return
+	}
+
+	accountStatus := BankAccountStatusVerified
+	var failureReason *string
+	switch {
+	case drop.Status != "Success":
+		accountStatus = BankAccountStatusFailed
+		reason := "penny drop failed"
+		if drop.FailureReason != nil {
+			reason = "penny drop failed: " + *drop.FailureReason
+		}
+		failureReason = &reason
+	case !drop.NameMatch:
+		accountStatus = BankAccountStatusFailed
+		reason := fmt.Sprintf("name on the account does not match the KYC name, score %.2f", drop.NameMatchScore)
+		failureReason = &reason
+	}
+
+	now := time.Now().UTC().Format(time.DateTime)
+	var verifiedAt *string
+	if accountStatus == BankAccountStatusVerified {
+		verifiedAt = &now
+	}
+	_, err = a.db.Exec(`INSERT INTO bank_accounts (phone_number, account_number, ifsc_code, beneficiary_name, status, failure_reason, penny_drop_id, created_at, verified_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (phone_number, account_number, ifsc_code) DO UPDATE SET beneficiary_name = excluded.beneficiary_name, status = excluded.status,
+			failure_reason = excluded.failure_reason, penny_drop_id = excluded.penny_drop_id, verified_at = excluded.verified_at`,
+		phoneNumber, req.AccountNumber, req.IfscCode, drop.BeneficiaryName, accountStatus, failureReason, drop.ID, now, verifiedAt)
+	if err != nil {
+		log.Default().Println("Error saving bank account:", err)
+		http.Error(w, "Error adding bank account", http.StatusInternalServerError)
+		return
+	}
+	log.Default().Println("Bank account", req.AccountNumber, "of", phoneNumber, "is", accountStatus)
+
+	var account BankAccount
+	err = scanBankAccount(a.db.QueryRow("SELECT "+bankAccountColumns+" FROM bank_accounts WHERE phone_number = ? AND account_number = ? AND ifsc_code = ?",
+		phoneNumber, req.AccountNumber, req.IfscCode), &account)
+	if err != nil {
+		log.Default().Println("Error getting bank account:", err)
+		http.Error(w, "Error adding bank account", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    account,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// postToGateway posts the json body to a payment gateway route only services can call, with the
+// API key the gateway issued to the RTA
+func (a *App) postToGateway(path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, a.paymentGatewayUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", a.paymentGatewayAPIKey)
+	return http.DefaultClient.Do(req)
+}
+
+// requestPennyDrop asks the payment gateway to verify the account with a penny drop. On error it
+// also returns the status code of the gateway, 0 if it couldn't be reached.
+func (a *App) requestPennyDrop(accountNumber, ifscCode, name string) (*PennyDrop, int, error) {
+	body, err := json.Marshal(map[string]string{
+		"accountNumber": accountNumber,
+		"ifscCode":      ifscCode,
+		"name":          name,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := a.postToGateway("/penny-drop", body)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("error reading penny drop response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, errors.New(strings.TrimSpace(string(respBody)))
+	}
+
+	var drop PennyDrop
+	if err := json.Unmarshal(respBody, &drop); err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("error decoding penny drop response: %w. response %+v", err, string(respBody))
+	}
+	return &drop, resp.StatusCode, nil
+}
+
+// handler function to list the bank accounts of a user
+func (a *App) listBankAccounts(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := callerPhoneNumber(w, r, r.URL.Query().Get("phoneNumber"))
+	if !ok {
+		return
+	}
+
+	rows, err := a.db.Query("SELECT "+bankAccountColumns+" FROM bank_accounts WHERE phone_number = ? ORDER BY id", phoneNumber)
+	if err != nil {
+		log.Default().Println("Error listing bank accounts:", err)
+		http.Error(w, "Error retrieving bank accounts", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accounts := []BankAccount{}
+	for rows.Next() {
+		var b BankAccount
+		if err := scanBankAccount(rows, &b); err != nil {
+			log.Default().Println("Error reading bank account:", err)
+			http.Error(w, "Error retrieving bank accounts", http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, b)
+	}
+	if err := rows.Err(); err != nil {
+		log.Default().Println("Error listing bank accounts:", err)
+		http.Error(w, "Error retrieving bank accounts", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    accounts,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handler function to remove a bank account of the logged in user
+func (a *App) deleteBankAccountHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid bank account id", http.StatusBadRequest)
+		return
+	}
+	phoneNumber := identity(r).PhoneNumber
+
+	res, err := a.db.Exec("DELETE FROM bank_accounts WHERE id = ? AND phone_number = ?", id, phoneNumber)
+	if err != nil {
+		log.Default().Println("Error deleting bank account:", err)
+		http.Error(w, "Error deleting bank account", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Bank account not found", http.StatusNotFound)
+		return
+	}
+	log.Default().Println("Deleted bank account", id, "of", phoneNumber)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isVerifiedBankAccount reports whether the account is a verified bank account of the user
+func (a *App) isVerifiedBankAccount(phoneNumber, accountNumber, ifscCode string) (bool, error) {
+	var count int
+	err := a.db.QueryRow("SELECT COUNT(*) FROM bank_accounts WHERE phone_number = ? AND account_number = ? AND ifsc_code = ? AND status = ?",
+		phoneNumber, accountNumber, strings.ToUpper(ifscCode), BankAccountStatusVerified).Scan(&count)
+	return count > 0, err
+}
+
+// payoutAccount returns the verified bank account of the user to pay a redemption out to, the one
+// given or else the first verified one
+func (a *App) payoutAccount(phoneNumber string, id int64) (*BankAccount, error) {
+	query := "SELECT " + bankAccountColumns + " FROM bank_accounts WHERE phone_number = ?"
+	args := []any{phoneNumber}
+	if id != 0 {
+		query += " AND id = ?"
+		args = append(args, id)
+	}
+	query += " ORDER BY status = ? DESC, id LIMIT 1"
+	args = append(args, BankAccountStatusVerified)
+
+	var b BankAccount
+	err := scanBankAccount(a.db.QueryRow(query, args...), &b)
+	if errors.Is(err, sql.ErrNoRows) {
+		if id != 0 {
+			return nil, errBankAccountNotFound
+		}
+		return nil, fmt.Errorf("%s has no bank account, %w", phoneNumber, errBankAccountNotVerified)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.Status != BankAccountStatusVerified {
+		return nil, fmt.Errorf("bank account %d is %s, %w", b.ID, b.Status, errBankAccountNotVerified)
+	}
+	return &b, nil
+}
+
+// payOut sends the proceeds of a Succeeded redemption order to its bank account and records
+// the payout on the order
+func (a *App) payOut(orderID string) {
+	var amount Money
+	var accountNumber, ifscCode sql.NullString
+	err := a.db.QueryRow(`SELECT o.amount, b.account_number, b.ifsc_code FROM orders o LEFT JOIN bank_accounts b ON b.id = o.bank_account_id
+		WHERE o.uuid = ?`, orderID).Scan(&amount, &accountNumber, &ifscCode)
+	if err != nil {
+		log.Default().Println("Error getting payout details:", err)
+		return
+	}
+
+	status := PayoutStatusFailed
+	var payoutID *string
+	if !accountNumber.Valid {
+		log.Default().Println("Bank account of order", orderID, "was removed, payout failed")
+	} else {
+		payout, err := a.retryRequestPayout(accountNumber.String, ifscCode.String, amount, orderID, 2) // Retry 2 times
+		if err != nil {
+			log.Default().Println("Error paying out order", orderID+":", err)
+		} else {
+			status, payoutID = payout.Status, &payout.ID
+		}
+	}
+
+	_, err = a.db.Exec("UPDATE orders SET payout_id = ?, payout_status = ? WHERE uuid = ?", payoutID, status, orderID)
+	if err != nil {
+		log.Default().Println("Error updating payout status:", err)
+		return
+	}
+	orderChanges.notify(orderID)
+	a.publishOrderUpdate(orderID)
+	log.Default().Println("Payout of order", orderID, "is", status)
+}
+
+func (a *App) retryRequestPayout(accountNumber, ifscCode string, amount Money, reference string, retryCount int) (*Payout, error) {
+	var err error
+	for i := 0; i < retryCount; i++ {
+		var payout *Payout
+		payout, err = a.requestPayout(accountNumber, ifscCode, amount, reference)
+		if err == nil {
+			return payout, nil
+		}
+		log.Printf("Error requesting payout (attempt %d/%d): %v", i+1, retryCount, err)
+		time.Sleep(1 * time.Second) // Add a delay between retries
+	}
+	return nil, err
+}
+
+func (a *App) requestPayout(accountNumber, ifscCode string, amount Money, reference string) (*Payout, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"accountNumber": accountNumber,
+		"ifscCode":      ifscCode,
+		"amount":        amount,
+		"reference":     reference,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.postToGateway("/payout", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading payout response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("payout returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var payout Payout
+	if err := json.Unmarshal(respBody, &payout); err != nil {
+		return nil, fmt.Errorf("error decoding payout response: %w. response %+v", err, string(respBody))
+	}
+	return &payout, nil
+}
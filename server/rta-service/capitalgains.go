@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Indian financial years run from 1 April to 31 March in IST
+var ist = time.FixedZone("IST", 5*60*60+30*60)
+
+var (
+	// Equity units bought before this date are grandfathered at their fair market value of 31 January 2018
+	grandfatheringCutoff = time.Date(2018, time.February, 1, 0, 0, 0, 0, ist)
+	// Debt units bought from this date are specified mutual fund units, their gains are always short term
+	specifiedFundCutoff = time.Date(2023, time.April, 1, 0, 0, 0, 0, ist)
+	// Debt units redeemed from this date are long term after 24 months instead of 36
+	debtHoldingPeriodChange = time.Date(2024, time.July, 23, 0, 0, 0, 0, ist)
+)
+
+// CapitalGain is the gain on the units of one lot sold by a redemption
+type CapitalGain struct {
+	Fund        string `json:"fund"`
+	AssetClass  string `json:"assetClass"`
+	Units       Units  `json:"units"`
+	PurchasedAt string `json:"purchasedAt"`
+	RedeemedAt  string `json:"redeemedAt"`
+	SaleValue   Money  `json:"saleValue"`
+	// ExitLoad is deducted from the sale value as a transfer expense
+	ExitLoad   Money `json:"exitLoad"`
+	ActualCost Money `json:"actualCost"`
+	// FairMarketValue is the value of the units on 31 January 2018, set for grandfathered lots
+	FairMarketValue   *Money `json:"fairMarketValue"`
+	CostOfAcquisition Money  `json:"costOfAcquisition"`
+	Gain              Money  `json:"gain"`
+	// Term is ShortTerm or LongTerm
+	Term string `json:"term"`
+}
+
+const (
+	ShortTerm = "ShortTerm"
+	LongTerm  = "LongTerm"
+)
+
+// GainsSummary totals the gains of one term
+type GainsSummary struct {
+	Units             Units `json:"units"`
+	SaleValue         Money `json:"saleValue"`
+	ExitLoad          Money `json:"exitLoad"`
+	CostOfAcquisition Money `json:"costOfAcquisition"`
+	Gain              Money `json:"gain"`
+}
+
+func (s *GainsSummary) add(g CapitalGain) {
+	s.Units += g.Units
+	s.SaleValue += g.SaleValue
+	s.ExitLoad += g.ExitLoad
+	s.CostOfAcquisition += g.CostOfAcquisition
+	s.Gain += g.Gain
+}
+
+// FundGains are the capital gains made on a fund in the financial year
+type FundGains struct {
+	Fund       string       `json:"fund"`
+	AssetClass string       `json:"assetClass"`
+	ShortTerm  GainsSummary `json:"shortTerm"`
+	LongTerm   GainsSummary `json:"longTerm"`
+}
+
+var financialYearPattern = regexp.MustCompile(`^(\d{4})-(\d{2})$`)
+
+// parseFinancialYear parses a financial year like 2025-26 into its first instant and the first instant of the next year
+func parseFinancialYear(fy string) (time.Time, time.Time, error) {
+	m := financialYearPattern.FindStringSubmatch(fy)
+	if m == nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("financial year must look like 2025-26")
+	}
+	start, _ := strconv.Atoi(m[1])
+	end, _ := strconv.Atoi(m[2])
+	if (start+1)%100 != end {
+		return time.Time{}, time.Time{}, fmt.Errorf("financial year must span consecutive years, like 2025-26")
+	}
+	from := time.Date(start, time.April, 1, 0, 0, 0, 0, ist)
+	return from, from.AddDate(1, 0, 0), nil
+}
+
+// financialYearOf returns the first instant of the financial year the time falls in and the first instant of the next year
+func financialYearOf(t time.Time) (time.Time, time.Time) {
+	t = t.In(ist)
+	year := t.Year()
+	if t.Month() < time.April {
+		year--
+	}
+	from := time.Date(year, time.April, 1, 0, 0, 0, 0, ist)
+	return from, from.AddDate(1, 0, 0)
+}
+
+// isLongTerm applies the holding period rules for capital gains on mutual fund units
+func isLongTerm(assetClass string, purchasedAt, redeemedAt time.Time) bool {
+	if assetClass == AssetClassEquity {
+		return redeemedAt.After(purchasedAt.AddDate(1, 0, 0))
+	}
+	if !purchasedAt.Before(specifiedFundCutoff) {
+		return false
+	}
+	months := 36
+	if !redeemedAt.Before(debtHoldingPeriodChange) {
+		months = 24
+	}
+	return redeemedAt.After(purchasedAt.AddDate(0, months, 0))
+}
+
+// handler function to get the capital gains of a user in a financial year, e.g. ?fy=2025-26
+func (a *App) capitalGainsHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := callerPhoneNumber(w, r, r.URL.Query().Get("phoneNumber"))
+	if !ok {
+		return
+	}
+	fy := r.URL.Query().Get("fy")
+	from, to, err := parseFinancialYear(fy)
+	if err != nil {
+		http.Error(w, "Invalid fy, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gains, err := a.capitalGains(phoneNumber, from, to)
+	if err != nil {
+		log.Default().Println("Error computing capital gains:", err)
+		http.Error(w, "Error computing capital gains", http.StatusInternalServerError)
+		return
+	}
+
+	var funds []*FundGains
+	byFund := map[string]*FundGains{}
+	var shortTerm, longTerm GainsSummary
+	for _, g := range gains {
+		f := byFund[g.Fund]
+		if f == nil {
+			f = &FundGains{Fund: g.Fund, AssetClass: g.AssetClass}
+			byFund[g.Fund] = f
+			funds = append(funds, f)
+		}
+		if g.Term == LongTerm {
+			f.LongTerm.add(g)
+			longTerm.add(g)
+		} else {
+			f.ShortTerm.add(g)
+			shortTerm.add(g)
+		}
+	}
+	if funds == nil {
+		funds = []*FundGains{}
+	}
+
+	resp := map[string]interface{}{
+		"data": map[string]interface{}{
+			"financialYear": fy,
+			"shortTerm":     shortTerm,
+			"longTerm":      longTerm,
+			"funds":         funds,
+			"transactions":  gains,
+		},
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// capitalGains returns the gains on every lot redeemed by the user between from and to
+func (a *App) capitalGains(phoneNumber string, from, to time.Time) ([]CapitalGain, error) {
+	rows, err := a.db.Query(`SELECT fund, units, purchased_at, cost_per_unit, redeemed_at, redemption_price, COALESCE(exit_load, 0) FROM lot_redemptions
+		WHERE phone_number = ? AND redeemed_at >= ? AND redeemed_at < ? ORDER BY fund, redeemed_at, id`,
+		phoneNumber, from.UTC().Format(time.DateTime), to.UTC().Format(time.DateTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type lotRedemption struct {
+		fund                    string
+		units                   Units
+		cost, price             float64
+		exitLoad                Money
+		purchasedAt, redeemedAt time.Time
+	}
+	var redemptions []lotRedemption
+	for rows.Next() {
+		var lr lotRedemption
+		if err := rows.Scan(&lr.fund, &lr.units, &lr.purchasedAt, &lr.cost, &lr.redeemedAt, &lr.price, &lr.exitLoad); err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, lr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	gains := []CapitalGain{}
+	fairMarketValues := map[string]*float64{}
+	for _, lr := range redemptions {
+		fundC.Lock()
+		assetClass := fundC.Funds[lr.fund].AssetClass
+		fundC.Unlock()
+
+		g := CapitalGain{
+			Fund:        lr.fund,
+			AssetClass:  assetClass,
+			Units:       lr.units,
+			PurchasedAt: lr.purchasedAt.Format(time.RFC3339),
+			RedeemedAt:  lr.redeemedAt.Format(time.RFC3339),
+			SaleValue:   lr.units.valueAt(lr.price),
+			ExitLoad:    lr.exitLoad,
+			ActualCost:  lr.units.valueAt(lr.cost),
+			Term:        ShortTerm,
+		}
+		if isLongTerm(assetClass, lr.purchasedAt, lr.redeemedAt) {
+			g.Term = LongTerm
+		}
+
+		g.CostOfAcquisition = g.ActualCost
+		if assetClass == AssetClassEquity && lr.purchasedAt.Before(grandfatheringCutoff) {
+			if _, ok := fairMarketValues[lr.fund]; !ok {
+				fmv, err := a.grandfatheredNav(lr.fund)
+				if err != nil {
+					return nil, err
+				}
+				fairMarketValues[lr.fund] = fmv
+			}
+			if nav := fairMarketValues[lr.fund]; nav != nil {
+				fmv := lr.units.valueAt(*nav)
+				g.FairMarketValue = &fmv
+				// cost is the higher of the actual cost and the lower of the fair market value and the sale value
+				g.CostOfAcquisition = max(g.ActualCost, min(fmv, g.SaleValue))
+			}
+		}
+		g.Gain = g.SaleValue - g.ExitLoad - g.CostOfAcquisition
+		gains = append(gains, g)
+	}
+	return gains, nil
+}
+
+// grandfatheredNav returns the last nav of the fund declared on or before 31 January 2018,
+// or nil when the nav history doesn't go back that far
+func (a *App) grandfatheredNav(fund string) (*float64, error) {
+	var nav float64
+	err := a.db.QueryRow("SELECT nav FROM nav_history WHERE fund = ? AND declared_at < ? ORDER BY declared_at DESC LIMIT 1",
+		fund, grandfatheringCutoff.UTC().Format(time.DateTime)).Scan(&nav)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &nav, nil
+}
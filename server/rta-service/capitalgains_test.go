@@ -0,0 +1,288 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFinancialYear(t *testing.T) {
+	tests := []struct {
+		fy       string
+		from, to time.Time
+		err      bool
+	}{
+		{fy: "2024-25", from: time.Date(2024, time.April, 1, 0, 0, 0, 0, ist), to: time.Date(2025, time.April, 1, 0, 0, 0, 0, ist)},
+		{fy: "1999-00", from: time.Date(1999, time.April, 1, 0, 0, 0, 0, ist), to: time.Date(2000, time.April, 1, 0, 0, 0, 0, ist)},
+		{fy: "2024-26", err: true},
+		{fy: "2024-2025", err: true},
+		{fy: "2024", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fy, func(t *testing.T) {
+			from, to, err := parseFinancialYear(tt.fy)
+			if (err != nil) != tt.err {
+				t.Fatalf("parseFinancialYear() error = %v, want error %v", err, tt.err)
+			}
+			if !from.Equal(tt.from) || !to.Equal(tt.to) {
+				t.Errorf("parseFinancialYear() = %v, %v, want %v, %v", from, to, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestCapitalGains(t *testing.T) {
+	const phoneNumber = "9000000002"
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, ist)
+	}
+	money := func(v Money) *Money {
+		return &v
+	}
+	// navs of Growth Fund 1 around 31 January 2018, Growth Fund 2 has no history that far back
+	navs := []struct {
+		declaredAt time.Time
+		nav        float64
+	}{
+		{date(2018, time.January, 15), 18},
+		{date(2018, time.January, 31), 20},
+		{date(2018, time.February, 1), 50},
+	}
+
+	tests := []struct {
+		name                    string
+		fund                    string
+		purchasedAt, redeemedAt time.Time
+		cost, price             float64
+		exitLoad                Money
+
+		// none is set when the redemption falls outside the financial year
+		none              bool
+		term              string
+		fairMarketValue   *Money
+		costOfAcquisition Money
+		gain              Money
+	}{
+		{
+			name:              "equity held over a year",
+			fund:              "Growth Fund 1",
+			purchasedAt:       date(2023, time.May, 1),
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              10,
+			price:             15,
+			term:              LongTerm,
+			costOfAcquisition: 100 * Rupee,
+			gain:              50 * Rupee,
+		},
+		{
+			name:              "equity held a year to the day",
+			fund:              "Growth Fund 1",
+			purchasedAt:       date(2023, time.June, 1),
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              10,
+			price:             15,
+			term:              ShortTerm,
+			costOfAcquisition: 100 * Rupee,
+			gain:              50 * Rupee,
+		},
+		{
+			name:              "exit load is deducted from the gain",
+			fund:              "Growth Fund 1",
+			purchasedAt:       date(2024, time.January, 1),
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              10,
+			price:             15,
+			exitLoad:          150,
+			term:              ShortTerm,
+			costOfAcquisition: 100 * Rupee,
+			gain:              4850,
+		},
+		{
+			name:              "equity loss",
+			fund:              "Growth Fund 1",
+			purchasedAt:       date(2024, time.January, 1),
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              10,
+			price:             8,
+			term:              ShortTerm,
+			costOfAcquisition: 100 * Rupee,
+			gain:              -20 * Rupee,
+		},
+		{
+			name:              "grandfathered at the fair market value",
+			fund:              "Growth Fund 1",
+			purchasedAt:       date(2017, time.June, 1),
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              10,
+			price:             30,
+			term:              LongTerm,
+			fairMarketValue:   money(200 * Rupee),
+			costOfAcquisition: 200 * Rupee,
+			gain:              100 * Rupee,
+		},
+		{
+			name:              "grandfathered sold below the fair market value",
+			fund:              "Growth Fund 1",
+			purchasedAt:       date(2017, time.June, 1),
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              10,
+			price:             15,
+			term:              LongTerm,
+			fairMarketValue:   money(200 * Rupee),
+			costOfAcquisition: 150 * Rupee,
+			gain:              0,
+		},
+		{
+			name:              "grandfathered bought above the fair market value",
+			fund:              "Growth Fund 1",
+			purchasedAt:       date(2017, time.June, 1),
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              25,
+			price:             30,
+			term:              LongTerm,
+			fairMarketValue:   money(200 * Rupee),
+			costOfAcquisition: 250 * Rupee,
+			gain:              50 * Rupee,
+		},
+		{
+			name:              "grandfathered without nav history",
+			fund:              "Growth Fund 2",
+			purchasedAt:       date(2017, time.June, 1),
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              10,
+			price:             30,
+			term:              LongTerm,
+			costOfAcquisition: 100 * Rupee,
+			gain:              200 * Rupee,
+		},
+		{
+			name:              "bought on the grandfathering cutoff",
+			fund:              "Growth Fund 1",
+			purchasedAt:       grandfatheringCutoff,
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              10,
+			price:             30,
+			term:              LongTerm,
+			costOfAcquisition: 100 * Rupee,
+			gain:              200 * Rupee,
+		},
+		{
+			name:              "debt units are not grandfathered",
+			fund:              "Balanced Fund 1",
+			purchasedAt:       date(2017, time.June, 1),
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              10,
+			price:             30,
+			term:              LongTerm,
+			costOfAcquisition: 100 * Rupee,
+			gain:              200 * Rupee,
+		},
+		{
+			name:              "debt held over 36 months",
+			fund:              "Balanced Fund 1",
+			purchasedAt:       date(2021, time.January, 1),
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              10,
+			price:             15,
+			term:              LongTerm,
+			costOfAcquisition: 100 * Rupee,
+			gain:              50 * Rupee,
+		},
+		{
+			name:              "debt held 29 months redeemed before the change",
+			fund:              "Balanced Fund 1",
+			purchasedAt:       date(2022, time.January, 1),
+			redeemedAt:        date(2024, time.June, 1),
+			cost:              10,
+			price:             15,
+			term:              ShortTerm,
+			costOfAcquisition: 100 * Rupee,
+			gain:              50 * Rupee,
+		},
+		{
+			name:              "debt held 25 months redeemed after the change",
+			fund:              "Balanced Fund 1",
+			purchasedAt:       date(2022, time.July, 1),
+			redeemedAt:        date(2024, time.August, 1),
+			cost:              10,
+			price:             15,
+			term:              LongTerm,
+			costOfAcquisition: 100 * Rupee,
+			gain:              50 * Rupee,
+		},
+		{
+			name:              "specified fund units",
+			fund:              "Balanced Fund 1",
+			purchasedAt:       specifiedFundCutoff,
+			redeemedAt:        date(2025, time.March, 31),
+			cost:              10,
+			price:             15,
+			term:              ShortTerm,
+			costOfAcquisition: 100 * Rupee,
+			gain:              50 * Rupee,
+		},
+		{
+			name:        "redeemed in the next financial year",
+			fund:        "Growth Fund 1",
+			purchasedAt: date(2023, time.May, 1),
+			redeemedAt:  date(2025, time.April, 1),
+			cost:        10,
+			price:       15,
+			none:        true,
+		},
+	}
+
+	from, to, err := parseFinancialYear("2024-25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t)
+			for _, n := range navs {
+				_, err := a.db.Exec("INSERT INTO nav_history (fund, nav, declared_at) VALUES (?, ?, ?)", "Growth Fund 1", n.nav, n.declaredAt.UTC().Format(time.DateTime))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := a.db.Exec(`INSERT INTO lot_redemptions (redemption_order_uuid, lot_id, phone_number, fund, units, purchased_at, cost_per_unit, redeemed_at, redemption_price, exit_load)
+				VALUES ('redemption', 1, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				phoneNumber, tt.fund, 10*Unit, tt.purchasedAt.UTC().Format(time.DateTime), tt.cost, tt.redeemedAt.UTC().Format(time.DateTime), tt.price, tt.exitLoad)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gains, err := a.capitalGains(phoneNumber, from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.none {
+				if len(gains) != 0 {
+					t.Errorf("capitalGains() = %+v, want none", gains)
+				}
+				return
+			}
+			if len(gains) != 1 {
+				t.Fatalf("capitalGains() returned %d gains, want 1", len(gains))
+			}
+			g := gains[0]
+			if g.Term != tt.term {
+				t.Errorf("Term = %s, want %s", g.Term, tt.term)
+			}
+			if g.ActualCost != (10 * Unit).valueAt(tt.cost) {
+				t.Errorf("ActualCost = %s, want %s", g.ActualCost, (10 * Unit).valueAt(tt.cost))
+			}
+			switch {
+			case g.FairMarketValue == nil && tt.fairMarketValue == nil:
+			case g.FairMarketValue == nil || tt.fairMarketValue == nil || *g.FairMarketValue != *tt.fairMarketValue:
+				t.Errorf("FairMarketValue = %v, want %v", g.FairMarketValue, tt.fairMarketValue)
+			}
+			if g.CostOfAcquisition != tt.costOfAcquisition {
+				t.Errorf("CostOfAcquisition = %s, want %s", g.CostOfAcquisition, tt.costOfAcquisition)
+			}
+			if g.Gain != tt.gain {
+				t.Errorf("Gain = %s, want %s", g.Gain, tt.gain)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// chargeRule is a charge deducted from the amount of a purchase before units are allotted
+type chargeRule struct {
+	Name string `json:"name"`
+	// Percentage is charged on the amount left after the charges before this one
+	Percentage float64 `json:"percentage"`
+	// Flat is charged per order
+	Flat Money `json:"flat"`
+	// MinAmount is the least order amount the charge applies to
+	MinAmount Money `json:"minAmount"`
+	// Funds the charge applies to, every fund when empty
+	Funds []string `json:"funds"`
+}
+
+// stampDuty is levied on every purchase, after the charges set in CHARGES
+var stampDuty = chargeRule{Name: "Stamp Duty", Percentage: 0.005}
+
+// OrderCharge is one charge deducted from a purchase
+type OrderCharge struct {
+	Name   string `json:"name"`
+	Amount Money  `json:"amount"`
+}
+
+// OrderCharges are the charges of an order, stored as json in its charges column
+type OrderCharges []OrderCharge
+
+// Scan implements sql.Scanner
+func (c *OrderCharges) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	case []byte:
+		return json.Unmarshal(v, c)
+	}
+	return fmt.Errorf("unsupported charges %T", src)
+}
+
+// Value implements driver.Valuer
+func (c OrderCharges) Value() (driver.Value, error) {
+	b, err := json.Marshal(c)
+	return string(b), err
+}
+
+// loadChargeRules returns the charges set in the CHARGES environment variable as a json list,
+// e.g. [{"name":"Transaction Charge","flat":100,"minAmount":10000}], followed by stamp duty
+func loadChargeRules() []chargeRule {
+	v := os.Getenv("CHARGES")
+	if v == "" {
+		return []chargeRule{stampDuty}
+	}
+	var rules []chargeRule
+	if err := json.Unmarshal([]byte(v), &rules); err != nil {
+		log.Fatal("invalid CHARGES: ", err)
+	}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			log.Fatal("invalid CHARGES: every charge needs a name")
+		}
+		if strings.EqualFold(rule.Name, stampDuty.Name) {
+			log.Fatalf("invalid CHARGES: %s is always charged and can't be set", stampDuty.Name)
+		}
+		if rule.Percentage < 0 || rule.Percentage > 100 || rule.Flat < 0 || rule.MinAmount < 0 {
+			log.Fatalf("invalid CHARGES: %s must have a percentage between 0 and 100, and a flat charge and minimum amount that are not negative", rule.Name)
+		}
+	}
+	return append(rules, stampDuty)
+}
+
+// applyCharges returns the charges of a purchase of the fund in the order of the rules, and
+// the amount left for units once they are deducted
+func applyCharges(rules []chargeRule, fund string, amount Money) (OrderCharges, Money) {
+	charges := OrderCharges{}
+	net := amount
+	for _, rule := range rules {
+		if amount < rule.MinAmount || (len(rule.Funds) > 0 && !slices.Contains(rule.Funds, fund)) {
+			continue
+		}
+		charge := rule.Flat + net.percent(rule.Percentage)
+		if charge <= 0 {
+			continue
+		}
+		charges = append(charges, OrderCharge{Name: rule.Name, Amount: charge})
+		net -= charge
+	}
+	return charges, net
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Dividend is an IDCW declaration of a fund. Every unit held when the nav of the record date is
+// declared earns AmountPerUnit, and that nav drops by AmountPerUnit from the last one.
+type Dividend struct {
+	ID         int64  `json:"id"`
+	Fund       string `json:"fund"`
+	RecordDate string `json:"recordDate"`
+	// AmountPerUnit is in rupees, like navs it isn't rounded
+	AmountPerUnit float64 `json:"amountPerUnit"`
+	// Status is Declared until the record date nav pays the holders, then Paid
+	Status string `json:"status"`
+	// ExDividendNav is the nav declared on the record date, set once Paid
+	ExDividendNav *float64 `json:"exDividendNav"`
+	DeclaredBy    string   `json:"declaredBy"`
+	DeclaredAt    string   `json:"declaredAt"`
+	PaidAt        *string  `json:"paidAt"`
+}
+
+const (
+	DividendStatusDeclared = "Declared"
+	DividendStatusPaid     = "Paid"
+)
+
+// Dividend options of a holding, the dividends of holdings without one are paid out
+const (
+	DividendOptionPayout       = "Payout"
+	DividendOptionReinvestment = "Reinvestment"
+)
+
+const dividendColumns = "id, fund, record_date, amount_per_unit, status, ex_dividend_nav, declared_by, declared_at, paid_at"
+
+func scanDividend(row interface{ Scan(...any) error }, d *Dividend) error {
+	return row.Scan(&d.ID, &d.Fund, &d.RecordDate, &d.AmountPerUnit, &d.Status, &d.ExDividendNav, &d.DeclaredBy, &d.DeclaredAt, &d.PaidAt)
+}
+
+// tdsRule is the tax deducted at source from dividends. Rate percent of a dividend is withheld once
+// the dividends paid to the investor by the AMC in the financial year, this one included, exceed Threshold.
+type tdsRule struct {
+	Rate      float64
+	Threshold Money
+}
+
+// loadTDSRule returns the TDS on dividends, 10% above 10,000 rupees a year unless DIVIDEND_TDS_RATE
+// or DIVIDEND_TDS_THRESHOLD (in rupees) override them
+func loadTDSRule() tdsRule {
+	rule := tdsRule{Rate: 10, Threshold: 10000 * Rupee}
+	if v := os.Getenv("DIVIDEND_TDS_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 100 {
+			log.Fatal("invalid DIVIDEND_TDS_RATE: must be a percentage between 0 and 100")
+		}
+		rule.Rate = rate
+	}
+	if v := os.Getenv("DIVIDEND_TDS_THRESHOLD"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil || threshold < 0 {
+			log.Fatal("invalid DIVIDEND_TDS_THRESHOLD: must be an amount that is not negative")
+		}
+		rule.Threshold = rupees(threshold)
+	}
+	return rule
+}
+
+// handler function for operators to declare a dividend of a fund, e.g. {"recordDate":"2026-10-20","amountPerUnit":1.5}
+func (a *App) declareDividendHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RecordDate    string  `json:"recordDate"`
+		AmountPerUnit float64 `json:"amountPerUnit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name := r.PathValue("fund")
+	fundC.Lock()
+	fund, ok := fundC.Funds[name]
+	fundC.Unlock()
+	if !ok {
+		http.Error(w, "Fund not found", http.StatusNotFound)
+		return
+	}
+
+	if fund.inNFO() {
+		http.Error(w, fmt.Sprintf("%s is in its NFO, dividends can be declared once it is allotted", name), http.StatusConflict)
+		return
+	}
+
+	recordDate, err := time.ParseInLocation(time.DateOnly, req.RecordDate, ist)
+	if err != nil {
+		http.Error(w, "Invalid recordDate, expected YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	today := time.Now().In(ist).Format(time.DateOnly)
+	if req.RecordDate < today {
+		http.Error(w, "Invalid recordDate, must not be before today", http.StatusBadRequest)
+		return
+	}
+	// the nav can't drop below zero, navs of the fund never go below the lower of its bounds
+	lowestNav := min(fund.NavMin, fund.NavMax)
+	if req.AmountPerUnit <= 0 || req.AmountPerUnit >= lowestNav {
+		http.Error(w, fmt.Sprintf("Invalid amountPerUnit, must be more than 0 and less than %s, the lowest nav of the fund", formatAmount(lowestNav)), http.StatusBadRequest)
+		return
+	}
+
+	var exists int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM dividends WHERE fund = ? AND record_date = ?", name, req.RecordDate).Scan(&exists); err != nil {
+		log.Default().Println("Error checking dividends:", err)
+		http.Error(w, "Error declaring dividend", http.StatusInternalServerError)
+		return
+	}
+	if exists > 0 {
+		http.Error(w, fmt.Sprintf("A dividend of %s is already declared for %s", name, req.RecordDate), http.StatusConflict)
+		return
+	}
+
+	res, err := a.db.Exec("INSERT INTO dividends (fund, record_date, amount_per_unit, status, declared_by, declared_at) VALUES (?, ?, ?, ?, ?, ?)",
+		name, recordDate.Format(time.DateOnly), req.AmountPerUnit, DividendStatusDeclared, identity(r).PhoneNumber, time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		log.Default().Println("Error declaring dividend:", err)
+		http.Error(w, "Error declaring dividend", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	log.Default().Println(identity(r).PhoneNumber, "declared a dividend of", req.AmountPerUnit, "per unit of", name, "for", req.RecordDate)
+
+	var d Dividend
+	if err := scanDividend(a.db.QueryRow("SELECT "+dividendColumns+" FROM dividends WHERE id = ?", id), &d); err != nil {
+		log.Default().Println("Error getting dividend:", err)
+		http.Error(w, "Error declaring dividend", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]interface{}{
+		"data":    d,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handler function to list the dividends declared by a fund, latest record date first
+func (a *App) listDividends(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("fund")
+	fundC.Lock()
+	_, ok := fundC.Funds[name]
+	fundC.Unlock()
+	if !ok {
+		http.Error(w, "Fund not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := a.db.Query("SELECT "+dividendColumns+" FROM dividends WHERE fund = ? ORDER BY record_date DESC", name)
+	if err != nil {
+		log.Default().Println("Error listing dividends:", err)
+		http.Error(w, "Error listing dividends", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	dividends := []Dividend{}
+	for rows.Next() {
+		var d Dividend
+		if err := scanDividend(rows, &d); err != nil {
+			log.Default().Println("Error scanning dividend:", err)
+			http.Error(w, "Error listing dividends", http.StatusInternalServerError)
+			return
+		}
+		dividends = append(dividends, d)
+	}
+	if err := rows.Err(); err != nil {
+		log.Default().Println("Error listing dividends:", err)
+		http.Error(w, "Error listing dividends", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    dividends,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handler function to choose whether the dividends of a fund held in a folio are paid out or reinvested
+func (a *App) setDividendOptionHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Option string `json:"option"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Option != DividendOptionPayout && req.Option != DividendOptionReinvestment {
+		http.Error(w, "Invalid option, must be Payout or Reinvestment", http.StatusBadRequest)
+		return
+	}
+	phoneNumber, ok := callerPhoneNumber(w, r, "")
+	if !ok {
+		return
+	}
+
+	folioNumber, fund := r.PathValue("folioNumber"), r.PathValue("fund")
+	amc, ok := fundAMC(fund)
+	if !ok {
+		http.Error(w, "Fund not found", http.StatusNotFound)
+		return
+	}
+	err := a.checkFolio(phoneNumber, amc, folioNumber)
+	if errors.Is(err, errFolioNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Default().Println("Error checking folio:", err)
+		http.Error(w, "Error setting dividend option", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = a.db.Exec("INSERT OR REPLACE INTO dividend_options (folio_number, fund, phone_number, option, updated_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		folioNumber, fund, phoneNumber, req.Option)
+	if err != nil {
+		log.Default().Println("Error setting dividend option:", err)
+		http.Error(w, "Error setting dividend option", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data": map[string]string{
+			"folioNumber": folioNumber,
+			"fund":        fund,
+			"option":      req.Option,
+		},
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// dueDividends returns the Declared dividends whose record date has come by the given time
+func (a *App) dueDividends(at time.Time) ([]Dividend, error) {
+	rows, err := a.db.Query("SELECT "+dividendColumns+" FROM dividends WHERE status = ? AND record_date <= ? ORDER BY id",
+		DividendStatusDeclared, at.In(ist).Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dividends []Dividend
+	for rows.Next() {
+		var d Dividend
+		if err := scanDividend(rows, &d); err != nil {
+			return nil, err
+		}
+		dividends = append(dividends, d)
+	}
+	return dividends, rows.Err()
+}
+
+// dropNavs sets the market value of the funds going ex-dividend to their last declared nav less
+// the dividend, and returns the ex-dividend navs by dividend
+func (a *App) dropNavs(dividends []Dividend, at time.Time) (map[int64]float64, error) {
+	exNavs := map[int64]float64{}
+	for _, d := range dividends {
+		lastNav, err := a.navAt(d.Fund, at)
+		if err != nil {
+			return nil, err
+		}
+		fundC.Lock()
+		fund, ok := fundC.Funds[d.Fund]
+		if ok && lastNav > d.AmountPerUnit {
+			fund.MarketValue = lastNav - d.AmountPerUnit
+			fundC.Funds[d.Fund] = fund
+		}
+		fundC.Unlock()
+		if ok {
+			exNavs[d.ID] = fund.MarketValue
+		}
+	}
+	return exNavs, nil
+}
+
+// dividendHolding is the units of the fund held in a folio when its dividend is paid
+type dividendHolding struct {
+	phoneNumber string
+	folioNumber string
+	units       Units
+	option      string
+	// account is the verified bank account a payout goes to, nil when the user has none
+	account *BankAccount
+}
+
+// payDividend pays the dividend to every holder of the fund at the ex-dividend nav. Each holding
+// gets a Succeeded Dividend Payout or Dividend Reinvestment order less the TDS, reinvested
+// dividends open a lot of the units they buy. Payouts are sent to the bank once all are recorded.
+func (a *App) payDividend(d Dividend, exNav float64) error {
+	holdings, err := a.dividendHoldings(d.Fund)
+	if err != nil {
+		return err
+	}
+	amc, _ := fundAMC(d.Fund)
+	now := time.Now().UTC()
+	fyFrom, fyTo := financialYearOf(now)
+	paidAt := now.Format(time.DateTime)
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE dividends SET status = ?, ex_dividend_nav = ?, paid_at = ? WHERE id = ? AND status = ?",
+		DividendStatusPaid, exNav, paidAt, d.ID, DividendStatusDeclared)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	var orderIDs, payouts []string
+	for _, h := range holdings {
+		dividend := h.units.valueAt(d.AmountPerUnit)
+		if dividend <= 0 {
+			continue
+		}
+		paidBefore, err := dividendsPaid(tx, h.phoneNumber, amc, fyFrom, fyTo)
+		if err != nil {
+			return err
+		}
+		var tds Money
+		if paidBefore+dividend > a.tds.Threshold {
+			tds = dividend.percent(a.tds.Rate)
+		}
+		amount := dividend - tds
+
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+
+		if h.option == DividendOptionPayout && h.account != nil {
+			_, err = tx.Exec(`INSERT INTO orders (uuid, fund, amount, units, price_per_unit, status, payment_id, phone_number, submitted_at, succeeded_at, order_type, folio_number, bank_account_id, gross_amount, tds, dividend_id)
+				VALUES (?, ?, ?, 0, ?, 'Succeeded', '', ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				id.String(), d.Fund, amount, exNav, h.phoneNumber, paidAt, paidAt, OrderTypeDividendPayout, h.folioNumber, h.account.ID, dividend, tds, d.ID)
+			if err != nil {
+				return err
+			}
+			orderIDs = append(orderIDs, id.String())
+			payouts = append(payouts, id.String())
+			continue
+		}
+
+		charges, netAmount := applyCharges(a.chargeRules, d.Fund, amount)
+		units := unitsFor(netAmount, exNav)
+		if units <= 0 {
+			log.Default().Println("Dividend", d.ID, "of", h.phoneNumber, "in folio", h.folioNumber, "is too small to reinvest")
+			continue
+		}
+		_, err = tx.Exec(`INSERT INTO orders (uuid, fund, amount, units, price_per_unit, status, payment_id, phone_number, submitted_at, succeeded_at, order_type, folio_number, gross_amount, tds, net_amount, charges, dividend_id)
+			VALUES (?, ?, ?, ?, ?, 'Succeeded', '', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id.String(), d.Fund, amount, units, exNav, h.phoneNumber, paidAt, paidAt, OrderTypeDividendReinvestment, h.folioNumber, dividend, tds, netAmount, charges, d.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO purchase_lots (order_uuid, phone_number, fund, purchased_at, units, remaining_units, cost_per_unit, folio_number)
+			SELECT uuid, phone_number, fund, succeeded_at, units, units, amount * ? / units, folio_number FROM orders WHERE uuid = ?`, float64(Unit)/float64(Rupee), id.String())
+		if err != nil {
+			return err
+		}
+		orderIDs = append(orderIDs, id.String())
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Default().Println("Paid dividend", d.ID, "of", d.Fund, "to", len(orderIDs), "holdings at an ex-dividend nav of", exNav)
+
+	for _, id := range orderIDs {
+		orderChanges.notify(id)
+		a.publishOrderUpdate(id)
+	}
+	go func() {
+		for _, id := range payouts {
+			a.payOut(id)
+		}
+	}()
+	return nil
+}
+
+// dividendHoldings returns the units of the fund held in every folio, with the dividend option of
+// the holding and the bank account its payouts go to
+func (a *App) dividendHoldings(fund string) ([]dividendHolding, error) {
+	rows, err := a.db.Query(`SELECT l.phone_number, l.folio_number, SUM(l.remaining_units), COALESCE(o.option, ?) FROM purchase_lots l
+		LEFT JOIN dividend_options o ON o.folio_number = l.folio_number AND o.fund = l.fund
+		WHERE l.fund = ? AND l.remaining_units > 0 GROUP BY l.phone_number, l.folio_number ORDER BY l.phone_number, l.folio_number`,
+		DividendOptionPayout, fund)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var holdings []dividendHolding
+	for rows.Next() {
+		var h dividendHolding
+		var folioNumber sql.NullString
+		if err := rows.Scan(&h.phoneNumber, &folioNumber, &h.units, &h.option); err != nil {
+			return nil, err
+		}
+		h.folioNumber = folioNumber.String
+		holdings = append(holdings, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i, h := range holdings {
+		if h.option != DividendOptionPayout {
+			continue
+		}
+		// holders without a verified bank account have the dividend reinvested
+		account, err := a.payoutAccount(h.phoneNumber, 0)
+		if errors.Is(err, errBankAccountNotVerified) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		holdings[i].account = account
+	}
+	return holdings, nil
+}
+
+// dividendsPaid returns the dividends before TDS paid or reinvested to the user by the AMC between from and to
+func dividendsPaid(tx *sql.Tx, phoneNumber, amc string, from, to time.Time) (Money, error) {
+	rows, err := tx.Query(`SELECT fund, SUM(gross_amount) FROM orders WHERE phone_number = ? AND order_type IN (?, ?) AND status = 'Succeeded'
+		AND succeeded_at >= ? AND succeeded_at < ? GROUP BY fund`,
+		phoneNumber, OrderTypeDividendPayout, OrderTypeDividendReinvestment, from.UTC().Format(time.DateTime), to.UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var paid Money
+	for rows.Next() {
+		var fund string
+		var amount Money
+		if err := rows.Scan(&fund, &amount); err != nil {
+			return 0, err
+		}
+		if owner, _ := fundAMC(fund); owner == amc {
+			paid += amount
+		}
+	}
+	return paid, rows.Err()
+}
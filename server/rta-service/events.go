@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often an idle stream sends a comment to keep proxies from closing the connection
+var streamHeartbeatInterval = 15 * time.Second
+
+// Number of recent events kept per user to replay to a client reconnecting with Last-Event-ID
+const eventHistorySize = 100
+
+// event is a Server-Sent Event pushed to the streams of a user
+type event struct {
+	ID   int64
+	Type string
+	Data []byte
+}
+
+// eventBroker fans out events to the streams open for a phone number and keeps
+// the recent events of every user so reconnecting clients don't miss updates
+type eventBroker struct {
+	sync.Mutex
+	// ids start from the time the service started, so they keep growing across restarts
+	// and a client reconnecting with an id from before a restart doesn't skip new events
+	lastID      int64
+	subscribers map[string]map[chan event]struct{}
+	history     map[string][]event
+}
+
+var events = &eventBroker{
+	lastID:      time.Now().UnixMilli(),
+	subscribers: map[string]map[chan event]struct{}{},
+	history:     map[string][]event{},
+}
+
+// subscribe registers a stream for the phone number. It returns the events published
+// after lastEventID that the client has missed, and the channel new events are sent on.
+// The channel is closed if the client can't keep up, it should then reconnect.
+func (b *eventBroker) subscribe(phoneNumber string, lastEventID int64) ([]event, chan event) {
+	b.Lock()
+	defer b.Unlock()
+
+	var missed []event
+	if lastEventID > 0 {
+		for _, e := range b.history[phoneNumber] {
+			if e.ID > lastEventID {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	ch := make(chan event, 64)
+	if b.subscribers[phoneNumber] == nil {
+		b.subscribers[phoneNumber] = map[chan event]struct{}{}
+	}
+	b.subscribers[phoneNumber][ch] = struct{}{}
+	return missed, ch
+}
+
+func (b *eventBroker) unsubscribe(phoneNumber string, ch chan event) {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, ok := b.subscribers[phoneNumber][ch]; !ok {
+		// already dropped by publish
+		return
+	}
+	delete(b.subscribers[phoneNumber], ch)
+	if len(b.subscribers[phoneNumber]) == 0 {
+		delete(b.subscribers, phoneNumber)
+	}
+	close(ch)
+}
+
+// publish sends an event to every stream of the phone number
+func (b *eventBroker) publish(phoneNumber, eventType string, data any) {
+	if phoneNumber == "" {
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Default().Println("Error encoding", eventType, "event:", err)
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.lastID++
+	e := event{ID: b.lastID, Type: eventType, Data: payload}
+
+	history := append(b.history[phoneNumber], e)
+	if len(history) > eventHistorySize {
+		history = history[len(history)-eventHistorySize:]
+	}
+	b.history[phoneNumber] = history
+
+	for ch := range b.subscribers[phoneNumber] {
+		select {
+		case ch <- e:
+		default:
+			// drop the slow client, it will catch up through Last-Event-ID
+			delete(b.subscribers[phoneNumber], ch)
+			close(ch)
+		}
+	}
+	if len(b.subscribers[phoneNumber]) == 0 {
+		delete(b.subscribers, phoneNumber)
+	}
+}
+
+// subscribedPhoneNumbers returns the phone numbers with at least one open stream
+func (b *eventBroker) subscribedPhoneNumbers() []string {
+	b.Lock()
+	defer b.Unlock()
+
+	phoneNumbers := make([]string, 0, len(b.subscribers))
+	for phoneNumber := range b.subscribers {
+		phoneNumbers = append(phoneNumbers, phoneNumber)
+	}
+	return phoneNumbers
+}
+
+// handler function streaming the order, nav and portfolio updates of a user as Server-Sent Events
+func (a *App) streamHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := callerPhoneNumber(w, r, r.URL.Query().Get("phoneNumber"))
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// EventSource sends Last-Event-ID on reconnect, other clients can use the query parameter
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		lastID = id
+	}
+
+	missed, ch := events.subscribe(phoneNumber, lastID)
+	defer events.unsubscribe(phoneNumber, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// ask clients to reconnect after 3 seconds if the connection drops
+	fmt.Fprint(w, "retry: 3000\n\n")
+	for _, e := range missed {
+		writeEvent(w, e)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeEvent(w, e)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e event) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+}
+
+// publishOrderUpdate pushes the current state of the order to its user's streams.
+// Once an order succeeds the user's portfolio value changes as well.
+func (a *App) publishOrderUpdate(orderID string) {
+	var order OrderRequest
+	err := scanOrder(a.db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE uuid = ?", orderID), &order)
+	if err != nil {
+		log.Default().Println("Error getting order details for stream:", err)
+		return
+	}
+	events.publish(order.PhoneNumber, "order", order)
+
+	if order.Status == "Succeeded" {
+		a.publishPortfolio(order.PhoneNumber)
+	}
+}
+
+// publishNavUpdates pushes the new market value of the funds held by each streaming user,
+// followed by the new value of their portfolio
+func (a *App) publishNavUpdates() {
+	for _, phoneNumber := range events.subscribedPhoneNumbers() {
+		portfolio, err := a.aggregateOrders(phoneNumber)
+		if err != nil {
+			log.Default().Println("Error aggregating orders for stream:", err)
+			continue
+		}
+		if len(portfolio) == 0 {
+			continue
+		}
+
+		fundC.Lock()
+		var navs []Fund
+		for fundName := range portfolio {
+			navs = append(navs, fundC.Funds[fundName])
+		}
+		fundC.Unlock()
+
+		for _, nav := range navs {
+			events.publish(phoneNumber, "nav", nav)
+		}
+		events.publish(phoneNumber, "portfolio", portfolioSummary(portfolio))
+	}
+}
+
+func (a *App) publishPortfolio(phoneNumber string) {
+	portfolio, err := a.aggregateOrders(phoneNumber)
+	if err != nil {
+		log.Default().Println("Error aggregating orders for stream:", err)
+		return
+	}
+	events.publish(phoneNumber, "portfolio", portfolioSummary(portfolio))
+}
+
+// portfolioSummary adds the portfolio totals to the per fund aggregates
+func portfolioSummary(portfolio map[string]map[string]float64) map[string]interface{} {
+	totalAmount, marketValue := 0.0, 0.0
+	for _, fund := range portfolio {
+		totalAmount += fund["total_amount"]
+		marketValue += fund["market_value"]
+	}
+	return map[string]interface{}{
+		"total_amount": totalAmount,
+		"market_value": marketValue,
+		"funds":        portfolio,
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// ExitLoad charges Percentage of the redemption value of units redeemed less than WithinDays
+// days after they were bought
+type ExitLoad struct {
+	WithinDays int     `json:"withinDays"`
+	Percentage float64 `json:"percentage"`
+}
+
+// maxExitLoad is the highest exit load percentage a schedule can charge
+const maxExitLoad = 5.0
+
+// Default exit load schedules of the funds, operators can change them through the admin API
+var (
+	arbitrageExitLoads = []ExitLoad{{WithinDays: 30, Percentage: 0.25}}
+	balancedExitLoads  = []ExitLoad{{WithinDays: 180, Percentage: 1}, {WithinDays: 365, Percentage: 0.5}}
+	growthExitLoads    = []ExitLoad{{WithinDays: 365, Percentage: 1}}
+)
+
+// exitLoadRate returns the percentage charged on units held for the given number of days, the
+// one of the shortest period they were redeemed within. The schedule is sorted by WithinDays.
+func exitLoadRate(schedule []ExitLoad, days int) float64 {
+	for _, l := range schedule {
+		if days < l.WithinDays {
+			return l.Percentage
+		}
+	}
+	return 0
+}
+
+// validateExitLoads sorts the schedule by period and returns what is wrong with it
+func validateExitLoads(schedule []ExitLoad) string {
+	sort.Slice(schedule, func(i, j int) bool { return schedule[i].WithinDays < schedule[j].WithinDays })
+	for i, l := range schedule {
+		if l.WithinDays <= 0 {
+			return "withinDays must be positive"
+		}
+		if i > 0 && l.WithinDays == schedule[i-1].WithinDays {
+			return fmt.Sprintf("withinDays %d is given more than once", l.WithinDays)
+		}
+		if l.Percentage <= 0 || l.Percentage > maxExitLoad {
+			return fmt.Sprintf("percentage must be more than 0 and at most %.0f", maxExitLoad)
+		}
+	}
+	return ""
+}
+
+// loadExitLoads replaces the default exit load schedules with the ones set through the admin API
+func loadExitLoads(db *sql.DB) error {
+	rows, err := db.Query("SELECT fund, schedule FROM fund_exit_loads")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fundC.Lock()
+	defer fundC.Unlock()
+	for rows.Next() {
+		var name, schedule string
+		if err := rows.Scan(&name, &schedule); err != nil {
+			return err
+		}
+		fund, ok := fundC.Funds[name]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal([]byte(schedule), &fund.ExitLoads); err != nil {
+			return fmt.Errorf("exit loads of %s: %w", name, err)
+		}
+		fundC.Funds[name] = fund
+	}
+	return rows.Err()
+}
+
+// handler function for operators to set the exit load schedule of a fund, an empty schedule
+// removes the exit load. Redemptions processed from then on are charged by the new schedule.
+func (a *App) setExitLoadsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ExitLoads []ExitLoad `json:"exitLoads"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ExitLoads == nil {
+		req.ExitLoads = []ExitLoad{}
+	}
+	if msg := validateExitLoads(req.ExitLoads); msg != "" {
+		http.Error(w, "Invalid exit loads, "+msg, http.StatusBadRequest)
+		return
+	}
+
+	name := r.PathValue("fund")
+	fundC.Lock()
+	_, ok := fundC.Funds[name]
+	fundC.Unlock()
+	if !ok {
+		http.Error(w, "Fund not found", http.StatusNotFound)
+		return
+	}
+
+	schedule, err := json.Marshal(req.ExitLoads)
+	if err != nil {
+		log.Default().Println("Error encoding exit loads:", err)
+		http.Error(w, "Error saving exit loads", http.StatusInternalServerError)
+		return
+	}
+	_, err = a.db.Exec("INSERT OR REPLACE INTO fund_exit_loads (fund, schedule, updated_by, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)",
+		name, string(schedule), identity(r).PhoneNumber)
+	if err != nil {
+		log.Default().Println("Error saving exit loads:", err)
+		http.Error(w, "Error saving exit loads", http.StatusInternalServerError)
+		return
+	}
+
+	fundC.Lock()
+	fund := fundC.Funds[name]
+	fund.ExitLoads = req.ExitLoads
+	fundC.Funds[name] = fund
+	fundC.Unlock()
+	log.Default().Println(identity(r).PhoneNumber, "set the exit loads of", name, "to", string(schedule))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fund)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Folio is the account a user holds units of an AMC's funds in
+type Folio struct {
+	FolioNumber string `json:"folioNumber"`
+	AMC         string `json:"amc"`
+	CreatedAt   string `json:"createdAt"`
+	// Holdings are the funds held in the folio, filled in when listing folios
+	Holdings []FolioHolding `json:"holdings,omitempty"`
+}
+
+// FolioHolding is the units of a fund held in a folio
+type FolioHolding struct {
+	Fund           string `json:"fund"`
+	Units          Units  `json:"units"`
+	InvestedAmount Money  `json:"investedAmount"`
+	MarketValue    Money  `json:"marketValue"`
+	// DividendOption is whether dividends of the fund are paid out or reinvested
+	DividendOption string `json:"dividendOption"`
+}
+
+var (
+	errFolioNotFound  = errors.New("folio not found")
+	errFolioAmbiguous = errors.New("units are held in more than one folio")
+)
+
+// folioMu serialises folio creation so concurrent orders of a user with the same AMC,
+// like the legs of a strategy, end up in the same folio
+var folioMu sync.Mutex
+
+// fundAMC returns the AMC of the fund, or false if the fund is unknown
+func fundAMC(fund string) (string, bool) {
+	fundC.Lock()
+	defer fundC.Unlock()
+	f, ok := fundC.Funds[fund]
+	return f.AMC, ok
+}
+
+// amcCode is the prefix of the folio numbers of an AMC, e.g. SUN for Sunrise Mutual Fund
+func amcCode(amc string) string {
+	code := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return -1
+	}, amc)
+	if len(code) > 3 {
+		code = code[:3]
+	}
+	return strings.ToUpper(code)
+}
+
+// createFolio opens a new folio for the user with the AMC
+func createFolio(db *sql.DB, phoneNumber, amc string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO folios (phone_number, amc) VALUES (?, ?)", phoneNumber, amc)
+	if err != nil {
+		return "", err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	folioNumber := fmt.Sprintf("%s%08d", amcCode(amc), id)
+	_, err = tx.Exec("UPDATE folios SET folio_number = ? WHERE id = ?", folioNumber, id)
+	if err != nil {
+		return "", err
+	}
+	return folioNumber, tx.Commit()
+}
+
+// defaultFolio returns the folio new purchases of the user with the AMC go to, the first one
+// opened with the AMC. It is opened on the user's first purchase with the AMC.
+func defaultFolio(db *sql.DB, phoneNumber, amc string) (string, error) {
+	folioMu.Lock()
+	defer folioMu.Unlock()
+
+	var folioNumber string
+	err := db.QueryRow("SELECT folio_number FROM folios WHERE phone_number = ? AND amc = ? ORDER BY id LIMIT 1", phoneNumber, amc).Scan(&folioNumber)
+	if err == nil {
+		return folioNumber, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	folioNumber, err = createFolio(db, phoneNumber, amc)
+	if err != nil {
+		return "", err
+	}
+	log.Default().Println("Opened folio", folioNumber, "with", amc, "for", phoneNumber)
+	return folioNumber, nil
+}
+
+// purchaseFolio returns the folio a purchase of the fund goes to. A folio given by the user
+// must be theirs and belong to the fund's AMC, otherwise their default folio with the AMC is used.
+// Orders for unknown funds get no folio, they fail when processed.
+func (a *App) purchaseFolio(phoneNumber, fund string, folioNumber *string) (*string, error) {
+	amc, ok := fundAMC(fund)
+	if !ok {
+		return nil, nil
+	}
+	if folioNumber != nil && *folioNumber != "" {
+		if err := a.checkFolio(phoneNumber, amc, *folioNumber); err != nil {
+			return nil, err
+		}
+		return folioNumber, nil
+	}
+
+	f, err := defaultFolio(a.db, phoneNumber, amc)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// checkFolio verifies the folio belongs to the user and the AMC
+func (a *App) checkFolio(phoneNumber, amc, folioNumber string) error {
+	var count int
+	err := a.db.QueryRow("SELECT COUNT(*) FROM folios WHERE folio_number = ? AND phone_number = ? AND amc = ?", folioNumber, phoneNumber, amc).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: %s is not a folio of %s with %s", errFolioNotFound, folioNumber, phoneNumber, amc)
+	}
+	return nil
+}
+
+// redemptionFolio returns the folio to redeem units of the fund from. Without a folio given
+// by the user, the only folio holding units of the fund is used.
+func (a *App) redemptionFolio(phoneNumber, fund, folioNumber string) (string, error) {
+	amc, _ := fundAMC(fund)
+	if folioNumber != "" {
+		return folioNumber, a.checkFolio(phoneNumber, amc, folioNumber)
+	}
+
+	rows, err := a.db.Query("SELECT DISTINCT folio_number FROM purchase_lots WHERE phone_number = ? AND fund = ? AND remaining_units > 0", phoneNumber, fund)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var folios []string
+	for rows.Next() {
+		var f string
+		if err := rows.Scan(&f); err != nil {
+			return "", err
+		}
+		folios = append(folios, f)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	switch len(folios) {
+	case 0:
+		return "", nil
+	case 1:
+		return folios[0], nil
+	default:
+		return "", fmt.Errorf("%w: pass folioNumber, units of %s are held in folios %s", errFolioAmbiguous, fund, strings.Join(folios, ", "))
+	}
+}
+
+// backfillFolios assigns the orders and lots created before folios existed to the user's default
+// folio with the fund's AMC
+func backfillFolios(db *sql.DB) error {
+	rows, err := db.Query("SELECT DISTINCT phone_number, fund FROM orders WHERE folio_number IS NULL AND phone_number IS NOT NULL AND phone_number != ''")
+	if err != nil {
+		return err
+	}
+	type holding struct{ phoneNumber, fund string }
+	var holdings []holding
+	for rows.Next() {
+		var h holding
+		if err := rows.Scan(&h.phoneNumber, &h.fund); err != nil {
+			rows.Close()
+			return err
+		}
+		holdings = append(holdings, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, h := range holdings {
+		amc, ok := fundAMC(h.fund)
+		if !ok {
+			continue
+		}
+		folioNumber, err := defaultFolio(db, h.phoneNumber, amc)
+		if err != nil {
+			return err
+		}
+		for _, table := range []string{"orders", "purchase_lots", "lot_redemptions"} {
+			_, err := db.Exec("UPDATE "+table+" SET folio_number = ? WHERE phone_number = ? AND fund = ? AND folio_number IS NULL", folioNumber, h.phoneNumber, h.fund)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handler function to list the folios of a user with the funds held in each
+func (a *App) listFolios(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := callerPhoneNumber(w, r, r.URL.Query().Get("phoneNumber"))
+	if !ok {
+		return
+	}
+
+	folios, err := a.folios(phoneNumber)
+	if err != nil {
+		log.Default().Println("Error getting folios:", err)
+		http.Error(w, "Error retrieving folios", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    folios,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// folios returns the folios of the user with their holdings valued at the current market value
+func (a *App) folios(phoneNumber string) ([]*Folio, error) {
+	rows, err := a.db.Query("SELECT folio_number, amc, created_at FROM folios WHERE phone_number = ? ORDER BY id", phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folios := []*Folio{}
+	byNumber := map[string]*Folio{}
+	for rows.Next() {
+		f := &Folio{Holdings: []FolioHolding{}}
+		if err := rows.Scan(&f.FolioNumber, &f.AMC, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		folios = append(folios, f)
+		byNumber[f.FolioNumber] = f
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = a.db.Query(`SELECT l.folio_number, l.fund, SUM(l.remaining_units), SUM(l.remaining_units * l.cost_per_unit), COALESCE(o.option, ?) FROM purchase_lots l
+		LEFT JOIN dividend_options o ON o.folio_number = l.folio_number AND o.fund = l.fund
+		WHERE l.phone_number = ? AND l.remaining_units > 0 GROUP BY l.folio_number, l.fund`, DividendOptionPayout, phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var folioNumber sql.NullString
+		var h FolioHolding
+		var invested float64
+		if err := rows.Scan(&folioNumber, &h.Fund, &h.Units, &invested, &h.DividendOption); err != nil {
+			return nil, err
+		}
+		// the cost is per unit, remaining units are in thousandths
+		h.InvestedAmount = rupees(invested / float64(Unit))
+		f := byNumber[folioNumber.String]
+		if f == nil {
+			continue
+		}
+		fundC.Lock()
+		h.MarketValue = h.Units.valueAt(fundC.Funds[h.Fund].MarketValue)
+		fundC.Unlock()
+		f.Holdings = append(f.Holdings, h)
+	}
+	for _, f := range folios {
+		sort.Slice(f.Holdings, func(i, j int) bool { return f.Holdings[i].Fund < f.Holdings[j].Fund })
+	}
+	return folios, rows.Err()
+}
+
+// handler function to open a new folio for a user with an AMC. Purchases go to the user's first
+// folio with the AMC unless the order names the folio.
+func (a *App) createFolioHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PhoneNumber string `json:"phoneNumber"`
+		AMC         string `json:"amc"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	phoneNumber, ok := callerPhoneNumber(w, r, req.PhoneNumber)
+	if !ok {
+		return
+	}
+	req.PhoneNumber = phoneNumber
+	if !knownAMC(req.AMC) {
+		http.Error(w, "AMC not found", http.StatusBadRequest)
+		return
+	}
+
+	folioMu.Lock()
+	folioNumber, err := createFolio(a.db, req.PhoneNumber, req.AMC)
+	folioMu.Unlock()
+	if err != nil {
+		log.Default().Println("Error creating folio:", err)
+		http.Error(w, "Error creating folio", http.StatusInternalServerError)
+		return
+	}
+
+	var folio Folio
+	err = a.db.QueryRow("SELECT folio_number, amc, created_at FROM folios WHERE folio_number = ?", folioNumber).Scan(&folio.FolioNumber, &folio.AMC, &folio.CreatedAt)
+	if err != nil {
+		log.Default().Println("Error getting folio:", err)
+		http.Error(w, "Error creating folio", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    folio,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// knownAMC reports whether any fund belongs to the AMC
+func knownAMC(amc string) bool {
+	fundC.Lock()
+	defer fundC.Unlock()
+	for _, f := range fundC.Funds {
+		if f.AMC == amc {
+			return true
+		}
+	}
+	return false
+}
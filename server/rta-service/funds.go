@@ -0,0 +1,140 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Scheme categories of SEBI, the sub-category names the scheme type within one, e.g. Flexi Cap Fund
+const (
+	CategoryEquity           = "Equity"
+	CategoryDebt             = "Debt"
+	CategoryHybrid           = "Hybrid"
+	CategorySolutionOriented = "Solution Oriented"
+	CategoryOther            = "Other"
+)
+
+var fundCategories = []string{CategoryEquity, CategoryDebt, CategoryHybrid, CategorySolutionOriented, CategoryOther}
+
+// Levels of the SEBI riskometer
+const (
+	RiskometerLow            = "Low"
+	RiskometerLowToModerate  = "Low to Moderate"
+	RiskometerModerate       = "Moderate"
+	RiskometerModeratelyHigh = "Moderately High"
+	RiskometerHigh           = "High"
+	RiskometerVeryHigh       = "Very High"
+)
+
+// riskometerLevels lists the riskometer levels from the least risky
+var riskometerLevels = []string{RiskometerLow, RiskometerLowToModerate, RiskometerModerate, RiskometerModeratelyHigh, RiskometerHigh, RiskometerVeryHigh}
+
+// maxExpenseRatio is the highest total expense ratio SEBI allows, in percent
+const maxExpenseRatio = 2.25
+
+// fundSorts are the fields the fund catalog can be sorted by, funds that compare equal are sorted by name
+var fundSorts = map[string]func(a, b Fund) int{
+	"name": func(a, b Fund) int { return cmp.Compare(a.Name, b.Name) },
+	"nav":  func(a, b Fund) int { return cmp.Compare(a.MarketValue, b.MarketValue) },
+	"riskometer": func(a, b Fund) int {
+		return cmp.Compare(slices.Index(riskometerLevels, a.Riskometer), slices.Index(riskometerLevels, b.Riskometer))
+	},
+	"expenseRatio":  func(a, b Fund) int { return cmp.Compare(a.ExpenseRatio, b.ExpenseRatio) },
+	"aum":           func(a, b Fund) int { return cmp.Compare(a.AUM, b.AUM) },
+	"inceptionDate": func(a, b Fund) int { return cmp.Compare(a.InceptionDate, b.InceptionDate) },
+}
+
+// handler function to list the fund catalog. Funds can be filtered by category, subCategory,
+// riskometer, amc and assetClass, each taking a comma separated list of values, by minNav, maxNav,
+// maxExpenseRatio and minAum, and searched by name, amc, category or benchmark with q. They are
+// sorted by name unless sort names another field, order=desc reverses it.
+func (a *App) listFunds(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var filters []func(Fund) bool
+	for param, field := range map[string]func(Fund) string{
+		"category":    func(f Fund) string { return f.Category },
+		"subCategory": func(f Fund) string { return f.SubCategory },
+		"riskometer":  func(f Fund) string { return f.Riskometer },
+		"amc":         func(f Fund) string { return f.AMC },
+		"assetClass":  func(f Fund) string { return f.AssetClass },
+	} {
+		if v := q.Get(param); v != "" {
+			values := strings.Split(v, ",")
+			filters = append(filters, func(f Fund) bool {
+				return slices.ContainsFunc(values, func(v string) bool { return strings.EqualFold(strings.TrimSpace(v), field(f)) })
+			})
+		}
+	}
+
+	for param, filter := range map[string]func(v float64) func(Fund) bool{
+		"minNav":          func(v float64) func(Fund) bool { return func(f Fund) bool { return f.MarketValue >= v } },
+		"maxNav":          func(v float64) func(Fund) bool { return func(f Fund) bool { return f.MarketValue <= v } },
+		"maxExpenseRatio": func(v float64) func(Fund) bool { return func(f Fund) bool { return f.ExpenseRatio <= v } },
+		"minAum":          func(v float64) func(Fund) bool { return func(f Fund) bool { return f.AUM >= rupees(v) } },
+	} {
+		if v := q.Get(param); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("Invalid %s, must be a number not below 0", param), http.StatusBadRequest)
+				return
+			}
+			filters = append(filters, filter(n))
+		}
+	}
+
+	if search := strings.ToLower(strings.TrimSpace(q.Get("q"))); search != "" {
+		filters = append(filters, func(f Fund) bool {
+			for _, field := range []string{f.Name, f.AMC, f.Category, f.SubCategory, f.Benchmark} {
+				if strings.Contains(strings.ToLower(field), search) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	sortBy := q.Get("sort")
+	if sortBy == "" {
+		sortBy = "name"
+	}
+	compare, ok := fundSorts[sortBy]
+	if !ok {
+		http.Error(w, "Invalid sort, must be one of name, nav, riskometer, expenseRatio, aum or inceptionDate", http.StatusBadRequest)
+		return
+	}
+	order := q.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		http.Error(w, "Invalid order, must be asc or desc", http.StatusBadRequest)
+		return
+	}
+
+	funds := []Fund{}
+	fundC.Lock()
+	for _, f := range fundC.Funds {
+		if !slices.ContainsFunc(filters, func(filter func(Fund) bool) bool { return !filter(f) }) {
+			funds = append(funds, f)
+		}
+	}
+	fundC.Unlock()
+
+	slices.SortFunc(funds, func(a, b Fund) int {
+		c := compare(a, b)
+		if order == "desc" {
+			c = -c
+		}
+		return cmp.Or(c, cmp.Compare(a.Name, b.Name))
+	})
+
+	resp := map[string]interface{}{
+		"data":    funds,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
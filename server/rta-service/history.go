@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// PortfolioSnapshot is the value of a user's portfolio at a nav declaration
+type PortfolioSnapshot struct {
+	ValuedAt       string  `json:"valuedAt"`
+	InvestedAmount float64 `json:"investedAmount"`
+	MarketValue    float64 `json:"marketValue"`
+}
+
+// recordNav stores the navs declared at the given time in the nav history
+func (a *App) recordNav(declaredAt time.Time, navs map[string]float64) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for fund, nav := range navs {
+		_, err := tx.Exec("INSERT INTO nav_history (fund, nav, declared_at) VALUES (?, ?, ?)", fund, nav, declaredAt.Format(time.DateTime))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// snapshotPortfolios values the holdings every user had at the given time with the given navs
+// and stores the result, replacing any snapshot already taken at that time.
+// When phoneNumber is set only that user's portfolio is valued. It returns the number of snapshots stored.
+func (a *App) snapshotPortfolios(valuedAt time.Time, navs map[string]float64, phoneNumber string) (int, error) {
+	at := valuedAt.UTC().Format(time.DateTime)
+
+	// The holdings are the purchase lots bought by then less the units redeemed from them by
+	// then, invested at their cost like in aggregateOrders
+	query := `SELECT l.phone_number, l.fund,
+			SUM(l.units - COALESCE(r.units, 0)),
+			SUM((l.units - COALESCE(r.units, 0)) * l.cost_per_unit)
+		FROM purchase_lots l
+		LEFT JOIN (SELECT lot_id, SUM(units) AS units FROM lot_redemptions WHERE redeemed_at <= ? GROUP BY lot_id) r ON r.lot_id = l.id
+		WHERE l.purchased_at <= ?`
+	args := []any{at, at}
+	if phoneNumber != "" {
+		query += " AND l.phone_number = ?"
+		args = append(args, phoneNumber)
+	}
+	query += " GROUP BY l.phone_number, l.fund"
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	snapshots := map[string]*PortfolioSnapshot{}
+	for rows.Next() {
+		var phone, fund string
+		var units Units
+		var cost float64
+		if err := rows.Scan(&phone, &fund, &units, &cost); err != nil {
+			return 0, err
+		}
+		if snapshots[phone] == nil {
+			snapshots[phone] = &PortfolioSnapshot{ValuedAt: at}
+		}
+		// the cost is per unit and units are in thousandths
+		snapshots[phone].InvestedAmount += rupees(cost / float64(Unit)).Rupees()
+		snapshots[phone].MarketValue += units.Float() * navs[fund]
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for phone, snapshot := range snapshots {
+		_, err := tx.Exec("INSERT OR REPLACE INTO portfolio_snapshots (phone_number, valued_at, invested_amount, market_value) VALUES (?, ?, ?, ?)", phone, at, snapshot.InvestedAmount, snapshot.MarketValue)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(snapshots), tx.Commit()
+}
+
+// handler function to get the value of a user's portfolio over time
+func (a *App) portfolioHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := callerPhoneNumber(w, r, r.URL.Query().Get("phoneNumber"))
+	if !ok {
+		return
+	}
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := a.db.Query("SELECT valued_at, invested_amount, market_value FROM portfolio_snapshots WHERE phone_number = ? AND valued_at >= ? AND valued_at <= ? ORDER BY valued_at", phoneNumber, from, to)
+	if err != nil {
+		log.Default().Println("Error getting portfolio history:", err)
+		http.Error(w, "Error retrieving portfolio history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []PortfolioSnapshot{}
+	for rows.Next() {
+		var snapshot PortfolioSnapshot
+		if err := rows.Scan(&snapshot.ValuedAt, &snapshot.InvestedAmount, &snapshot.MarketValue); err != nil {
+			log.Default().Println("Error reading portfolio history:", err)
+			http.Error(w, "Error retrieving portfolio history", http.StatusInternalServerError)
+			return
+		}
+		history = append(history, snapshot)
+	}
+	if err := rows.Err(); err != nil {
+		log.Default().Println("Error getting portfolio history:", err)
+		http.Error(w, "Error retrieving portfolio history", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    history,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handler function to rebuild the portfolio snapshots of past nav declarations from the nav history,
+// e.g. after orders were corrected. Optional phoneNumber, from and to restrict what is rebuilt.
+func (a *App) rebuildPortfolioHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber := r.URL.Query().Get("phoneNumber")
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	declarations, snapshots, err := a.rebuildPortfolioHistory(phoneNumber, from, to)
+	if err != nil {
+		log.Default().Println("Error rebuilding portfolio history:", err)
+		http.Error(w, "Error rebuilding portfolio history", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data": map[string]interface{}{
+			"navDeclarations": declarations,
+			"snapshots":       snapshots,
+		},
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// rebuildPortfolioHistory takes the portfolio snapshots again for every nav declaration between from and to.
+// It returns the number of nav declarations replayed and snapshots stored.
+func (a *App) rebuildPortfolioHistory(phoneNumber, from, to string) (int, int, error) {
+	rows, err := a.db.Query("SELECT declared_at, fund, nav FROM nav_history WHERE declared_at >= ? AND declared_at <= ? ORDER BY declared_at", from, to)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	type declaration struct {
+		at   time.Time
+		navs map[string]float64
+	}
+	var declarations []*declaration
+	for rows.Next() {
+		var declaredAt time.Time
+		var fund string
+		var nav float64
+		if err := rows.Scan(&declaredAt, &fund, &nav); err != nil {
+			return 0, 0, err
+		}
+		if len(declarations) == 0 || !declarations[len(declarations)-1].at.Equal(declaredAt) {
+			declarations = append(declarations, &declaration{at: declaredAt, navs: map[string]float64{}})
+		}
+		declarations[len(declarations)-1].navs[fund] = nav
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	rows.Close()
+
+	snapshots := 0
+	for _, d := range declarations {
+		n, err := a.snapshotPortfolios(d.at, d.navs, phoneNumber)
+		if err != nil {
+			return 0, 0, err
+		}
+		snapshots += n
+	}
+	return len(declarations), snapshots, nil
+}
+
+// parseTimeRange reads the optional from and to query parameters in the format timestamps are stored in.
+// A missing bound leaves that side of the range open.
+func parseTimeRange(r *http.Request) (string, string, error) {
+	from, to := "0000-01-01 00:00:00", "9999-12-31 23:59:59"
+
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, _, err := parseTimeParam(v)
+		if err != nil {
+			return "", "", errors.New("Invalid from, expected RFC3339 time or YYYY-MM-DD date")
+		}
+		from = t.UTC().Format(time.DateTime)
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, dateOnly, err := parseTimeParam(v)
+		if err != nil {
+			return "", "", errors.New("Invalid to, expected RFC3339 time or YYYY-MM-DD date")
+		}
+		// a bare date includes the whole day
+		if dateOnly {
+			t = t.AddDate(0, 0, 1).Add(-time.Second)
+		}
+		to = t.UTC().Format(time.DateTime)
+	}
+	return from, to, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// KYC statuses. A profile is Pending when submitted and is reviewed by an admin.
+const (
+	KYCStatusPending  = "Pending"
+	KYCStatusVerified = "Verified"
+	KYCStatusRejected = "Rejected"
+)
+
+// ErrorCodeKYCNotVerified is returned when a user without Verified KYC places a purchase
+const ErrorCodeKYCNotVerified = "KYC_NOT_VERIFIED"
+
+// KYCProfile is the identity of an investor, purchases are allowed once it is Verified
+type KYCProfile struct {
+	PhoneNumber string `json:"phoneNumber"`
+	PAN         string `json:"pan"`
+	Name        string `json:"name"`
+	// DateOfBirth is YYYY-MM-DD
+	DateOfBirth string `json:"dateOfBirth"`
+	Address     string `json:"address"`
+	Status      string `json:"status"`
+	// RejectionReason is set only when the profile is Rejected
+	RejectionReason *string `json:"rejectionReason"`
+	SubmittedAt     string  `json:"submittedAt"`
+	ReviewedAt      *string `json:"reviewedAt"`
+}
+
+// panPattern is the format of a PAN, five letters, four digits and a check letter
+var panPattern = regexp.MustCompile(`^[A-Z]{5}[0-9]{4}[A-Z]$`)
+
+var (
+	errKYCNotFound    = errors.New("kyc not found")
+	errKYCNotVerified = errors.New("purchases need verified KYC")
+	errKYCNotPending  = errors.New("kyc is not pending review")
+)
+
+// writeErrorCode responds with an error carrying a machine readable code, for errors
+// clients are expected to act on
+func writeErrorCode(w http.ResponseWriter, status int, code, message string) {
+	resp := map[string]interface{}{
+		"error": map[string]string{
+			"code":    code,
+			"message": message,
+		},
+		"success": false,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+const kycColumns = "phone_number, pan, name, date_of_birth, address, status, rejection_reason, submitted_at, reviewed_at"
+
+func scanKYC(row interface{ Scan(...any) error }, p *KYCProfile) error {
+	return row.Scan(&p.PhoneNumber, &p.PAN, &p.Name, &p.DateOfBirth, &p.Address, &p.Status, &p.RejectionReason, &p.SubmittedAt, &p.ReviewedAt)
+}
+
+// kycProfile returns the KYC profile of the user, errKYCNotFound if they haven't submitted one
+func (a *App) kycProfile(phoneNumber string) (*KYCProfile, error) {
+	var p KYCProfile
+	err := scanKYC(a.db.QueryRow("SELECT "+kycColumns+" FROM kyc_profiles WHERE phone_number = ?", phoneNumber), &p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errKYCNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// checkKYC returns errKYCNotVerified, wrapped with the reason, unless the KYC of the user is Verified
+func (a *App) checkKYC(phoneNumber string) error {
+	p, err := a.kycProfile(phoneNumber)
+	if errors.Is(err, errKYCNotFound) {
+		return fmt.Errorf("KYC of %s has not been submitted, %w", phoneNumber, errKYCNotVerified)
+	}
+	if err != nil {
+		return err
+	}
+	if p.Status != KYCStatusVerified {
+		return fmt.Errorf("KYC of %s is %s, %w", phoneNumber, p.Status, errKYCNotVerified)
+	}
+	return nil
+}
+
+// handler function to submit the KYC profile of a user for review. A Pending or Rejected
+// profile can be submitted again, a Verified one can't be changed.
+func (a *App) submitKYCHandler(w http.ResponseWriter, r *http.Request) {
+	var req KYCProfile
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	phoneNumber, ok := callerPhoneNumber(w, r, req.PhoneNumber)
+	if !ok {
+		return
+	}
+	req.PhoneNumber = phoneNumber
+	req.PAN = strings.ToUpper(strings.TrimSpace(req.PAN))
+	req.Name = strings.TrimSpace(req.Name)
+	req.Address = strings.TrimSpace(req.Address)
+
+	if !panPattern.MatchString(req.PAN) {
+		http.Error(w, "PAN must be 5 letters, 4 digits and a letter, e.g. ABCDE1234F", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if req.Address == "" {
+		http.Error(w, "Address is required", http.StatusBadRequest)
+		return
+	}
+	dob, err := time.Parse(time.DateOnly, req.DateOfBirth)
+	if err != nil || !dob.Before(time.Now()) {
+		http.Error(w, "Date of birth must be a past date in YYYY-MM-DD format", http.StatusBadRequest)
+		return
+	}
+
+	var count int
+	err = a.db.QueryRow("SELECT COUNT(*) FROM users WHERE phone_number = ?", req.PhoneNumber).Scan(&count)
+	if err != nil {
+		log.Default().Println("Error checking user:", err)
+		http.Error(w, "Error submitting KYC", http.StatusInternalServerError)
+		return
+	}
+	if count == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// A PAN identifies one investor, it can't be used by another user unless their KYC was rejected
+	err = a.db.QueryRow("SELECT COUNT(*) FROM kyc_profiles WHERE pan = ? AND phone_number != ? AND status != ?", req.PAN, req.PhoneNumber, KYCStatusRejected).Scan(&count)
+	if err != nil {
+		log.Default().Println("Error checking PAN:", err)
+		http.Error(w, "Error submitting KYC", http.StatusInternalServerError)
+		return
+	}
+	if count > 0 {
+		http.Error(w, "PAN is already registered with another user", http.StatusConflict)
+		return
+	}
+
+	res, err := a.db.Exec(`INSERT INTO kyc_profiles (phone_number, pan, name, date_of_birth, address, status, submitted_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (phone_number) DO UPDATE SET pan = excluded.pan, name = excluded.name, date_of_birth = excluded.date_of_birth,
+			address = excluded.address, status = excluded.status, rejection_reason = NULL, submitted_at = excluded.submitted_at, reviewed_at = NULL
+		WHERE kyc_profiles.status != ?`,
+		req.PhoneNumber, req.PAN, req.Name, req.DateOfBirth, req.Address, KYCStatusPending, time.Now().UTC().Format(time.DateTime), KYCStatusVerified)
+	if err != nil {
+		log.Default().Println("Error submitting KYC:", err)
+		http.Error(w, "Error submitting KYC", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "KYC is already verified", http.StatusConflict)
+		return
+	}
+
+	a.writeKYC(w, req.PhoneNumber)
+}
+
+// handler function to get the KYC profile of a user
+func (a *App) getKYCHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := callerPhoneNumber(w, r, r.URL.Query().Get("phoneNumber"))
+	if !ok {
+		return
+	}
+	a.writeKYC(w, phoneNumber)
+}
+
+// writeKYC responds with the KYC profile of the user
+func (a *App) writeKYC(w http.ResponseWriter, phoneNumber string) {
+	profile, err := a.kycProfile(phoneNumber)
+	if errors.Is(err, errKYCNotFound) {
+		http.Error(w, "KYC not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Default().Println("Error getting KYC:", err)
+		http.Error(w, "Error retrieving KYC", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    profile,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handler function for admins to list KYC profiles, oldest submission first, optionally by status
+func (a *App) listKYCHandler(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT " + kycColumns + " FROM kyc_profiles"
+	var args []any
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY submitted_at, id"
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		log.Default().Println("Error listing KYC:", err)
+		http.Error(w, "Error retrieving KYC", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	profiles := []KYCProfile{}
+	for rows.Next() {
+		var p KYCProfile
+		if err := scanKYC(rows, &p); err != nil {
+			log.Default().Println("Error reading KYC:", err)
+			http.Error(w, "Error retrieving KYC", http.StatusInternalServerError)
+			return
+		}
+		profiles = append(profiles, p)
+	}
+	if err := rows.Err(); err != nil {
+		log.Default().Println("Error listing KYC:", err)
+		http.Error(w, "Error retrieving KYC", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    profiles,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handler function for admins to approve a Pending KYC profile
+func (a *App) approveKYCHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber := r.PathValue("phoneNumber")
+	a.reviewKYC(w, phoneNumber, KYCStatusVerified, nil)
+}
+
+// handler function for admins to reject a Pending KYC profile, the reason is shown to the user
+func (a *App) rejectKYCHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, "Reason is required", http.StatusBadRequest)
+		return
+	}
+
+	phoneNumber := r.PathValue("phoneNumber")
+	a.reviewKYC(w, phoneNumber, KYCStatusRejected, &req.Reason)
+}
+
+// reviewKYC moves a Pending KYC profile to status and responds with the profile
+func (a *App) reviewKYC(w http.ResponseWriter, phoneNumber, status string, reason *string) {
+	err := a.setKYCStatus(phoneNumber, status, reason)
+	if errors.Is(err, errKYCNotFound) {
+		http.Error(w, "KYC not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errKYCNotPending) {
+		http.Error(w, "KYC is not pending review", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Default().Println("Error reviewing KYC:", err)
+		http.Error(w, "Error reviewing KYC", http.StatusInternalServerError)
+		return
+	}
+
+	log.Default().Println("KYC of", phoneNumber, "is", status)
+	a.writeKYC(w, phoneNumber)
+}
+
+func (a *App) setKYCStatus(phoneNumber, status string, reason *string) error {
+	res, err := a.db.Exec("UPDATE kyc_profiles SET status = ?, rejection_reason = ?, reviewed_at = ? WHERE phone_number = ? AND status = ?",
+		status, reason, time.Now().UTC().Format(time.DateTime), phoneNumber, KYCStatusPending)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	if _, err := a.kycProfile(phoneNumber); err != nil {
+		return err
+	}
+	return errKYCNotPending
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// otpTTL is how long an OTP can be verified for
+	otpTTL = 5 * time.Minute
+	// otpResendInterval is the least time between two OTPs to a phone number
+	otpResendInterval = 30 * time.Second
+	// otpWindow and otpMaxPerWindow limit the OTPs sent to a phone number
+	otpWindow       = 15 * time.Minute
+	otpMaxPerWindow = 5
+	// otpMaxAttempts is the number of wrong codes after which an OTP can't be used anymore
+	otpMaxAttempts = 5
+	// sessionTTL is how long a session token is valid for
+	sessionTTL = 30 * 24 * time.Hour
+)
+
+// otpSender delivers login OTPs to users
+type otpSender interface {
+	Send(phoneNumber, otp string) error
+}
+
+// logOTPSender writes the OTPs to the server log, for development
+type logOTPSender struct{}
+
+func (logOTPSender) Send(phoneNumber, otp string) error {
+	log.Default().Println("OTP for", phoneNumber, "is", otp)
+	return nil
+}
+
+// fileOTPSender appends the OTPs to a local file, for development and automated tests
+type fileOTPSender struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (s *fileOTPSender) Send(phoneNumber, otp string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s %s %s\n", time.Now().UTC().Format(time.RFC3339), phoneNumber, otp)
+	return err
+}
+
+// newOTPSender returns the sender configured by the OTP_FILE environment variable,
+// OTPs are written to the file if it is set and to the log otherwise
+func newOTPSender() otpSender {
+	if path := os.Getenv("OTP_FILE"); path != "" {
+		return &fileOTPSender{path: path}
+	}
+	return logOTPSender{}
+}
+
+// Session is a login of a user, identified by its token
+type Session struct {
+	ID         int64   `json:"id"`
+	CreatedAt  string  `json:"createdAt"`
+	ExpiresAt  string  `json:"expiresAt"`
+	LastUsedAt *string `json:"lastUsedAt"`
+	UserAgent  string  `json:"userAgent"`
+	// Current is set on the session of the token used for the request
+	Current bool `json:"current"`
+}
+
+var errSessionNotFound = errors.New("session not found")
+
+// hashSecret is how OTPs and session tokens are stored, so a copy of the database can't be used to log in
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newOTP returns a random 6 digit code
+func newOTP() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// newSessionToken returns a random token
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tooManyRequests responds with 429, telling the client when to try again
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int(retryAfter.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// handler function to send a login OTP to a registered phone number
+func (a *App) requestOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PhoneNumber string `json:"phoneNumber"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var count int
+	err := a.db.QueryRow("SELECT COUNT(*) FROM users WHERE phone_number = ?", req.PhoneNumber).Scan(&count)
+	if err != nil {
+		log.Default().Println("Error checking user:", err)
+		http.Error(w, "Error sending OTP", http.StatusInternalServerError)
+		return
+	}
+	if count == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// The OTPs are issued one at a time so the limits can't be raced past
+	a.otpMu.Lock()
+	defer a.otpMu.Unlock()
+
+	now := time.Now().UTC()
+	retryAfter, err := a.otpRetryAfter(req.PhoneNumber, now)
+	if err != nil {
+		log.Default().Println("Error checking OTPs:", err)
+		http.Error(w, "Error sending OTP", http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		tooManyRequests(w, retryAfter, "Too many OTPs requested, try again later")
+		return
+	}
+
+	otp, err := newOTP()
+	if err != nil {
+		log.Default().Println("Error generating OTP:", err)
+		http.Error(w, "Error sending OTP", http.StatusInternalServerError)
+		return
+	}
+	expiresAt := now.Add(otpTTL)
+
+	// A new OTP replaces the ones sent before
+	_, err = a.db.Exec("UPDATE login_otps SET consumed_at = ? WHERE phone_number = ? AND consumed_at IS NULL", now.Format(time.DateTime), req.PhoneNumber)
+	if err != nil {
+		log.Default().Println("Error saving OTP:", err)
+		http.Error(w, "Error sending OTP", http.StatusInternalServerError)
+		return
+	}
+	_, err = a.db.Exec("INSERT INTO login_otps (phone_number, code_hash, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		req.PhoneNumber, hashSecret(otp), now.Format(time.DateTime), expiresAt.Format(time.DateTime))
+	if err != nil {
+		log.Default().Println("Error saving OTP:", err)
+		http.Error(w, "Error sending OTP", http.StatusInternalServerError)
+		return
+	}
+
+	if err := a.otpSender.Send(req.PhoneNumber, otp); err != nil {
+		log.Default().Println("Error sending OTP:", err)
+		http.Error(w, "Error sending OTP", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data": map[string]interface{}{
+			"expiresAt": expiresAt.Format(time.RFC3339),
+		},
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// otpRetryAfter returns how long the user has to wait before another OTP can be sent to them
+func (a *App) otpRetryAfter(phoneNumber string, now time.Time) (time.Duration, error) {
+	rows, err := a.db.Query("SELECT created_at FROM login_otps WHERE phone_number = ? AND created_at > ? ORDER BY created_at DESC",
+		phoneNumber, now.Add(-otpWindow).Format(time.DateTime))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var sent []time.Time
+	for rows.Next() {
+		var createdAt time.Time
+		if err := rows.Scan(&createdAt); err != nil {
+			return 0, err
+		}
+		sent = append(sent, createdAt)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var retryAfter time.Duration
+	if len(sent) > 0 {
+		retryAfter = sent[0].Add(otpResendInterval).Sub(now)
+	}
+	if len(sent) >= otpMaxPerWindow {
+		// Wait for the oldest OTP that counts towards the limit to leave the window
+		if d := sent[otpMaxPerWindow-1].Add(otpWindow).Sub(now); d > retryAfter {
+			retryAfter = d
+		}
+	}
+	return retryAfter, nil
+}
+
+// handler function to verify a login OTP, responds with a session token to pass as
+// `Authorization: Bearer <token>`
+func (a *App) verifyOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PhoneNumber string `json:"phoneNumber"`
+		OTP         string `json:"otp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	a.otpMu.Lock()
+	defer a.otpMu.Unlock()
+
+	now := time.Now().UTC()
+	var id int64
+	var codeHash string
+	var attempts int
+	err := a.db.QueryRow("SELECT id, code_hash, attempts FROM login_otps WHERE phone_number = ? AND consumed_at IS NULL AND expires_at > ? ORDER BY id DESC LIMIT 1",
+		req.PhoneNumber, now.Format(time.DateTime)).Scan(&id, &codeHash, &attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "OTP expired or not requested", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Default().Println("Error getting OTP:", err)
+		http.Error(w, "Error verifying OTP", http.StatusInternalServerError)
+		return
+	}
+	if attempts >= otpMaxAttempts {
+		http.Error(w, "Too many wrong attempts, request a new OTP", http.StatusTooManyRequests)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(req.OTP)), []byte(codeHash)) != 1 {
+		_, err := a.db.Exec("UPDATE login_otps SET attempts = attempts + 1 WHERE id = ?", id)
+		if err != nil {
+			log.Default().Println("Error saving OTP attempt:", err)
+		}
+		http.Error(w, "Invalid OTP", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = a.db.Exec("UPDATE login_otps SET consumed_at = ? WHERE id = ?", now.Format(time.DateTime), id)
+	if err != nil {
+		log.Default().Println("Error consuming OTP:", err)
+		http.Error(w, "Error verifying OTP", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		log.Default().Println("Error generating session token:", err)
+		http.Error(w, "Error verifying OTP", http.StatusInternalServerError)
+		return
+	}
+	expiresAt := now.Add(sessionTTL)
+	res, err := a.db.Exec("INSERT INTO sessions (token_hash, phone_number, user_agent, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		hashSecret(token), req.PhoneNumber, r.UserAgent(), now.Format(time.DateTime), expiresAt.Format(time.DateTime))
+	if err != nil {
+		log.Default().Println("Error creating session:", err)
+		http.Error(w, "Error verifying OTP", http.StatusInternalServerError)
+		return
+	}
+	sessionID, _ := res.LastInsertId()
+	log.Default().Println("User", req.PhoneNumber, "logged in, session", sessionID)
+
+	resp := map[string]interface{}{
+		"data": map[string]interface{}{
+			"token":       token,
+			"sessionId":   sessionID,
+			"phoneNumber": req.PhoneNumber,
+			"expiresAt":   expiresAt.Format(time.RFC3339),
+		},
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// bearerToken returns the token of the `Authorization: Bearer <token>` header
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// session returns the id and user of the active session of the token and marks it used
+func (a *App) session(token string) (int64, string, error) {
+	if token == "" {
+		return 0, "", errSessionNotFound
+	}
+	now := time.Now().UTC().Format(time.DateTime)
+
+	var id int64
+	var phoneNumber string
+	err := a.db.QueryRow("SELECT id, phone_number FROM sessions WHERE token_hash = ? AND revoked_at IS NULL AND expires_at > ?",
+		hashSecret(token), now).Scan(&id, &phoneNumber)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", errSessionNotFound
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	_, err = a.db.Exec("UPDATE sessions SET last_used_at = ? WHERE id = ?", now, id)
+	if err != nil {
+		return 0, "", err
+	}
+	return id, phoneNumber, nil
+}
+
+// handler function to end the session of the request's token, or every session of the user with `?all=true`
+func (a *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	id, phoneNumber := identity(r).SessionID, identity(r).PhoneNumber
+
+	now := time.Now().UTC().Format(time.DateTime)
+	var err error
+	if r.URL.Query().Get("all") == "true" {
+		_, err = a.db.Exec("UPDATE sessions SET revoked_at = ? WHERE phone_number = ? AND revoked_at IS NULL", now, phoneNumber)
+	} else {
+		_, err = a.db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ?", now, id)
+	}
+	if err != nil {
+		log.Default().Println("Error revoking session:", err)
+		http.Error(w, "Error logging out", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "User logged out successfully")
+}
+
+// handler function to list the active sessions of the user of the request's token
+func (a *App) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	currentID, phoneNumber := identity(r).SessionID, identity(r).PhoneNumber
+
+	rows, err := a.db.Query("SELECT id, created_at, expires_at, last_used_at, user_agent FROM sessions WHERE phone_number = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY id DESC",
+		phoneNumber, time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		log.Default().Println("Error listing sessions:", err)
+		http.Error(w, "Error retrieving sessions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.CreatedAt, &s.ExpiresAt, &s.LastUsedAt, &s.UserAgent); err != nil {
+			log.Default().Println("Error reading session:", err)
+			http.Error(w, "Error retrieving sessions", http.StatusInternalServerError)
+			return
+		}
+		s.Current = s.ID == currentID
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		log.Default().Println("Error listing sessions:", err)
+		http.Error(w, "Error retrieving sessions", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    sessions,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handler function to end one of the sessions of the user, e.g. a login on a lost device
+func (a *App) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber := identity(r).PhoneNumber
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid session id", http.StatusBadRequest)
+		return
+	}
+
+	res, err := a.db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND phone_number = ? AND revoked_at IS NULL",
+		time.Now().UTC().Format(time.DateTime), id, phoneNumber)
+	if err != nil {
+		log.Default().Println("Error revoking session:", err)
+		http.Error(w, "Error revoking session", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Lot is the units bought by one purchase, redeemed first in first out
+type Lot struct {
+	ID             int64   `json:"id"`
+	OrderID        string  `json:"orderID"`
+	Fund           string  `json:"fund"`
+	PurchasedAt    string  `json:"purchasedAt"`
+	Units          Units   `json:"units"`
+	RemainingUnits Units   `json:"remainingUnits"`
+	CostPerUnit    float64 `json:"costPerUnit"`
+	FolioNumber    *string `json:"folioNumber"`
+	// OrderType is the type of the order that allotted the units, lots of dividend reinvestments
+	// are exempt from exit load
+	OrderType string `json:"orderType"`
+}
+
+// handler function to get the open purchase lots of a user, oldest first
+func (a *App) getLots(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := callerPhoneNumber(w, r, r.URL.Query().Get("phoneNumber"))
+	if !ok {
+		return
+	}
+
+	query := `SELECT l.id, l.order_uuid, l.fund, l.purchased_at, l.units, l.remaining_units, l.cost_per_unit, l.folio_number, COALESCE(o.order_type, ?)
+		FROM purchase_lots l LEFT JOIN orders o ON o.uuid = l.order_uuid
+		WHERE l.phone_number = ? AND l.remaining_units > 0`
+	args := []any{OrderTypePurchase, phoneNumber}
+	if fund := r.URL.Query().Get("fund"); fund != "" {
+		query += " AND l.fund = ?"
+		args = append(args, fund)
+	}
+	if folioNumber := r.URL.Query().Get("folioNumber"); folioNumber != "" {
+		query += " AND l.folio_number = ?"
+		args = append(args, folioNumber)
+	}
+	query += " ORDER BY l.folio_number, l.fund, l.purchased_at, l.id"
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		log.Default().Println("Error getting lots:", err)
+		http.Error(w, "Error retrieving lots", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lots := []Lot{}
+	for rows.Next() {
+		var lot Lot
+		if err := rows.Scan(&lot.ID, &lot.OrderID, &lot.Fund, &lot.PurchasedAt, &lot.Units, &lot.RemainingUnits, &lot.CostPerUnit, &lot.FolioNumber, &lot.OrderType); err != nil {
+			log.Default().Println("Error reading lot:", err)
+			http.Error(w, "Error retrieving lots", http.StatusInternalServerError)
+			return
+		}
+		lots = append(lots, lot)
+	}
+	if err := rows.Err(); err != nil {
+		log.Default().Println("Error getting lots:", err)
+		http.Error(w, "Error retrieving lots", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    lots,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// RedemptionRequest asks to sell units of a fund back, either a number of units,
+// units worth an amount at the nav of processing, or all the units held.
+// FolioNumber is only needed when the fund is held in more than one folio.
+// The proceeds are paid out to BankAccountID, or the user's first verified bank account.
+type RedemptionRequest struct {
+	PhoneNumber string `json:"phoneNumber"`
+	Fund        string `json:"fund"`
+	FolioNumber string `json:"folioNumber"`
+	Units       Units  `json:"units"`
+	Amount      Money  `json:"amount"`
+	All         bool   `json:"all"`
+	// BankAccountID must be a verified bank account of the user
+	BankAccountID int64 `json:"bankAccountId"`
+}
+
+// handler function to place a redemption order. It is processed in the background like purchases.
+func (a *App) createRedemptionHandler(w http.ResponseWriter, r *http.Request) {
+	var req RedemptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	phoneNumber, ok := callerPhoneNumber(w, r, req.PhoneNumber)
+	if !ok {
+		return
+	}
+	req.PhoneNumber = phoneNumber
+
+	order, err := a.createRedemption(req)
+	var invalid *invalidRedemptionError
+	if errors.As(err, &invalid) {
+		http.Error(w, invalid.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, errFolioNotFound) || errors.Is(err, errFolioAmbiguous) || errors.Is(err, errBankAccountNotFound) || errors.Is(err, errBankAccountNotVerified) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Default().Println("Error creating redemption:", err)
+		http.Error(w, "Error creating redemption", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    order,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// invalidRedemptionError is returned for redemption requests that can't be placed
+type invalidRedemptionError struct {
+	msg string
+}
+
+func (e *invalidRedemptionError) Error() string {
+	return e.msg
+}
+
+func (a *App) createRedemption(req RedemptionRequest) (*OrderRequest, error) {
+	if req.PhoneNumber == "" {
+		return nil, &invalidRedemptionError{"Phone number is required"}
+	}
+	fundC.Lock()
+	_, ok := fundC.Funds[req.Fund]
+	fundC.Unlock()
+	if !ok {
+		return nil, &invalidRedemptionError{fmt.Sprintf("Fund '%s' not found", req.Fund)}
+	}
+
+	requested := 0
+	for _, set := range []bool{req.Units > 0, req.Amount > 0, req.All} {
+		if set {
+			requested++
+		}
+	}
+	if requested != 1 {
+		return nil, &invalidRedemptionError{"Exactly one of units, amount or all is required"}
+	}
+
+	folioNumber, err := a.redemptionFolio(req.PhoneNumber, req.Fund, req.FolioNumber)
+	if err != nil {
+		return nil, err
+	}
+	held, err := heldUnits(a.db, req.PhoneNumber, folioNumber, req.Fund)
+	if err != nil {
+		return nil, err
+	}
+	if held <= 0 {
+		return nil, &invalidRedemptionError{fmt.Sprintf("No units held in '%s'", req.Fund)}
+	}
+	if req.All {
+		req.Units = held
+	}
+	if req.Units > held {
+		return nil, &invalidRedemptionError{fmt.Sprintf("Only %s units held in '%s' in folio %s", held, req.Fund, folioNumber)}
+	}
+
+	account, err := a.payoutAccount(req.PhoneNumber, req.BankAccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	// units holds the units asked for, amount the amount asked for. Both are set to what was
+	// actually redeemed once the order is processed.
+	_, err = a.db.Exec("INSERT INTO orders (uuid, fund, amount, units, price_per_unit, status, payment_id, phone_number, order_type, folio_number, bank_account_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", id.String(), req.Fund, req.Amount, req.Units, 0, "Submitted", "", req.PhoneNumber, OrderTypeRedemption, folioNumber, account.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	order := &OrderRequest{
+		ID:            id.String(),
+		Fund:          req.Fund,
+		Amount:        req.Amount,
+		Units:         req.Units,
+		Status:        "Submitted",
+		PhoneNumber:   req.PhoneNumber,
+		OrderType:     OrderTypeRedemption,
+		FolioNumber:   &folioNumber,
+		BankAccountID: &account.ID,
+	}
+	a.startProcessing(id.String())
+	return order, nil
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// heldUnits returns the units of the fund still held in open lots of the folio
+func heldUnits(q queryRower, phoneNumber, folioNumber, fund string) (Units, error) {
+	var held Units
+	err := q.QueryRow("SELECT COALESCE(SUM(remaining_units), 0) FROM purchase_lots WHERE phone_number = ? AND folio_number = ? AND fund = ?", phoneNumber, folioNumber, fund).Scan(&held)
+	return held, err
+}
+
+// processRedemption redeems the units of a Submitted redemption order at the current nav,
+// consuming the user's lots of the fund oldest first
+func (a *App) processRedemption(order OrderRequest) error {
+	// Simulate processing the order
+	time.Sleep(time.Duration(processOrderRate) * time.Second)
+
+	fundC.Lock()
+	fund, ok := fundC.Funds[order.Fund]
+	fundC.Unlock()
+
+	var failure *orderFailure
+	if !ok {
+		failure = &orderFailure{FailureFundNotFound, fmt.Sprintf("fund '%s' not found", order.Fund)}
+	}
+
+	units := order.Units
+	if failure == nil && units == 0 {
+		units = unitsFor(order.Amount, fund.MarketValue)
+	}
+
+	updated := false
+	var err error
+	if failure == nil {
+		updated, failure, err = a.redeemLots(order, units, fund.MarketValue, fund.ExitLoads)
+		if err != nil {
+			log.Default().Println("Error redeeming order:", err)
+			return err
+		}
+	}
+	if failure != nil {
+		updated, err = a.failOrder(order.ID, failure)
+		if err != nil {
+			log.Default().Println("Error updating order status:", err)
+			return err
+		}
+	}
+	if !updated {
+		log.Default().Println("Order", order.ID, "was cancelled before redemption")
+		return nil
+	}
+	orderChanges.notify(order.ID)
+
+	if failure != nil {
+		log.Default().Println("Order", order.ID, "failed with", failure.Code+":", failure.Message)
+		return nil
+	}
+	log.Default().Println("Redeemed", units, "units of", order.Fund, "for order:", order.ID)
+	a.payOut(order.ID)
+	return nil
+}
+
+// redeemLots consumes the units from the user's open lots of the fund, oldest first, and marks the
+// redemption order Succeeded. Each lot is charged the exit load of its holding period, except lots
+// of reinvested dividends, the order amount is what is left to pay out. It returns the failure when
+// the user doesn't hold enough units and reports false if the order was no longer Submitted.
+func (a *App) redeemLots(order OrderRequest, units Units, nav float64, exitLoads []ExitLoad) (bool, *orderFailure, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return false, nil, err
+	}
+	defer tx.Rollback()
+
+	folioNumber := ""
+	if order.FolioNumber != nil {
+		folioNumber = *order.FolioNumber
+	}
+	held, err := heldUnits(tx, order.PhoneNumber, folioNumber, order.Fund)
+	if err != nil {
+		return false, nil, err
+	}
+	if units > held {
+		failure := &orderFailure{FailureInsufficientUnits, fmt.Sprintf("%s units requested but only %s units of '%s' are held", units, held, order.Fund)}
+		return false, failure, nil
+	}
+
+	rows, err := tx.Query(`SELECT l.id, l.purchased_at, l.remaining_units, l.cost_per_unit, COALESCE(o.order_type, ?)
+		FROM purchase_lots l LEFT JOIN orders o ON o.uuid = l.order_uuid
+		WHERE l.phone_number = ? AND l.folio_number = ? AND l.fund = ? AND l.remaining_units > 0 ORDER BY l.purchased_at, l.id`,
+		OrderTypePurchase, order.PhoneNumber, folioNumber, order.Fund)
+	if err != nil {
+		return false, nil, err
+	}
+	var lots []Lot
+	for rows.Next() {
+		var lot Lot
+		if err := rows.Scan(&lot.ID, &lot.PurchasedAt, &lot.RemainingUnits, &lot.CostPerUnit, &lot.OrderType); err != nil {
+			rows.Close()
+			return false, nil, err
+		}
+		lots = append(lots, lot)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, nil, err
+	}
+
+	now := time.Now()
+	remaining := units
+	totalLoad := Money(0)
+	for _, lot := range lots {
+		if remaining <= 0 {
+			break
+		}
+		consumed := min(lot.RemainingUnits, remaining)
+		remaining -= consumed
+
+		purchasedAt, err := time.Parse(time.RFC3339, lot.PurchasedAt)
+		if err != nil {
+			return false, nil, fmt.Errorf("purchase time of lot %d: %w", lot.ID, err)
+		}
+		// units allotted by reinvesting a dividend are exempt from exit load
+		rate := 0.0
+		if lot.OrderType != OrderTypeDividendReinvestment {
+			rate = exitLoadRate(exitLoads, int(now.Sub(purchasedAt).Hours()/24))
+		}
+		load := consumed.valueAt(nav).percent(rate)
+		totalLoad += load
+
+		_, err = tx.Exec("UPDATE purchase_lots SET remaining_units = remaining_units - ? WHERE id = ?", consumed, lot.ID)
+		if err != nil {
+			return false, nil, err
+		}
+		_, err = tx.Exec(`INSERT INTO lot_redemptions (redemption_order_uuid, lot_id, phone_number, fund, units, purchased_at, cost_per_unit, redeemed_at, redemption_price, folio_number, exit_load_rate, exit_load)
+			SELECT ?, id, phone_number, fund, ?, purchased_at, cost_per_unit, CURRENT_TIMESTAMP, ?, folio_number, ?, ? FROM purchase_lots WHERE id = ?`, order.ID, consumed, nav, rate, load, lot.ID)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	gross := units.valueAt(nav)
+	res, err := tx.Exec("UPDATE orders SET units = ?, price_per_unit = ?, gross_amount = ?, exit_load = ?, amount = ?, status = 'Succeeded', succeeded_at = CURRENT_TIMESTAMP WHERE uuid = ? AND status = 'Submitted'",
+		units, nav, gross, totalLoad, gross-totalLoad, order.ID)
+	if err != nil {
+		return false, nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil, nil
+	}
+
+	return true, nil, tx.Commit()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// inTempDir runs the rest of the test in a new temporary directory, where initializeDatabase
+// creates its database
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// newTestApp returns an App on a new database in a temporary directory
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	inTempDir(t)
+	db, err := initializeDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &App{db: db}
+}
+
+// testLot is a lot seeded along with the order that allotted it
+type testLot struct {
+	orderID     string
+	orderType   string
+	folioNumber string
+	fund        string
+	units       Units
+	costPerUnit float64
+	purchasedAt time.Time
+}
+
+func seedLots(t *testing.T, db *sql.DB, phoneNumber string, lots []testLot) {
+	t.Helper()
+	for _, l := range lots {
+		_, err := db.Exec(`INSERT INTO orders (uuid, phone_number, fund, amount, units, status, order_type, folio_number, succeeded_at)
+			VALUES (?, ?, ?, ?, ?, 'Succeeded', ?, ?, ?)`,
+			l.orderID, phoneNumber, l.fund, l.units.valueAt(l.costPerUnit), l.units, l.orderType, l.folioNumber, l.purchasedAt.UTC().Format(time.DateTime))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO purchase_lots (order_uuid, phone_number, fund, purchased_at, units, remaining_units, cost_per_unit, folio_number)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			l.orderID, phoneNumber, l.fund, l.purchasedAt.UTC().Format(time.DateTime), l.units, l.units, l.costPerUnit, l.folioNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// lotRedemption is a row of lot_redemptions
+type lotRedemption struct {
+	orderID      string
+	units        Units
+	exitLoadRate float64
+	exitLoad     Money
+}
+
+func TestRedeemLots(t *testing.T) {
+	const (
+		phoneNumber = "9000000002"
+		folioNumber = "GRO1000001"
+		fund        = "Growth Fund 1"
+		nav         = 15.0
+	)
+	now := time.Now()
+	exitLoads := []ExitLoad{{WithinDays: 365, Percentage: 1}}
+	lots := []testLot{
+		{"old", OrderTypePurchase, folioNumber, fund, 100 * Unit, 10, now.AddDate(0, 0, -400)},
+		{"recent", OrderTypePurchase, folioNumber, fund, 50 * Unit, 12, now.AddDate(0, 0, -100)},
+		{"reinvested", OrderTypeDividendReinvestment, folioNumber, fund, 20 * Unit, 11, now.AddDate(0, 0, -50)},
+		// lots of other folios and funds are never touched
+		{"other-folio", OrderTypePurchase, "GRO1000002", fund, 100 * Unit, 9, now.AddDate(0, 0, -500)},
+		{"other-fund", OrderTypePurchase, folioNumber, "Growth Fund 2", 100 * Unit, 9, now.AddDate(0, 0, -500)},
+	}
+
+	tests := []struct {
+		name   string
+		units  Units
+		status string
+
+		updated     bool
+		failure     string
+		remaining   map[string]Units
+		redemptions []lotRedemption
+		exitLoad    Money
+	}{
+		{
+			name:        "part of the oldest lot",
+			units:       60 * Unit,
+			updated:     true,
+			remaining:   map[string]Units{"old": 40 * Unit, "recent": 50 * Unit, "reinvested": 20 * Unit},
+			redemptions: []lotRedemption{{"old", 60 * Unit, 0, 0}},
+		},
+		{
+			name:      "the oldest lot and part of the next",
+			units:     130 * Unit,
+			updated:   true,
+			remaining: map[string]Units{"old": 0, "recent": 20 * Unit, "reinvested": 20 * Unit},
+			redemptions: []lotRedemption{
+				{"old", 100 * Unit, 0, 0},
+				// 30 units at 15 is 450.00, 1% of it is 4.50
+				{"recent", 30 * Unit, 1, 450},
+			},
+			exitLoad: 450,
+		},
+		{
+			name:      "into the lot of a reinvested dividend",
+			units:     160 * Unit,
+			updated:   true,
+			remaining: map[string]Units{"old": 0, "recent": 0, "reinvested": 10 * Unit},
+			redemptions: []lotRedemption{
+				{"old", 100 * Unit, 0, 0},
+				{"recent", 50 * Unit, 1, 750},
+				{"reinvested", 10 * Unit, 0, 0},
+			},
+			exitLoad: 750,
+		},
+		{
+			name:      "fraction of a unit",
+			units:     Unit / 2,
+			updated:   true,
+			remaining: map[string]Units{"old": 99500, "recent": 50 * Unit, "reinvested": 20 * Unit},
+			// 0.5 units at 15 is 7.50
+			redemptions: []lotRedemption{{"old", Unit / 2, 0, 0}},
+		},
+		{
+			name:      "every unit held",
+			units:     170 * Unit,
+			updated:   true,
+			remaining: map[string]Units{"old": 0, "recent": 0, "reinvested": 0},
+			redemptions: []lotRedemption{
+				{"old", 100 * Unit, 0, 0},
+				{"recent", 50 * Unit, 1, 750},
+				{"reinvested", 20 * Unit, 0, 0},
+			},
+			exitLoad: 750,
+		},
+		{
+			name:      "more than held",
+			units:     170*Unit + 1,
+			failure:   FailureInsufficientUnits,
+			remaining: map[string]Units{"old": 100 * Unit, "recent": 50 * Unit, "reinvested": 20 * Unit},
+		},
+		{
+			name:      "order no longer submitted",
+			units:     60 * Unit,
+			status:    "Cancelled",
+			remaining: map[string]Units{"old": 100 * Unit, "recent": 50 * Unit, "reinvested": 20 * Unit},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t)
+			seedLots(t, a.db, phoneNumber, lots)
+
+			status := tt.status
+			if status == "" {
+				status = "Submitted"
+			}
+			folio := folioNumber
+			order := OrderRequest{ID: "redemption", Fund: fund, PhoneNumber: phoneNumber, FolioNumber: &folio, Units: tt.units, OrderType: OrderTypeRedemption}
+			_, err := a.db.Exec("INSERT INTO orders (uuid, phone_number, fund, units, status, order_type, folio_number) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				order.ID, phoneNumber, fund, tt.units, status, OrderTypeRedemption, folioNumber)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			updated, failure, err := a.redeemLots(order, tt.units, nav, exitLoads)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated != tt.updated {
+				t.Errorf("redeemLots() updated = %v, want %v", updated, tt.updated)
+			}
+			gotFailure := ""
+			if failure != nil {
+				gotFailure = failure.Code
+			}
+			if gotFailure != tt.failure {
+				t.Errorf("redeemLots() failure = %q, want %q", gotFailure, tt.failure)
+			}
+
+			for orderID, want := range tt.remaining {
+				var got Units
+				if err := a.db.QueryRow("SELECT remaining_units FROM purchase_lots WHERE order_uuid = ?", orderID).Scan(&got); err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("lot %s has %s units remaining, want %s", orderID, got, want)
+				}
+			}
+			for _, orderID := range []string{"other-folio", "other-fund"} {
+				var got Units
+				if err := a.db.QueryRow("SELECT remaining_units FROM purchase_lots WHERE order_uuid = ?", orderID).Scan(&got); err != nil {
+					t.Fatal(err)
+				}
+				if got != 100*Unit {
+					t.Errorf("lot %s has %s units remaining, want 100.000", orderID, got)
+				}
+			}
+
+			rows, err := a.db.Query(`SELECT l.order_uuid, r.units, r.exit_load_rate, r.exit_load FROM lot_redemptions r
+				JOIN purchase_lots l ON l.id = r.lot_id WHERE r.redemption_order_uuid = ? ORDER BY r.id`, order.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var redemptions []lotRedemption
+			for rows.Next() {
+				var r lotRedemption
+				if err := rows.Scan(&r.orderID, &r.units, &r.exitLoadRate, &r.exitLoad); err != nil {
+					t.Fatal(err)
+				}
+				redemptions = append(redemptions, r)
+			}
+			if !slices.Equal(redemptions, tt.redemptions) {
+				t.Errorf("lot redemptions = %v, want %v", redemptions, tt.redemptions)
+			}
+
+			if !tt.updated {
+				return
+			}
+			var (
+				gotStatus               string
+				gross, exitLoad, amount Money
+			)
+			err = a.db.QueryRow("SELECT status, gross_amount, exit_load, amount FROM orders WHERE uuid = ?", order.ID).Scan(&gotStatus, &gross, &exitLoad, &amount)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantGross := tt.units.valueAt(nav)
+			if gotStatus != "Succeeded" || gross != wantGross || exitLoad != tt.exitLoad || amount != wantGross-tt.exitLoad {
+				t.Errorf("order is %s with gross %s, exit load %s and amount %s, want Succeeded with %s, %s and %s",
+					gotStatus, gross, exitLoad, amount, wantGross, tt.exitLoad, wantGross-tt.exitLoad)
+			}
+		})
+	}
+}
@@ -2,18 +2,22 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"payment-gateway/internal/ratelimit"
 
 	"database/sql"
 	"log"
@@ -63,27 +67,72 @@ func main() {
 	}
 	defer db.Close()
 
-	// run updateMarketValue every 1 minute
-	go runNavUpdateCache()
-
 	// Create a new instance of the App
 	app := NewApp(db)
 
+	// run updateMarketValue every 1 minute
+	go app.runNavUpdateCache()
+	// refunds of cancelled orders left pending by the last run
+	go app.refundPendingOrders()
+
 	// Run the application
 	app.Run()
 }
 
-func runNavUpdateCache() {
-	updateMarketValue()
+func (a *App) runNavUpdateCache() {
+	a.declareNav()
 	// run nav update every 1 minute
 	ticker := time.NewTicker(time.Duration(navValueUpdateRate) * time.Second)
 	go func() {
 		for range ticker.C {
-			updateMarketValue()
+			a.declareNav()
 		}
 	}()
 }
 
+// declareNav allots the NFOs whose allotment date has come, updates the market value of every
+// fund, records it in the nav history, pays the dividends whose record date has come, values
+// every portfolio at the new navs and lets the streaming clients know. Funds going ex-dividend
+// drop from their last nav by the dividend.
+func (a *App) declareNav() {
+	a.allotDueNFOs(time.Now())
+	updateMarketValue()
+
+	declaredAt := time.Now().UTC()
+	dividends, err := a.dueDividends(declaredAt)
+	if err != nil {
+		log.Default().Println("Error getting due dividends:", err)
+	}
+	exNavs, err := a.dropNavs(dividends, declaredAt)
+	if err != nil {
+		log.Default().Println("Error dropping navs for dividends:", err)
+	}
+
+	navs := map[string]float64{}
+	fundC.Lock()
+	for name, fund := range fundC.Funds {
+		navs[name] = fund.MarketValue
+	}
+	fundC.Unlock()
+
+	if err := a.recordNav(declaredAt, navs); err != nil {
+		log.Default().Println("Error recording nav history:", err)
+	}
+	analyticsC.reset()
+	for _, d := range dividends {
+		if exNav, ok := exNavs[d.ID]; ok {
+			if err := a.payDividend(d, exNav); err != nil {
+				log.Default().Println("Error paying dividend", d.ID, "of", d.Fund+":", err)
+			}
+		}
+	}
+	if _, err := a.snapshotPortfolios(declaredAt, navs, ""); err != nil {
+		log.Default().Println("Error taking portfolio snapshots:", err)
+	}
+
+	a.publishNavUpdates()
+}
+
 func initializeDatabase() (*sql.DB, error) {
 	// Open the SQLite database file
 	log.Default().Println("Initialising database...")
@@ -99,20 +148,62 @@ func initializeDatabase() (*sql.DB, error) {
 		phone_number TEXT,
 		uuid TEXT,
 		fund TEXT,
-		amount FLOAT,
-		units FLOAT,
+		amount INTEGER,
+		units INTEGER,
 		price_per_unit FLOAT,
 		status TEXT DEFAULT 'Submitted',
 		payment_id TEXT,
 		submitted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		succeeded_at TIMESTAMP,
-		failed_at TIMESTAMP
+		failed_at TIMESTAMP,
+		failure_code TEXT,
+		failure_message TEXT,
+		cancelled_at TIMESTAMP,
+		refund_status TEXT,
+		refund_id TEXT,
+		strategy_name TEXT,
+		order_type TEXT DEFAULT 'Purchase',
+		folio_number TEXT,
+		bank_account_id INTEGER,
+		payout_id TEXT,
+		payout_status TEXT,
+		payment_verified_at TIMESTAMP,
+		gross_amount INTEGER,
+		exit_load INTEGER,
+		net_amount INTEGER,
+		charges TEXT,
+		tds INTEGER,
+		dividend_id INTEGER
 	)`)
 	if err != nil {
 		log.Fatal(err)
 		return nil, err
 	}
 
+	// Add the columns introduced after the orders table was first created
+	for _, c := range orderColumnMigrations {
+		err = addColumnIfMissing(db, "orders", c.name, c.definition)
+		if err != nil {
+			log.Fatal(err)
+			return nil, err
+		}
+	}
+
+	// Create the indexes used to look up and list orders
+	for _, stmt := range []string{
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_uuid ON orders (uuid)`,
+		`CREATE INDEX IF NOT EXISTS idx_orders_phone_number ON orders (phone_number, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_orders_payment_id ON orders (payment_id, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_orders_fund ON orders (fund, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_orders_status ON orders (status, id)`,
+	} {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			log.Fatal(err)
+			return nil, err
+		}
+	}
+
 	// Create the user table if it doesn't exist
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -123,225 +214,1254 @@ func initializeDatabase() (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Create the kyc profiles table if it doesn't exist, one profile per user
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS kyc_profiles (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		phone_number TEXT UNIQUE,
+		pan TEXT,
+		name TEXT,
+		date_of_birth TEXT,
+		address TEXT,
+		status TEXT,
+		rejection_reason TEXT,
+		submitted_at TIMESTAMP,
+		reviewed_at TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_kyc_profiles_pan ON kyc_profiles (pan)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the nomination tables if they don't exist, a user either has nominees or opted out
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS nominations (
+		phone_number TEXT PRIMARY KEY,
+		opted_out BOOLEAN,
+		updated_at TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS nominees (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		phone_number TEXT,
+		name TEXT,
+		relationship TEXT,
+		date_of_birth TEXT,
+		share_percentage REAL,
+		guardian_name TEXT,
+		guardian_relationship TEXT
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_nominees_phone_number ON nominees (phone_number)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the bank accounts table if it doesn't exist, accounts are verified with a penny drop
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS bank_accounts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		phone_number TEXT,
+		account_number TEXT,
+		ifsc_code TEXT,
+		beneficiary_name TEXT,
+		status TEXT,
+		failure_reason TEXT,
+		penny_drop_id TEXT,
+		created_at TIMESTAMP,
+		verified_at TIMESTAMP,
+		UNIQUE (phone_number, account_number, ifsc_code)
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the user roles table if it doesn't exist, the roles granted on top of investor
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS user_roles (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		phone_number TEXT,
+		role TEXT,
+		granted_by TEXT,
+		granted_at TIMESTAMP,
+		UNIQUE (phone_number, role)
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	err = bootstrapAdmins(db)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the login otps table if it doesn't exist, codes are stored hashed
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS login_otps (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		phone_number TEXT,
+		code_hash TEXT,
+		attempts INTEGER DEFAULT 0,
+		created_at TIMESTAMP,
+		expires_at TIMESTAMP,
+		consumed_at TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_login_otps_phone_number ON login_otps (phone_number, created_at)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the sessions table if it doesn't exist, tokens are stored hashed
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT UNIQUE,
+		phone_number TEXT,
+		user_agent TEXT,
+		created_at TIMESTAMP,
+		expires_at TIMESTAMP,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_sessions_phone_number ON sessions (phone_number)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the purchase lots table if it doesn't exist, one lot per allotted purchase
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS purchase_lots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		order_uuid TEXT UNIQUE,
+		phone_number TEXT,
+		fund TEXT,
+		purchased_at TIMESTAMP,
+		units INTEGER,
+		remaining_units INTEGER,
+		cost_per_unit FLOAT,
+		folio_number TEXT
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	err = addColumnIfMissing(db, "purchase_lots", "folio_number", "TEXT")
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_purchase_lots_holding ON purchase_lots (phone_number, fund, purchased_at)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	// Open the lots of purchases allotted before lots were tracked
+	_, err = db.Exec(`INSERT INTO purchase_lots (order_uuid, phone_number, fund, purchased_at, units, remaining_units, cost_per_unit, folio_number)
+		SELECT uuid, phone_number, fund, succeeded_at, units, units, price_per_unit, folio_number FROM orders
+		WHERE status = 'Succeeded' AND order_type = 'Purchase' AND uuid NOT IN (SELECT order_uuid FROM purchase_lots)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the lot redemptions table if it doesn't exist, one row per lot consumed by a redemption
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS lot_redemptions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		redemption_order_uuid TEXT,
+		lot_id INTEGER,
+		phone_number TEXT,
+		fund TEXT,
+		units INTEGER,
+		purchased_at TIMESTAMP,
+		cost_per_unit FLOAT,
+		redeemed_at TIMESTAMP,
+		redemption_price FLOAT,
+		folio_number TEXT,
+		exit_load_rate FLOAT,
+		exit_load INTEGER
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	for _, column := range []string{"folio_number TEXT", "exit_load_rate FLOAT", "exit_load INTEGER"} {
+		name, definition, _ := strings.Cut(column, " ")
+		err = addColumnIfMissing(db, "lot_redemptions", name, definition)
+		if err != nil {
+			log.Fatal(err)
+			return nil, err
+		}
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_lot_redemptions_phone_number ON lot_redemptions (phone_number, redeemed_at)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the folios table if it doesn't exist, the accounts users hold units of an AMC in
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS folios (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		folio_number TEXT UNIQUE,
+		phone_number TEXT,
+		amc TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_folios_phone_number ON folios (phone_number, amc)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	err = backfillFolios(db)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the exit loads table if it doesn't exist, the schedules set through the admin API
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS fund_exit_loads (
+		fund TEXT PRIMARY KEY,
+		schedule TEXT,
+		updated_by TEXT,
+		updated_at TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	// Create the launched funds table if it doesn't exist, funds launched with an NFO through the admin API
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS launched_funds (
+		name TEXT PRIMARY KEY,
+		amc TEXT,
+		asset_class TEXT,
+		nav_min FLOAT,
+		nav_max FLOAT,
+		min_first_purchase INTEGER,
+		min_additional_purchase INTEGER,
+		purchase_multiple INTEGER,
+		open_date TEXT,
+		close_date TEXT,
+		allotment_date TEXT,
+		offer_nav FLOAT,
+		allotted_at TIMESTAMP,
+		launched_by TEXT,
+		launched_at TIMESTAMP,
+		category TEXT,
+		sub_category TEXT,
+		riskometer TEXT,
+		expense_ratio FLOAT,
+		aum INTEGER,
+		benchmark TEXT
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	for _, column := range []string{"category TEXT", "sub_category TEXT", "riskometer TEXT", "expense_ratio FLOAT", "aum INTEGER", "benchmark TEXT"} {
+		name, definition, _ := strings.Cut(column, " ")
+		err = addColumnIfMissing(db, "launched_funds", name, definition)
+		if err != nil {
+			log.Fatal(err)
+			return nil, err
+		}
+	}
+	// Launched funds are loaded before the exit loads, which include theirs
+	err = loadLaunchedFunds(db)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	err = loadExitLoads(db)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the nav history table if it doesn't exist, one row per fund per nav declaration
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS nav_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fund TEXT,
+		nav FLOAT,
+		declared_at TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_nav_history_fund ON nav_history (fund, declared_at)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_nav_history_declared_at ON nav_history (declared_at)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the portfolio snapshots table if it doesn't exist, one row per user per nav declaration
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS portfolio_snapshots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		phone_number TEXT,
+		valued_at TIMESTAMP,
+		invested_amount FLOAT,
+		market_value FLOAT,
+		UNIQUE (phone_number, valued_at)
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the dividends table if it doesn't exist, one row per dividend declared by a fund
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS dividends (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fund TEXT,
+		record_date TEXT,
+		amount_per_unit FLOAT,
+		status TEXT,
+		ex_dividend_nav FLOAT,
+		declared_by TEXT,
+		declared_at TIMESTAMP,
+		paid_at TIMESTAMP,
+		UNIQUE (fund, record_date)
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the dividend options table if it doesn't exist, the choice of payout or reinvestment per fund per folio
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS dividend_options (
+		folio_number TEXT,
+		fund TEXT,
+		phone_number TEXT,
+		option TEXT,
+		updated_at TIMESTAMP,
+		PRIMARY KEY (folio_number, fund)
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
+	// Create the schema migrations table if it doesn't exist, the data migrations already applied
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+	// Amounts and units are stored as integer paise and thousandths of units
+	err = migrateToPaise(db)
+	if err != nil {
+		log.Fatal(err)
+		return nil, err
+	}
+
 	return db, nil
 }
 
+// orderColumnMigrations lists the columns added to the orders table after its first release,
+// in the order they were introduced.
+var orderColumnMigrations = []struct {
+	name       string
+	definition string
+}{
+	{"failure_code", "TEXT"},
+	{"failure_message", "TEXT"},
+	{"cancelled_at", "TIMESTAMP"},
+	{"refund_status", "TEXT"},
+	{"refund_id", "TEXT"},
+	{"strategy_name", "TEXT"},
+	{"order_type", "TEXT DEFAULT 'Purchase'"},
+	{"folio_number", "TEXT"},
+	{"bank_account_id", "INTEGER"},
+	{"payout_id", "TEXT"},
+	{"payout_status", "TEXT"},
+	{"payment_verified_at", "TIMESTAMP"},
+	{"gross_amount", "INTEGER"},
+	{"exit_load", "INTEGER"},
+	{"net_amount", "INTEGER"},
+	{"charges", "TEXT"},
+	{"tds", "INTEGER"},
+	{"dividend_id", "INTEGER"},
+}
+
+// addColumnIfMissing adds a column to an existing table so that databases created
+// by older versions of the service pick up new columns on startup.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("error reading columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     *string
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("error reading columns of %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading columns of %s: %w", table, err)
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("error adding column %s to %s: %w", column, table, err)
+	}
+	return nil
+}
+
 type App struct {
 	db *sql.DB
 	// base url for the payment gateway
 	baseURL           string
 	paymentGatewayUrl string
+	// paymentGatewayAPIKey is the key the gateway issued to the RTA, sent on penny drops, payouts and refunds
+	paymentGatewayAPIKey string
+	// otpSender delivers the login OTPs, otpMu serialises issuing and verifying them
+	otpSender otpSender
+	otpMu     sync.Mutex
+	limiter   *ratelimit.Limiter
+	// apiKeys are the keys issued to API clients, they are rate limited by key
+	apiKeys map[string]bool
+	// chargeRules are the charges deducted from purchases
+	chargeRules []chargeRule
+	// tds is deducted from dividends
+	tds tdsRule
+	// riskFreeRate is the annual rate in percent the fund analytics measure excess returns against
+	riskFreeRate float64
 }
 
 func NewApp(db *sql.DB) *App {
-	return &App{
+	a := &App{
 		db: db,
 		// baseurl from the environment variable
 		baseURL:           os.Getenv("BASE_URL"),
 		paymentGatewayUrl: os.Getenv("PAYMENT_GATEWAY_URL"),
+		paymentGatewayAPIKey: os.Getenv("PAYMENT_GATEWAY_API_KEY"),
+		otpSender:         newOTPSender(),
+		apiKeys:           loadAPIKeys(),
+		chargeRules:       loadChargeRules(),
+		tds:               loadTDSRule(),
+		riskFreeRate:      loadRiskFreeRate(),
 	}
+	a.limiter = ratelimit.New(defaultRateLimits, a.rateLimitKey)
+	return a
 }
 
 func (a *App) Run() {
 	// Start the web server
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("POST /order", randomFailureMiddleware(a.createOrderHandler))
-	mux.HandleFunc("GET /order/{id}", randomFailureMiddleware(a.getOrder))
-	mux.HandleFunc("GET /market-value/{fund}", randomFailureMiddleware(a.fundNav))
+	// Routes acting on a user's account are wrapped in authenticate, the user comes from the session token.
+	// Admin and operator routes are wrapped in authorize with the permission they need, see roles.go.
+
+	mux.HandleFunc("POST /order", randomFailureMiddleware(a.authenticate(a.createOrderHandler)))
+	mux.HandleFunc("GET /order/{id}", randomFailureMiddleware(a.authenticate(a.getOrder)))
+	mux.HandleFunc("GET /orders", randomFailureMiddleware(a.authenticate(a.listOrders)))
+	mux.HandleFunc("POST /order/{id}/cancel", randomFailureMiddleware(a.authenticate(a.cancelOrderHandler)))
+	mux.HandleFunc("GET /stream", randomFailureMiddleware(a.authenticateStream(a.streamHandler)))
+	mux.HandleFunc("GET /portfolio/returns", randomFailureMiddleware(a.authenticate(a.portfolioReturnsHandler)))
+	mux.HandleFunc("GET /portfolio/history", randomFailureMiddleware(a.authenticate(a.portfolioHistoryHandler)))
+	mux.HandleFunc("POST /portfolio/history/rebuild", randomFailureMiddleware(a.authorize(PermRunOperations, a.rebuildPortfolioHistoryHandler)))
+	mux.HandleFunc("POST /redemption", randomFailureMiddleware(a.authenticate(a.createRedemptionHandler)))
+	mux.HandleFunc("GET /holdings/lots", randomFailureMiddleware(a.authenticate(a.getLots)))
+	mux.HandleFunc("GET /reports/capital-gains", randomFailureMiddleware(a.authenticate(a.capitalGainsHandler)))
+	mux.HandleFunc("GET /statement", randomFailureMiddleware(a.authenticate(a.statementHandler)))
+	mux.HandleFunc("GET /folios", randomFailureMiddleware(a.authenticate(a.listFolios)))
+	mux.HandleFunc("POST /folios", randomFailureMiddleware(a.authenticate(a.createFolioHandler)))
+	mux.HandleFunc("GET /nominees", randomFailureMiddleware(a.authenticate(a.getNomineesHandler)))
+	mux.HandleFunc("PUT /nominees", randomFailureMiddleware(a.authenticate(a.setNomineesHandler)))
+	mux.HandleFunc("GET /bank-accounts", randomFailureMiddleware(a.authenticate(a.listBankAccounts)))
+	mux.HandleFunc("POST /bank-accounts", randomFailureMiddleware(a.authenticate(a.addBankAccountHandler)))
+	mux.HandleFunc("DELETE /bank-accounts/{id}", randomFailureMiddleware(a.authenticate(a.deleteBankAccountHandler)))
+	mux.HandleFunc("POST /kyc", randomFailureMiddleware(a.authenticate(a.submitKYCHandler)))
+	mux.HandleFunc("GET /kyc", randomFailureMiddleware(a.authenticate(a.getKYCHandler)))
+	mux.HandleFunc("GET /admin/kyc", randomFailureMiddleware(a.authorize(PermViewAccounts, a.listKYCHandler)))
+	mux.HandleFunc("POST /admin/kyc/{phoneNumber}/approve", randomFailureMiddleware(a.authorize(PermReviewKYC, a.approveKYCHandler)))
+	mux.HandleFunc("POST /admin/kyc/{phoneNumber}/reject", randomFailureMiddleware(a.authorize(PermReviewKYC, a.rejectKYCHandler)))
+	mux.HandleFunc("GET /admin/roles", randomFailureMiddleware(a.authorize(PermManageRoles, a.listRolesHandler)))
+	mux.HandleFunc("GET /admin/users/{phoneNumber}/roles", randomFailureMiddleware(a.authorize(PermManageRoles, a.getUserRolesHandler)))
+	mux.HandleFunc("PUT /admin/users/{phoneNumber}/roles/{role}", randomFailureMiddleware(a.authorize(PermManageRoles, a.grantRoleHandler)))
+	mux.HandleFunc("DELETE /admin/users/{phoneNumber}/roles/{role}", randomFailureMiddleware(a.authorize(PermManageRoles, a.revokeRoleHandler)))
+	mux.HandleFunc("GET /market-value/{fund}", randomFailureMiddleware(a.fundNav))
+	mux.HandleFunc("PUT /admin/funds/{fund}/exit-loads", randomFailureMiddleware(a.authorize(PermRunOperations, a.setExitLoadsHandler)))
+	mux.HandleFunc("POST /admin/funds", randomFailureMiddleware(a.authorize(PermRunOperations, a.launchFundHandler)))
+	mux.HandleFunc("POST /admin/funds/{fund}/dividends", randomFailureMiddleware(a.authorize(PermRunOperations, a.declareDividendHandler)))
+	mux.HandleFunc("GET /funds", randomFailureMiddleware(a.listFunds))
+	mux.HandleFunc("GET /funds/{fund}/analytics", randomFailureMiddleware(a.fundAnalyticsHandler))
+	mux.HandleFunc("GET /funds/{fund}/dividends", randomFailureMiddleware(a.listDividends))
+	mux.HandleFunc("PUT /folios/{folioNumber}/dividend-options/{fund}", randomFailureMiddleware(a.authenticate(a.setDividendOptionHandler)))
+
+	// Add this handler to your router or mux
+	mux.HandleFunc("POST /execute-strategy-orders", randomFailureMiddleware(a.authenticate(a.executeStrategyOrdersHandler)))
+	// Route for user login
+	mux.HandleFunc("POST /login", randomFailureMiddleware(a.loginHandler))
+	mux.HandleFunc("POST /login/otp", randomFailureMiddleware(a.requestOTPHandler))
+	mux.HandleFunc("POST /login/verify", randomFailureMiddleware(a.verifyOTPHandler))
+	mux.HandleFunc("POST /logout", randomFailureMiddleware(a.authenticate(a.logoutHandler)))
+	mux.HandleFunc("GET /sessions", randomFailureMiddleware(a.authenticate(a.listSessionsHandler)))
+	mux.HandleFunc("DELETE /sessions/{id}", randomFailureMiddleware(a.authenticate(a.revokeSessionHandler)))
+
+	// Route for user signup
+	mux.HandleFunc("POST /signup", randomFailureMiddleware(a.signupHandler))
+	mux.HandleFunc("/aggregated-orders-by-phone", randomFailureMiddleware(a.authenticate(a.getAggregatedOrdersByPhoneNumber)))
+
+	mux.HandleFunc("GET /metrics/rate-limits", randomFailureMiddleware(a.authorize(PermRunOperations, a.limiter.MetricsHandler)))
+
+	// Rate limits apply to every route, before its handler and randomFailureMiddleware run
+	handler := allowCORS(a.limiter.Middleware(mux))
+
+	// Route for fetching user portfolio
+	// mux.HandleFunc("/portfolio", randomFailureMiddleware(a.getPortfolioHandler))
+	log.Default().Println("Server started at :8081")
+	err := http.ListenAndServe(":8081", handler)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// CORS middleware // Add this handler to your router or mux
+func allowCORS(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, Last-Event-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining")
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+type OrderRequest struct {
+	ID           string  `json:"id"`
+	Fund         string  `json:"fund"`
+	Amount       Money   `json:"amount"`
+	Units        Units   `json:"units"`
+	PricePerUnit float64 `json:"pricePerUnit"`
+	Status       string  `json:"status"`
+	PaymentID    string  `json:"paymentID"`
+	PhoneNumber  string  `json:"phoneNumber"`
+	SubmittedAt  *string `json:"submittedAt"`
+	SucceededAt  *string `json:"succeededAt"`
+	FailedAt     *string `json:"failedAt"`
+	// FailureCode is one of the Failure* codes, set only when the order has Failed
+	FailureCode    *string `json:"failureCode"`
+	FailureMessage *string `json:"failureMessage"`
+	CancelledAt    *string `json:"cancelledAt"`
+	// RefundStatus is set once a cancelled or failed order's amount is due back to the investor,
+	// see the RefundStatus* values. RefundID is the gateway's refund once it is Refunded.
+	RefundStatus *string `json:"refundStatus"`
+	RefundID     *string `json:"refundId"`
+	// StrategyName is set for orders placed as part of a strategy
+	StrategyName *string `json:"strategyName"`
+	// OrderType is one of the OrderType* values
+	OrderType string `json:"orderType"`
+	// FolioNumber is the folio the units are bought into or redeemed from
+	FolioNumber *string `json:"folioNumber"`
+	// BankAccountID is the verified bank account a redemption is paid out to
+	BankAccountID *int64 `json:"bankAccountId"`
+	// PayoutID and PayoutStatus are set once a redemption is paid out, see the PayoutStatus* values
+	PayoutID     *string `json:"payoutId"`
+	PayoutStatus *string `json:"payoutStatus"`
+	// GrossAmount and ExitLoad are set once a redemption Succeeded, Amount is then the net payout.
+	// For dividends GrossAmount is the dividend and Amount what is left of it after the TDS.
+	GrossAmount *Money `json:"grossAmount"`
+	ExitLoad    *Money `json:"exitLoad"`
+	// NetAmount and Charges are set once a purchase Succeeded, units are allotted for the
+	// amount less the charges
+	NetAmount *Money       `json:"netAmount"`
+	Charges   OrderCharges `json:"charges"`
+	// Tds is the tax deducted from a dividend, DividendID the dividend it was paid for
+	Tds        *Money `json:"tds"`
+	DividendID *int64 `json:"dividendId"`
+}
+
+// Types of orders. Purchases are what POST /order creates; the others are recorded
+// against a holding by the RTA.
+const (
+	OrderTypePurchase = "Purchase"
+	// Units sold back to the fund, amount is the payout
+	OrderTypeRedemption = "Redemption"
+	// Dividend paid out to the investor, amount is the payout and no units change
+	OrderTypeDividendPayout = "Dividend Payout"
+	// Dividend used to buy more units, amount is the dividend reinvested
+	OrderTypeDividendReinvestment = "Dividend Reinvestment"
+)
+
+// orderColumns are the columns selected to build an OrderRequest, in the order scanOrder reads them
+const orderColumns = "uuid, fund, amount, units, price_per_unit, status, payment_id, phone_number, submitted_at, succeeded_at, failed_at, failure_code, failure_message, cancelled_at, refund_status, strategy_name, order_type, folio_number, bank_account_id, payout_id, payout_status, gross_amount, exit_load, net_amount, charges, tds, dividend_id, refund_id"
+
+// scanOrder reads a row selected with orderColumns, optionally preceded by extra destinations
+func scanOrder(row interface{ Scan(...any) error }, order *OrderRequest, extra ...any) error {
+	dest := append(extra, &order.ID, &order.Fund, &order.Amount, &order.Units, &order.PricePerUnit, &order.Status, &order.PaymentID, &order.PhoneNumber, &order.SubmittedAt, &order.SucceededAt, &order.FailedAt, &order.FailureCode, &order.FailureMessage, &order.CancelledAt, &order.RefundStatus, &order.StrategyName, &order.OrderType, &order.FolioNumber, &order.BankAccountID, &order.PayoutID, &order.PayoutStatus, &order.GrossAmount, &order.ExitLoad, &order.NetAmount, &order.Charges, &order.Tds, &order.DividendID, &order.RefundID)
+	return row.Scan(dest...)
+}
+
+// Failure codes stored on an order when processOrder marks it Failed.
+// Clients should branch on the code; the message is meant for humans.
+const (
+	// The payment gateway reported the payment as Failed
+	FailurePaymentFailed = "PAYMENT_FAILED"
+	// The payment was never completed (still Created at the payment gateway)
+	FailurePaymentPending = "PAYMENT_PENDING"
+	// The payment gateway could not be reached or returned an unreadable response
+	FailurePaymentGatewayUnreachable = "PAYMENT_GATEWAY_UNREACHABLE"
+	// The payment has already been used by another succeeded order
+	FailureDuplicatePayment = "DUPLICATE_PAYMENT"
+	// The fund of the order is not known to the RTA
+	FailureFundNotFound = "FUND_NOT_FOUND"
+	// The order amount buys less than one unit at the current market value
+	FailureUnitsBelowMinimum = "UNITS_BELOW_MINIMUM"
+	// A redemption asks for more units than the user holds in the fund
+	FailureInsufficientUnits = "INSUFFICIENT_UNITS"
+	// The payment was made from a bank account that is not a verified account of the user
+	FailureBankAccountNotVerified = "BANK_ACCOUNT_NOT_VERIFIED"
+	// The orders made with the payment add up to more than the amount paid
+	FailurePaymentAmountExceeded = "PAYMENT_AMOUNT_EXCEEDED"
+)
+
+// orderFailure describes why an order could not be allotted.
+type orderFailure struct {
+	Code    string
+	Message string
+}
+
+// paid reports whether the order failed after its payment went through, so its amount is due
+// back to the investor. Failed payments and payments used by another order have nothing to refund.
+func (f *orderFailure) paid() bool {
+	switch f.Code {
+	case FailureFundNotFound, FailureUnitsBelowMinimum, FailureBankAccountNotVerified:
+		return true
+	}
+	return false
+}
+
+func (a *App) createOrderHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body into a PaymentRequest struct
+	var req OrderRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// Orders are placed for the logged in user
+	phoneNumber, ok := callerPhoneNumber(w, r, req.PhoneNumber)
+	if !ok {
+		return
+	}
+	req.PhoneNumber = phoneNumber
+
+	// Generate the payment link using the bank account number and IFSC code
+	order, err := a.createOrder(req)
+	if errors.Is(err, errKYCNotVerified) {
+		writeErrorCode(w, http.StatusForbidden, ErrorCodeKYCNotVerified, err.Error())
+		return
+	}
+	if errors.Is(err, errNominationRequired) {
+		writeErrorCode(w, http.StatusForbidden, ErrorCodeNominationRequired, err.Error())
+		return
+	}
+	if errors.Is(err, errNFONotOpen) {
+		writeErrorCode(w, http.StatusUnprocessableEntity, ErrorCodeNFONotOpen, err.Error())
+		return
+	}
+	var limitErr *purchaseLimitError
+	if errors.As(err, &limitErr) {
+		writeErrorCode(w, http.StatusUnprocessableEntity, ErrorCodeInvalidPurchaseAmount, limitErr.Error())
+		return
+	}
+	if errors.Is(err, errFolioNotFound) {
+		http.Error(w, "Folio not found", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error gcreating order", http.StatusInternalServerError)
+		return
+	}
+
+	// Return the payment link in json response
+	resp := map[string]interface{}{
+		"data":    order,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (a *App) executeStrategyOrdersHandler(w http.ResponseWriter, r *http.Request) {
+    // Parse the request body into a struct containing the necessary data
+    var requestData struct {
+        StrategyName string  `json:"strategyName"`
+        Amount       Money   `json:"amount"`
+        PaymentID    string  `json:"paymentID"`
+        PhoneNumber  string  `json:"phoneNumber"`
+    }
+
+    if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+        http.Error(w, "Failed to decode request body", http.StatusBadRequest)
+        return
+    }
+    // Orders are placed for the logged in user
+    phoneNumber, ok := callerPhoneNumber(w, r, requestData.PhoneNumber)
+    if !ok {
+        return
+    }
+    requestData.PhoneNumber = phoneNumber
+
+    // Create a channel to signal completion
+    done := make(chan struct{})
+
+    // Execute the strategy orders using the provided data in a goroutine
+    var err error
+    go func() {
+        if err = a.executeStrategyOrders(requestData.StrategyName, requestData.Amount, requestData.PaymentID, requestData.PhoneNumber); err != nil {
+            // Handle any errors if needed
+            fmt.Printf("Failed to execute strategy orders: %v\n", err)
+        }
+        // Signal completion
+        done <- struct{}{}
+    }()
+
+    // Wait for the function to finish
+    <-done
+
+    if errors.Is(err, errKYCNotVerified) {
+        writeErrorCode(w, http.StatusForbidden, ErrorCodeKYCNotVerified, err.Error())
+        return
+    }
+    if errors.Is(err, errNominationRequired) {
+        writeErrorCode(w, http.StatusForbidden, ErrorCodeNominationRequired, err.Error())
+        return
+    }
+    var limitErr *purchaseLimitError
+    if errors.As(err, &limitErr) {
+        writeErrorCode(w, http.StatusUnprocessableEntity, ErrorCodeInvalidPurchaseAmount, limitErr.Error())
+        return
+    }
+    if errors.Is(err, errStrategyNotFound) {
+        http.Error(w, "Strategy not found", http.StatusNotFound)
+        return
+    }
+    if errors.Is(err, errFundNotFound) {
+        http.Error(w, "Fund not found", http.StatusBadRequest)
+        return
+    }
+    if errors.Is(err, errFolioNotFound) {
+        http.Error(w, "Folio not found", http.StatusNotFound)
+        return
+    }
+    if errors.Is(err, errNFONotOpen) {
+        writeErrorCode(w, http.StatusUnprocessableEntity, ErrorCodeNFONotOpen, err.Error())
+        return
+    }
+    if err != nil {
+        http.Error(w, "Error executing strategy orders", http.StatusInternalServerError)
+        return
+    }
+
+    // Respond with a success message
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("Strategy orders executed successfully"))
+}
+
+var errStrategyNotFound = errors.New("strategy not found")
+
+func (a *App) executeStrategyOrders(strategyName string, amount Money, paymentID, phoneNumber string) error {
+	// Retrieve strategy details based on the strategy name
+	strategyFundsMap := convertStrategyJsonIntoMap()
+	strategy, ok := strategyFundsMap[strategyName]
+	if !ok {
+		return fmt.Errorf("%w: %s", errStrategyNotFound, strategyName)
+	}
+
+	// None of the legs can be bought until the investor's KYC is verified and they have nominated
+	if err := a.checkKYC(phoneNumber); err != nil {
+		return err
+	}
+	if err := a.checkNomination(phoneNumber); err != nil {
+		return err
+	}
+
+	// Split the amount over the funds up front, so no order is placed unless every fund accepts its share
+	legs, err := a.splitStrategy(phoneNumber, strategy, amount)
+	if err != nil {
+		return err
+	}
+
+	// Check every leg before placing any, then place them together so the basket is placed whole or not at all
+	orders := make([]*OrderRequest, 0, len(legs))
+	for _, leg := range legs {
+		order, err := a.preparePurchase(OrderRequest{
+			Fund:         leg.fund.Name,
+			Amount:       leg.amount,
+			PaymentID:    paymentID,
+			PhoneNumber:  phoneNumber,
+			StrategyName: &strategyName,
+		})
+		if err != nil {
+			return fmt.Errorf("order for fund %s: %w", leg.fund.Name, err)
+		}
+		orders = append(orders, order)
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, order := range orders {
+		if err := insertPurchase(tx, order); err != nil {
+			return fmt.Errorf("order for fund %s: %w", order.Fund, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, order := range orders {
+		a.startProcessing(order.ID)
+	}
+	return nil
+}
+
+func (a *App) createOrder(req OrderRequest) (*OrderRequest, error) {
+	order, err := a.preparePurchase(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := insertPurchase(a.db, order); err != nil {
+		return nil, err
+	}
+	a.startProcessing(order.ID)
+	return order, nil
+}
+
+// preparePurchase checks the purchase can be placed and returns the order to insert, with its id
+// and the folio the units are bought into
+func (a *App) preparePurchase(req OrderRequest) (*OrderRequest, error) {
+	// Generate a UUID for the transaction
+	uuid, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only investors with verified KYC can buy units
+	if err := a.checkKYC(req.PhoneNumber); err != nil {
+		return nil, err
+	}
+	// and only once they have nominees or opted out of nomination
+	if err := a.checkNomination(req.PhoneNumber); err != nil {
+		return nil, err
+	}
+	// Funds launched with an NFO take purchases only while it is open, and after allotment
+	if err := checkNFO(req.Fund, time.Now()); err != nil {
+		return nil, err
+	}
+	// The amount is checked against the fund's minimums before the payment is used
+	if err := a.checkPurchaseLimits(req.PhoneNumber, req.Fund, req.FolioNumber, req.Amount); err != nil {
+		return nil, err
+	}
+
+	// The units are bought into a folio of the user with the fund's AMC
+	req.FolioNumber, err = a.purchaseFolio(req.PhoneNumber, req.Fund, req.FolioNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ID = uuid.String()
+	req.Status = "Submitted"
+	req.OrderType = OrderTypePurchase
+	return &req, nil
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// insertPurchase stores a purchase order prepared by preparePurchase
+func insertPurchase(e execer, order *OrderRequest) error {
+	_, err := e.Exec("INSERT INTO orders (uuid, fund, amount, units, price_per_unit, status, payment_id, phone_number, strategy_name, order_type, folio_number) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", order.ID, order.Fund, order.Amount, 0, 0, order.Status, order.PaymentID, order.PhoneNumber, order.StrategyName, order.OrderType, order.FolioNumber)
+	return err
+}
+
+// startProcessing processes a newly submitted order in the background,
+// pushing its state to the user's streams before and after
+func (a *App) startProcessing(orderID string) {
+	a.publishOrderUpdate(orderID)
+	go func() {
+		a.processOrder(orderID)
+		a.publishOrderUpdate(orderID)
+	}()
+}
+
+// Longest a client can wait on GET /order/{id} for the order to change
+const maxOrderWait = 60 * time.Second
+
+// handler function to get the order details as json.
+// With ?wait=30s the request blocks until the order reaches a terminal status or the wait ends.
+func (a *App) getOrder(w http.ResponseWriter, r *http.Request) {
+	// Get the transaction ID from the URL path
+	transactionID := r.PathValue("id")
+	// Only the user who placed the order can see it
+	phoneNumber, ok := callerPhoneNumber(w, r, "")
+	if !ok {
+		return
+	}
+
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxOrderWait {
+			http.Error(w, fmt.Sprintf("Invalid wait, must be a duration up to %s", maxOrderWait), http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+	if until := r.URL.Query().Get("until"); until != "" && until != "terminal" {
+		http.Error(w, "Invalid until, only terminal is supported", http.StatusBadRequest)
+		return
+	}
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		// Start waiting before reading the order so a change in between is not missed
+		changed, stopWaiting := orderChanges.wait(transactionID)
+
+		// Query the database to get the payment status
+		var order OrderRequest
+		err := scanOrder(a.db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE uuid = ? AND phone_number = ?", transactionID, phoneNumber), &order)
+		if err != nil {
+			stopWaiting()
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+
+		if wait == 0 || isTerminalOrderStatus(order.Status) {
+			stopWaiting()
+			// Return the payment details in json response
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(order)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			// return the order as it is now
+			wait = 0
+		case <-r.Context().Done():
+			stopWaiting()
+			return
+		}
+		stopWaiting()
+	}
+}
+
+// isTerminalOrderStatus reports whether the order will not change status anymore
+func isTerminalOrderStatus(status string) bool {
+	return status == "Succeeded" || status == "Failed" || status == "Cancelled"
+}
+
+const (
+	defaultOrdersPageSize = 20
+	maxOrdersPageSize     = 100
+)
 
-	// Add this handler to your router or mux
-	mux.HandleFunc("POST /execute-strategy-orders", randomFailureMiddleware(a.executeStrategyOrdersHandler))
-	// Route for user login
-	mux.HandleFunc("POST /login", randomFailureMiddleware(a.loginHandler))
+// handler function to list orders matching the query filters.
+// Orders are returned newest first and paginated with an opaque cursor over the order id,
+// so pages stay stable while new orders are being created.
+func (a *App) listOrders(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	// Users only see their own orders
+	phoneNumber, ok := callerPhoneNumber(w, r, q.Get("phoneNumber"))
+	if !ok {
+		return
+	}
 
-	// Route for user signup
-	mux.HandleFunc("POST /signup", randomFailureMiddleware(a.signupHandler))
-	mux.HandleFunc("/aggregated-orders-by-phone", randomFailureMiddleware(a.getAggregatedOrdersByPhoneNumber))
+	where := []string{"phone_number = ?"}
+	args := []any{phoneNumber}
+	for param, column := range map[string]string{
+		"fund":        "fund",
+		"status":      "status",
+		"paymentID":   "payment_id",
+	} {
+		if v := q.Get(param); v != "" {
+			where = append(where, column+" = ?")
+			args = append(args, v)
+		}
+	}
 
-	handler := allowCORS(mux)
+	if v := q.Get("from"); v != "" {
+		from, _, err := parseTimeParam(v)
+		if err != nil {
+			http.Error(w, "Invalid from, expected RFC3339 time or YYYY-MM-DD date", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "submitted_at >= ?")
+		args = append(args, from.UTC().Format(time.DateTime))
+	}
+	if v := q.Get("to"); v != "" {
+		to, dateOnly, err := parseTimeParam(v)
+		if err != nil {
+			http.Error(w, "Invalid to, expected RFC3339 time or YYYY-MM-DD date", http.StatusBadRequest)
+			return
+		}
+		// a bare date includes the whole day
+		if dateOnly {
+			where = append(where, "submitted_at < ?")
+			args = append(args, to.AddDate(0, 0, 1).Format(time.DateTime))
+		} else {
+			where = append(where, "submitted_at <= ?")
+			args = append(args, to.UTC().Format(time.DateTime))
+		}
+	}
 
-	// Route for fetching user portfolio
-	// mux.HandleFunc("/portfolio", randomFailureMiddleware(a.getPortfolioHandler))
-	log.Default().Println("Server started at :8081")
-	err := http.ListenAndServe(":8081", handler)
-	if err != nil {
-		log.Fatal(err)
+	if v := q.Get("cursor"); v != "" {
+		afterID, err := decodeOrderCursor(v)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "id < ?")
+		args = append(args, afterID)
 	}
-}
 
-// CORS middleware // Add this handler to your router or mux
-func allowCORS(h http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
+	limit := defaultOrdersPageSize
+	if v := q.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > maxOrdersPageSize {
+			http.Error(w, fmt.Sprintf("Invalid limit, must be between 1 and %d", maxOrdersPageSize), http.StatusBadRequest)
 			return
 		}
-		h.ServeHTTP(w, r)
+		limit = l
 	}
-}
 
-type OrderRequest struct {
-	ID           string  `json:"id"`
-	Fund         string  `json:"fund"`
-	Amount       float64 `json:"amount"`
-	Units        float64 `json:"units"`
-	PricePerUnit float64 `json:"pricePerUnit"`
-	Status       string  `json:"status"`
-	PaymentID    string  `json:"paymentID"`
-	PhoneNumber  string  `json:"phoneNumber"`
-	SubmittedAt  *string `json:"submittedAt"`
-	SucceededAt  *string `json:"succeededAt"`
-	FailedAt     *string `json:"failedAt"`
-}
+	query := "SELECT id, " + orderColumns + " FROM orders WHERE " + strings.Join(where, " AND ")
+	// fetch one extra row to know whether there is a next page
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit+1)
 
-func (a *App) createOrderHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse the request body into a PaymentRequest struct
-	var req OrderRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	rows, err := a.db.Query(query, args...)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		log.Default().Println("Error listing orders:", err)
+		http.Error(w, "Error retrieving orders", http.StatusInternalServerError)
 		return
 	}
-
-	// Generate the payment link using the bank account number and IFSC code
-	order, err := a.createOrder(req)
-	if err != nil {
-		http.Error(w, "Error gcreating order", http.StatusInternalServerError)
+	defer rows.Close()
+
+	orders := []OrderRequest{}
+	var lastID int64
+	hasMore := false
+	for rows.Next() {
+		if len(orders) == limit {
+			hasMore = true
+			break
+		}
+		var order OrderRequest
+		if err := scanOrder(rows, &order, &lastID); err != nil {
+			log.Default().Println("Error reading order:", err)
+			http.Error(w, "Error retrieving orders", http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		log.Default().Println("Error listing orders:", err)
+		http.Error(w, "Error retrieving orders", http.StatusInternalServerError)
 		return
 	}
 
-	// Return the payment link in json response
+	var nextCursor *string
+	if hasMore {
+		c := encodeOrderCursor(lastID)
+		nextCursor = &c
+	}
+
 	resp := map[string]interface{}{
-		"data":    order,
-		"success": true,
+		"data":       orders,
+		"nextCursor": nextCursor,
+		"success":    true,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (a *App) executeStrategyOrdersHandler(w http.ResponseWriter, r *http.Request) {
-    // Parse the request body into a struct containing the necessary data
-    var requestData struct {
-        StrategyName string  `json:"strategyName"`
-        Amount       float64 `json:"amount"`
-        PaymentID    string  `json:"paymentID"`
-        PhoneNumber  string  `json:"phoneNumber"`
-    }
-
-    if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-        http.Error(w, "Failed to decode request body", http.StatusBadRequest)
-        return
-    }
-
-    // Create a channel to signal completion
-    done := make(chan struct{})
-
-    // Execute the strategy orders using the provided data in a goroutine
-    go func() {
-        if err := a.executeStrategyOrders(requestData.StrategyName, requestData.Amount, requestData.PaymentID, requestData.PhoneNumber); err != nil {
-            // Handle any errors if needed
-            fmt.Printf("Failed to execute strategy orders: %v\n", err)
-        }
-        // Signal completion
-        done <- struct{}{}
-    }()
+// parseTimeParam parses a query parameter given either as an RFC3339 time or a YYYY-MM-DD date.
+// The returned flag reports whether only a date was given.
+func parseTimeParam(v string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, false, err
+}
 
-    // Wait for the function to finish
-    <-done
+// encodeOrderCursor builds the opaque cursor pointing after the order with the given id
+func encodeOrderCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
 
-    // Respond with a success message
-    w.WriteHeader(http.StatusOK)
-    w.Write([]byte("Strategy orders executed successfully"))
+func decodeOrderCursor(cursor string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(b), 10, 64)
 }
 
-func (a *App) executeStrategyOrders(strategyName string, amount float64, paymentID, phoneNumber string) error {
-	// Retrieve strategy details based on the strategy name
-	strategyFundsMap := convertStrategyJsonIntoMap()
-	strategy, ok := strategyFundsMap[strategyName]
+// handler function to cancel an order that has not been allotted yet.
+// All the pending orders paid with the same payment, i.e. every leg of a strategy basket,
+// are cancelled together and their amount becomes due for a refund.
+func (a *App) cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	orderID := r.PathValue("id")
+	phoneNumber, ok := callerPhoneNumber(w, r, "")
 	if !ok {
-		return fmt.Errorf("strategy '%s' not found", strategyName)
+		return
 	}
 
-	// Create a wait group to wait for all goroutines to finish
-	var wg sync.WaitGroup
-
-	// Iterate over each fund in the strategy and create an order for it
-	for _, fund := range strategy {
-		// Increment the wait group counter
-		wg.Add(1)
-
-		// Goroutine to create order for the current fund
-		go func(fund Funds) {
-			defer wg.Done()
-
-			// Calculate the amount for the current fund based on its percentage in the strategy
-			fundAmount := (amount * float64(fund.Percentage)) / 100
-
-			// Create an order request for the current fund
-			orderReq := OrderRequest{
-				Fund:        fund.Name,
-				Amount:      fundAmount,
-				PaymentID:   paymentID,
-				PhoneNumber: phoneNumber,
-				// You may need to provide other required fields like PhoneNumber, etc.
-			}
-
-			// Create the order for the current fund
-			_, err := a.createOrder(orderReq)
-			if err != nil {
-				// Handle error if order creation fails
-				log.Printf("Error creating order for fund %s: %v\n", fund.Name, err)
-				return
-			}
-		}(fund)
+	cancelled, err := a.cancelOrder(orderID, phoneNumber)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errOrderNotCancellable) {
+		http.Error(w, "Order can no longer be cancelled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Default().Println("Error cancelling order:", err)
+		http.Error(w, "Error cancelling order", http.StatusInternalServerError)
+		return
 	}
 
-	// Wait for all goroutines to finish
-	wg.Wait()
+	refundAmount := Money(0)
+	for _, order := range cancelled {
+		refundAmount += order.Amount
+	}
 
-	return nil
+	resp := map[string]interface{}{
+		"data": map[string]interface{}{
+			"cancelledOrders": cancelled,
+			"refundAmount":    refundAmount,
+		},
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
-func (a *App) createOrder(req OrderRequest) (*OrderRequest, error) {
-	// Generate a UUID for the transaction
-	uuid, err := uuid.NewRandom()
+var errOrderNotCancellable = errors.New("order is no longer Submitted")
+
+// cancelOrder cancels the order and the other Submitted orders sharing its payment.
+// Orders are only cancelled while they are still Submitted, processOrder only allots
+// orders that are still Submitted, so whichever of the two writes first wins.
+// Only orders of the user are cancelled, sql.ErrNoRows is returned if the order isn't theirs.
+func (a *App) cancelOrder(orderID, phoneNumber string) ([]OrderRequest, error) {
+	tx, err := a.db.Begin()
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	// Insert the payment details into the database
-	_, err = a.db.Exec("INSERT INTO orders (uuid, fund, amount, units, price_per_unit, status, payment_id, phone_number) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", uuid.String(), req.Fund, req.Amount, 0, 0, "Submitted", req.PaymentID, req.PhoneNumber)
+	var paymentID sql.NullString
+	err = tx.QueryRow("SELECT payment_id FROM orders WHERE uuid = ? AND phone_number = ?", orderID, phoneNumber).Scan(&paymentID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Return the generated UUID
-	req.ID = uuid.String()
-	req.Status = "Submitted"
-	go a.processOrder(uuid.String())
-	return &req, nil
-}
+	// only purchases were paid for, cancelled redemptions have nothing to refund
+	const cancel = "UPDATE orders SET status = 'Cancelled', cancelled_at = CURRENT_TIMESTAMP, refund_status = CASE WHEN order_type = 'Purchase' THEN 'Pending' END"
+	res, err := tx.Exec(cancel+" WHERE uuid = ? AND status = 'Submitted'", orderID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, errOrderNotCancellable
+	}
 
-// handler function to get the order details as json
-func (a *App) getOrder(w http.ResponseWriter, r *http.Request) {
-	// Get the transaction ID from the URL path
-	transactionID := r.PathValue("id")
+	query, args := "SELECT "+orderColumns+" FROM orders WHERE uuid = ?", []any{orderID}
+	if paymentID.String != "" {
+		// cancel the remaining legs of the basket
+		_, err = tx.Exec(cancel+" WHERE payment_id = ? AND phone_number = ? AND status = 'Submitted'", paymentID.String, phoneNumber)
+		if err != nil {
+			return nil, err
+		}
+		query, args = "SELECT "+orderColumns+" FROM orders WHERE payment_id = ? AND phone_number = ? AND status = 'Cancelled' ORDER BY id", []any{paymentID.String, phoneNumber}
+	}
 
-	// Query the database to get the payment status
-	var order OrderRequest
-	err := a.db.QueryRow("SELECT uuid, fund, amount, units, price_per_unit, status, payment_id, phone_number, submitted_at, succeeded_at, failed_at FROM orders WHERE uuid = ?", transactionID).Scan(&order.ID, &order.Fund, &order.Amount, &order.Units, &order.PricePerUnit, &order.Status, &order.PaymentID, &order.PhoneNumber, &order.SubmittedAt, &order.SucceededAt, &order.FailedAt)
+	rows, err := tx.Query(query, args...)
 	if err != nil {
-		http.Error(w, "Order not found", http.StatusNotFound)
-		return
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Return the payment details in json response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(order)
+	var cancelled []OrderRequest
+	for rows.Next() {
+		var order OrderRequest
+		if err := scanOrder(rows, &order); err != nil {
+			return nil, err
+		}
+		cancelled = append(cancelled, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	log.Default().Println("Cancelled", len(cancelled), "orders with order", orderID)
+	for _, order := range cancelled {
+		orderChanges.notify(order.ID)
+		events.publish(order.PhoneNumber, "order", order)
+		if order.RefundStatus != nil && *order.RefundStatus == RefundStatusPending {
+			go a.refundOrder(order.ID)
+		}
+	}
+	return cancelled, nil
 }
 
 // handler function to get fund nav details
@@ -367,7 +1487,7 @@ type PaymentRequest struct {
 	ID            string  `json:"id"`
 	AccountNumber string  `json:"accountNumber"`
 	IfscCode      string  `json:"ifscCode"`
-	Amount        int64   `json:"amount"`
+	Amount        Money   `json:"amount"`
 	RedirectUrl   string  `json:"redirectUrl"`
 	Status        string  `json:"status"`
 	CreatedAt     string  `json:"createdAt"`
@@ -378,42 +1498,28 @@ func (a *App) processOrder(orderID string) error {
 	log.Default().Println("Processing order:", orderID)
 	// Query the database to get the order details
 	var order OrderRequest
-	err := a.db.QueryRow("SELECT uuid, fund, amount, units, price_per_unit, status, payment_id, submitted_at, succeeded_at, failed_at FROM orders WHERE uuid = ?", orderID).Scan(&order.ID, &order.Fund, &order.Amount, &order.Units, &order.PricePerUnit, &order.Status, &order.PaymentID, &order.SubmittedAt, &order.SucceededAt, &order.FailedAt)
+	err := scanOrder(a.db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE uuid = ?", orderID), &order)
 	if err != nil {
 		log.Default().Println("Error getting order details:", err)
 		return err
 	}
+	if order.Status != "Submitted" {
+		log.Default().Println("Order", orderID, "is", order.Status, "and will not be processed")
+		return nil
+	}
+	if order.OrderType == OrderTypeRedemption {
+		return a.processRedemption(order)
+	}
 
 	// checking if the payment is already processed for agiven payment id with successful orders in db
 	var st string
-	orderAlreadyProcessed := false
+	var failure *orderFailure
 	err = a.db.QueryRow("SELECT status FROM orders WHERE payment_id = ? AND status = 'Succeeded'", order.PaymentID).Scan(&st)
 	if err == nil {
 		log.Default().Println("Payment already processed for order:", orderID)
-		orderAlreadyProcessed = true
-		order.Status = "Failed"
-	}
-
-	if !orderAlreadyProcessed {
-		// Check with the payment gateway if the payment is successful
-		log.Default().Println("Checking payment status for order:", orderID)
-		paymentStatus, err := a.retryCheckPaymentStatus(order.PaymentID, 2) // Retry 2 times
-		if err != nil {
-			log.Default().Println("Error checking payment status:", err)
-			paymentStatus = "Couldn't fetch payment status"
-		}
-		log.Default().Println("Payment status for order:", orderID, "is", paymentStatus)
-
-		// Update the order status based on the payment status
-		log.Default().Println("Updating order status for order:", orderID)
-		switch paymentStatus {
-		case "Success":
-			order.Status = "Succeeded"
-		case "Failed":
-			order.Status = "Failed"
-		default:
-			order.Status = "Failed"
-		}
+		failure = &orderFailure{FailureDuplicatePayment, fmt.Sprintf("payment %s has already been used by another order", order.PaymentID)}
+	} else {
+		failure = a.verifyPayment(orderID, order.PaymentID, order.PhoneNumber)
 	}
 
 	// Simulate processing the order
@@ -423,12 +1529,48 @@ func (a *App) processOrder(orderID string) error {
 	fundC.Lock()
 	defer fundC.Unlock()
 	fund, ok := fundC.Funds[order.Fund]
-	units := order.Amount / fund.MarketValue
-	if order.Status == "Succeeded" && ok && units >= 1 {
-		ppu := fund.MarketValue
-		a.db.Exec("UPDATE orders SET units = ?, price_per_unit = ?,  status = ?, succeeded_at = CURRENT_TIMESTAMP WHERE uuid = ?", units, ppu, "Succeeded", orderID)
+	if failure == nil && !ok {
+		failure = &orderFailure{FailureFundNotFound, fmt.Sprintf("fund '%s' not found", order.Fund)}
+	}
+	// purchases of a fund in its NFO stay Submitted until they are allotted together, see allotNFO.
+	// The verified payment is recorded so the allotment knows the amount was collected.
+	if failure == nil && fund.inNFO() {
+		_, err = a.db.Exec("UPDATE orders SET payment_verified_at = CURRENT_TIMESTAMP WHERE uuid = ? AND status = 'Submitted'", orderID)
+		if err != nil {
+			log.Default().Println("Error recording verified payment:", err)
+			return err
+		}
+		log.Default().Println("Order", orderID, "is collected for the NFO of", order.Fund, "allotted on", fund.NFO.AllotmentDate)
+		return nil
+	}
+	// units are allotted for what is left of the amount after the charges
+	charges, netAmount := applyCharges(a.chargeRules, order.Fund, order.Amount)
+	units := unitsFor(netAmount, fund.MarketValue)
+	if failure == nil && units < Unit {
+		failure = &orderFailure{FailureUnitsBelowMinimum, fmt.Sprintf("amount %s buys %s units at market value %.4f after charges of %s, at least 1 unit is required", order.Amount, units, fund.MarketValue, order.Amount-netAmount)}
+	}
+
+	// The updates only apply to orders still Submitted, so an order cancelled while it was
+	// being processed stays cancelled
+	var updated bool
+	if failure == nil {
+		order.Status = "Succeeded"
+		updated, err = a.allotPurchase(orderID, units, fund.MarketValue, netAmount, charges)
 	} else {
-		a.db.Exec("UPDATE orders SET failed_at = CURRENT_TIMESTAMP, status = ? WHERE uuid = ?", "Failed", orderID)
+		order.Status = "Failed"
+		updated, err = a.failOrder(orderID, failure)
+	}
+	if err != nil {
+		log.Default().Println("Error updating order status:", err)
+		return err
+	}
+	if !updated {
+		log.Default().Println("Order", orderID, "was cancelled before allotment")
+		return nil
+	}
+	orderChanges.notify(orderID)
+	if failure != nil {
+		log.Default().Println("Order", orderID, "failed with", failure.Code+":", failure.Message)
 	}
 
 	log.Default().Println("Order status updated for order:", orderID, "to", order.Status)
@@ -436,42 +1578,128 @@ func (a *App) processOrder(orderID string) error {
 	return nil
 }
 
+// allotPurchase marks a Submitted purchase order Succeeded with the units bought at the given
+// price per unit for the net amount, and opens the purchase lot holding them. The charges are
+// part of the cost of the lot. It reports false if the order was no longer Submitted.
+func (a *App) allotPurchase(orderID string, units Units, pricePerUnit float64, netAmount Money, charges OrderCharges) (bool, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE orders SET units = ?, price_per_unit = ?, net_amount = ?, charges = ?,  status = ?, succeeded_at = CURRENT_TIMESTAMP WHERE uuid = ? AND status = 'Submitted'", units, pricePerUnit, netAmount, charges, "Succeeded", orderID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	_, err = tx.Exec(`INSERT INTO purchase_lots (order_uuid, phone_number, fund, purchased_at, units, remaining_units, cost_per_unit, folio_number)
+		SELECT uuid, phone_number, fund, succeeded_at, units, units, amount * ? / units, folio_number FROM orders WHERE uuid = ?`, float64(Unit)/float64(Rupee), orderID)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// failOrder marks a Submitted order Failed. Purchases that failed after they were paid for are
+// refunded like cancelled ones. It reports false if the order was no longer Submitted.
+func (a *App) failOrder(orderID string, failure *orderFailure) (bool, error) {
+	res, err := a.db.Exec("UPDATE orders SET failed_at = CURRENT_TIMESTAMP, status = ?, failure_code = ?, failure_message = ?, refund_status = CASE WHEN order_type = 'Purchase' AND ? THEN 'Pending' END WHERE uuid = ? AND status = 'Submitted'",
+		"Failed", failure.Code, failure.Message, failure.paid(), orderID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if n > 0 && failure.paid() {
+		go a.refundOrder(orderID)
+	}
+	return n > 0, err
+}
+
+// verifyPayment checks with the payment gateway that the payment of an order went through
+// from a verified bank account of the user and covers the orders made with it. It returns nil
+// when the payment is successful, otherwise the reason the order has to fail.
+func (a *App) verifyPayment(orderID, paymentID, phoneNumber string) *orderFailure {
+	log.Default().Println("Checking payment status for order:", orderID)
+	payment, err := a.retryCheckPaymentStatus(paymentID, 2) // Retry 2 times
+	if err != nil {
+		log.Default().Println("Error checking payment status:", err)
+		return &orderFailure{FailurePaymentGatewayUnreachable, fmt.Sprintf("couldn't fetch payment status: %v", err)}
+	}
+	paymentStatus := payment.Status
+	log.Default().Println("Payment status for order:", orderID, "is", paymentStatus)
+
+	switch paymentStatus {
+	case "Success":
+		verified, err := a.isVerifiedBankAccount(phoneNumber, payment.AccountNumber, payment.IfscCode)
+		if err != nil {
+			log.Default().Println("Error checking bank account:", err)
+			return &orderFailure{FailureBankAccountNotVerified, fmt.Sprintf("couldn't check bank account %s: %v", payment.AccountNumber, err)}
+		}
+		if !verified {
+			return &orderFailure{FailureBankAccountNotVerified, fmt.Sprintf("payment %s was made from bank account %s which is not a verified account of %s", paymentID, payment.AccountNumber, phoneNumber)}
+		}
+		// the orders made with the payment, including this one, can't take more than was paid.
+		// Amounts refunded from it are spent too.
+		var ordered Money
+		err = a.db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM orders WHERE payment_id = ? AND order_type = ? AND (status IN ('Submitted', 'Succeeded') OR refund_status IN (?, ?))",
+			paymentID, OrderTypePurchase, RefundStatusPending, RefundStatusRefunded).Scan(&ordered)
+		if err != nil {
+			log.Default().Println("Error checking orders of payment:", err)
+			return &orderFailure{FailurePaymentAmountExceeded, fmt.Sprintf("couldn't check the orders of payment %s: %v", paymentID, err)}
+		}
+		if ordered > payment.Amount {
+			return &orderFailure{FailurePaymentAmountExceeded, fmt.Sprintf("orders of %s were made with payment %s of %s", ordered, paymentID, payment.Amount)}
+		}
+		return nil
+	case "Failed":
+		return &orderFailure{FailurePaymentFailed, fmt.Sprintf("payment %s failed at the payment gateway", paymentID)}
+	case "Created":
+		return &orderFailure{FailurePaymentPending, fmt.Sprintf("payment %s has not been completed", paymentID)}
+	default:
+		return &orderFailure{FailurePaymentFailed, fmt.Sprintf("payment %s has unexpected status '%s'", paymentID, paymentStatus)}
+	}
+}
+
 // RetryCheckPaymentStatus retries checking the payment status for the given payment ID for a specified number of times.
-func (a *App) retryCheckPaymentStatus(paymentID string, retryCount int) (string, error) {
+func (a *App) retryCheckPaymentStatus(paymentID string, retryCount int) (*PaymentRequest, error) {
 	for i := 0; i < retryCount; i++ {
-		paymentStatus, err := a.checkPaymentStatus(paymentID)
+		payment, err := a.checkPaymentStatus(paymentID)
 		if err == nil {
-			return paymentStatus, nil
+			return payment, nil
 		}
 		log.Printf("Error checking payment status (attempt %d/%d): %v", i+1, retryCount, err)
 		time.Sleep(1 * time.Second) // Add a delay between retries
 	}
-	return "", fmt.Errorf("unable to check payment status after %d attempts", retryCount)
+	return nil, fmt.Errorf("unable to check payment status after %d attempts", retryCount)
 }
 
-func (a *App) checkPaymentStatus(paymentID string) (string, error) {
+func (a *App) checkPaymentStatus(paymentID string) (*PaymentRequest, error) {
 	// Call the payment gateway API to get the payment status
 	url := a.paymentGatewayUrl + "/payment/" + paymentID
 	log.Default().Println("Checking payment status at:", url)
 	resp, err := http.Get(url)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("error reading payment response: %w", err)
+		return nil, fmt.Errorf("error reading payment response: %w", err)
 	}
 
 	// Parse the response body into a PaymentRequest struct
 	var paymentReq PaymentRequest
 	err = json.NewDecoder(bytes.NewReader(body)).Decode(&paymentReq)
 	if err != nil {
-		return "", fmt.Errorf("error decoding payment response: %w. response %+v", err, string(body))
+		return nil, fmt.Errorf("error decoding payment response: %w. response %+v", err, string(body))
 	}
 
-	return paymentReq.Status, nil
+	return &paymentReq, nil
 }
 
 func randomFailureMiddleware(f func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
@@ -496,8 +1724,35 @@ type Fund struct {
 	NavMin      float64 `json:"-"`
 	NavMax      float64 `json:"-"`
 	MarketValue float64 `json:"marketValue"`
+	// AssetClass decides how capital gains on the fund are taxed
+	AssetClass string `json:"assetClass"`
+	// AMC is the asset management company running the fund, users hold its funds in folios
+	AMC string `json:"amc"`
+	// MinFirstPurchase is the least amount of the first purchase of the fund in a folio,
+	// MinAdditionalPurchase of the ones after it. Amounts are in multiples of PurchaseMultiple.
+	MinFirstPurchase      Money `json:"minFirstPurchase"`
+	MinAdditionalPurchase Money `json:"minAdditionalPurchase"`
+	PurchaseMultiple      Money `json:"purchaseMultiple"`
+	// ExitLoads is the exit load schedule of the fund sorted by period, see exitloads.go
+	ExitLoads []ExitLoad `json:"exitLoads"`
+	// NFO is the new fund offer of a fund launched through the admin API, nil for the others
+	NFO *NFO `json:"nfo"`
+	// Category and SubCategory are the SEBI scheme categories and Riskometer the risk level of
+	// the fund, see funds.go. ExpenseRatio is the annual expense ratio in percent.
+	Category      string  `json:"category"`
+	SubCategory   string  `json:"subCategory"`
+	Riskometer    string  `json:"riskometer"`
+	ExpenseRatio  float64 `json:"expenseRatio"`
+	AUM           Money   `json:"aum"`
+	InceptionDate string  `json:"inceptionDate"`
+	Benchmark     string  `json:"benchmark"`
 }
 
+const (
+	AssetClassEquity = "Equity"
+	AssetClassDebt   = "Debt"
+)
+
 type fundCache struct {
 	Funds map[string]Fund
 	sync.Mutex
@@ -505,20 +1760,20 @@ type fundCache struct {
 
 var fundC = fundCache{
 	Funds: map[string]Fund{
-		"Arbitrage Fund 1": {Name: "Arbitrage Fund 1", NavMin: 10.0, NavMax: 20.0},
-		"Arbitrage Fund 2": {Name: "Arbitrage Fund 2", NavMin: 10.0, NavMax: 30.0},
-		"Arbitrage Fund 3": {Name: "Arbitrage Fund 3", NavMin: 100.0, NavMax: 200.0},
-		"Arbitrage Fund 4": {Name: "Arbitrage Fund 4", NavMin: 50.0, NavMax: 60.0},
-		"Balanced Fund 1":  {Name: "Balanced Fund 1", NavMin: 20.0, NavMax: 100.0},
-		"Balanced Fund 2":  {Name: "Balanced Fund 2", NavMin: 10.0, NavMax: 200.0},
-		"Balanced Fund 3":  {Name: "Balanced Fund 3", NavMin: 60.0, NavMax: 300.0},
-		"Balanced Fund 4":  {Name: "Balanced Fund 4", NavMin: 100.0, NavMax: 400.0},
-		"Balanced Fund 5":  {Name: "Balanced Fund 5", NavMin: 300.0, NavMax: 200.0},
-		"Growth Fund 1":    {Name: "Growth Fund 1", NavMin: 50.0, NavMax: 100.0},
-		"Growth Fund 2":    {Name: "Growth Fund 2", NavMin: 60.0, NavMax: 150.0},
-		"Growth Fund 3":    {Name: "Growth Fund 3", NavMin: 70.0, NavMax: 200.0},
-		"Growth Fund 4":    {Name: "Growth Fund 4", NavMin: 80.0, NavMax: 250.0},
-		"Growth Fund 5":    {Name: "Growth Fund 5", NavMin: 90.0, NavMax: 300.0},
+		"Arbitrage Fund 1": {Name: "Arbitrage Fund 1", NavMin: 10.0, NavMax: 20.0, AssetClass: AssetClassEquity, AMC: "Sunrise Mutual Fund", MinFirstPurchase: 1000 * Rupee, MinAdditionalPurchase: 500 * Rupee, PurchaseMultiple: 1 * Rupee, ExitLoads: arbitrageExitLoads, Category: CategoryHybrid, SubCategory: "Arbitrage Fund", Riskometer: RiskometerLow, ExpenseRatio: 0.35, AUM: 12450 * Crore, InceptionDate: "2014-06-18", Benchmark: "NIFTY 50 Arbitrage Index"},
+		"Arbitrage Fund 2": {Name: "Arbitrage Fund 2", NavMin: 10.0, NavMax: 30.0, AssetClass: AssetClassEquity, AMC: "Sunrise Mutual Fund", MinFirstPurchase: 1000 * Rupee, MinAdditionalPurchase: 500 * Rupee, PurchaseMultiple: 1 * Rupee, ExitLoads: arbitrageExitLoads, Category: CategoryHybrid, SubCategory: "Arbitrage Fund", Riskometer: RiskometerLow, ExpenseRatio: 0.42, AUM: 3820 * Crore, InceptionDate: "2016-11-02", Benchmark: "NIFTY 50 Arbitrage Index"},
+		"Arbitrage Fund 3": {Name: "Arbitrage Fund 3", NavMin: 100.0, NavMax: 200.0, AssetClass: AssetClassEquity, AMC: "Harbor Mutual Fund", MinFirstPurchase: 1000 * Rupee, MinAdditionalPurchase: 500 * Rupee, PurchaseMultiple: 100 * Rupee, ExitLoads: arbitrageExitLoads, Category: CategoryHybrid, SubCategory: "Arbitrage Fund", Riskometer: RiskometerLow, ExpenseRatio: 0.31, AUM: 8760 * Crore, InceptionDate: "2013-04-25", Benchmark: "NIFTY 50 Arbitrage Index"},
+		"Arbitrage Fund 4": {Name: "Arbitrage Fund 4", NavMin: 50.0, NavMax: 60.0, AssetClass: AssetClassEquity, AMC: "Summit Mutual Fund", MinFirstPurchase: 1000 * Rupee, MinAdditionalPurchase: 500 * Rupee, PurchaseMultiple: 100 * Rupee, ExitLoads: arbitrageExitLoads, Category: CategoryHybrid, SubCategory: "Arbitrage Fund", Riskometer: RiskometerLow, ExpenseRatio: 0.38, AUM: 2150 * Crore, InceptionDate: "2019-08-12", Benchmark: "NIFTY 50 Arbitrage Index"},
+		"Balanced Fund 1":  {Name: "Balanced Fund 1", NavMin: 20.0, NavMax: 100.0, AssetClass: AssetClassDebt, AMC: "Sunrise Mutual Fund", MinFirstPurchase: 500 * Rupee, MinAdditionalPurchase: 100 * Rupee, PurchaseMultiple: 1 * Rupee, ExitLoads: balancedExitLoads, Category: CategoryHybrid, SubCategory: "Conservative Hybrid Fund", Riskometer: RiskometerModeratelyHigh, ExpenseRatio: 0.95, AUM: 1850 * Crore, InceptionDate: "2012-01-10", Benchmark: "CRISIL Hybrid 85+15 - Conservative Index"},
+		"Balanced Fund 2":  {Name: "Balanced Fund 2", NavMin: 10.0, NavMax: 200.0, AssetClass: AssetClassDebt, AMC: "Sunrise Mutual Fund", MinFirstPurchase: 500 * Rupee, MinAdditionalPurchase: 100 * Rupee, PurchaseMultiple: 1 * Rupee, ExitLoads: balancedExitLoads, Category: CategoryHybrid, SubCategory: "Conservative Hybrid Fund", Riskometer: RiskometerModeratelyHigh, ExpenseRatio: 1.10, AUM: 920 * Crore, InceptionDate: "2015-03-23", Benchmark: "CRISIL Hybrid 85+15 - Conservative Index"},
+		"Balanced Fund 3":  {Name: "Balanced Fund 3", NavMin: 60.0, NavMax: 300.0, AssetClass: AssetClassDebt, AMC: "Harbor Mutual Fund", MinFirstPurchase: 500 * Rupee, MinAdditionalPurchase: 100 * Rupee, PurchaseMultiple: 1 * Rupee, ExitLoads: balancedExitLoads, Category: CategoryHybrid, SubCategory: "Conservative Hybrid Fund", Riskometer: RiskometerModerate, ExpenseRatio: 0.78, AUM: 3410 * Crore, InceptionDate: "2011-09-05", Benchmark: "CRISIL Hybrid 85+15 - Conservative Index"},
+		"Balanced Fund 4":  {Name: "Balanced Fund 4", NavMin: 100.0, NavMax: 400.0, AssetClass: AssetClassDebt, AMC: "Summit Mutual Fund", MinFirstPurchase: 500 * Rupee, MinAdditionalPurchase: 100 * Rupee, PurchaseMultiple: 1 * Rupee, ExitLoads: balancedExitLoads, Category: CategoryHybrid, SubCategory: "Conservative Hybrid Fund", Riskometer: RiskometerModeratelyHigh, ExpenseRatio: 1.25, AUM: 640 * Crore, InceptionDate: "2018-07-16", Benchmark: "CRISIL Hybrid 85+15 - Conservative Index"},
+		"Balanced Fund 5":  {Name: "Balanced Fund 5", NavMin: 300.0, NavMax: 200.0, AssetClass: AssetClassDebt, AMC: "Summit Mutual Fund", MinFirstPurchase: 500 * Rupee, MinAdditionalPurchase: 100 * Rupee, PurchaseMultiple: 1 * Rupee, ExitLoads: balancedExitLoads, Category: CategoryHybrid, SubCategory: "Conservative Hybrid Fund", Riskometer: RiskometerHigh, ExpenseRatio: 0.88, AUM: 2275 * Crore, InceptionDate: "2010-12-01", Benchmark: "CRISIL Hybrid 85+15 - Conservative Index"},
+		"Growth Fund 1":    {Name: "Growth Fund 1", NavMin: 50.0, NavMax: 100.0, AssetClass: AssetClassEquity, AMC: "Sunrise Mutual Fund", MinFirstPurchase: 1000 * Rupee, MinAdditionalPurchase: 500 * Rupee, PurchaseMultiple: 1 * Rupee, ExitLoads: growthExitLoads, Category: CategoryEquity, SubCategory: "Large Cap Fund", Riskometer: RiskometerVeryHigh, ExpenseRatio: 0.62, AUM: 24300 * Crore, InceptionDate: "2008-02-14", Benchmark: "NIFTY 100 TRI"},
+		"Growth Fund 2":    {Name: "Growth Fund 2", NavMin: 60.0, NavMax: 150.0, AssetClass: AssetClassEquity, AMC: "Sunrise Mutual Fund", MinFirstPurchase: 1000 * Rupee, MinAdditionalPurchase: 500 * Rupee, PurchaseMultiple: 1 * Rupee, ExitLoads: growthExitLoads, Category: CategoryEquity, SubCategory: "Flexi Cap Fund", Riskometer: RiskometerVeryHigh, ExpenseRatio: 0.71, AUM: 18650 * Crore, InceptionDate: "2013-01-01", Benchmark: "NIFTY 500 TRI"},
+		"Growth Fund 3":    {Name: "Growth Fund 3", NavMin: 70.0, NavMax: 200.0, AssetClass: AssetClassEquity, AMC: "Harbor Mutual Fund", MinFirstPurchase: 1000 * Rupee, MinAdditionalPurchase: 500 * Rupee, PurchaseMultiple: 1 * Rupee, ExitLoads: growthExitLoads, Category: CategoryEquity, SubCategory: "Mid Cap Fund", Riskometer: RiskometerVeryHigh, ExpenseRatio: 0.85, AUM: 9870 * Crore, InceptionDate: "2014-10-27", Benchmark: "NIFTY Midcap 150 TRI"},
+		"Growth Fund 4":    {Name: "Growth Fund 4", NavMin: 80.0, NavMax: 250.0, AssetClass: AssetClassEquity, AMC: "Summit Mutual Fund", MinFirstPurchase: 1000 * Rupee, MinAdditionalPurchase: 500 * Rupee, PurchaseMultiple: 1 * Rupee, ExitLoads: growthExitLoads, Category: CategoryEquity, SubCategory: "Small Cap Fund", Riskometer: RiskometerVeryHigh, ExpenseRatio: 0.79, AUM: 15420 * Crore, InceptionDate: "2016-05-09", Benchmark: "NIFTY Smallcap 250 TRI"},
+		"Growth Fund 5":    {Name: "Growth Fund 5", NavMin: 90.0, NavMax: 300.0, AssetClass: AssetClassEquity, AMC: "Summit Mutual Fund", MinFirstPurchase: 5000 * Rupee, MinAdditionalPurchase: 1000 * Rupee, PurchaseMultiple: 100 * Rupee, ExitLoads: growthExitLoads, Category: CategoryEquity, SubCategory: "Multi Cap Fund", Riskometer: RiskometerVeryHigh, ExpenseRatio: 0.68, AUM: 6130 * Crore, InceptionDate: "2021-12-13", Benchmark: "NIFTY 500 Multicap 50:25:25 TRI"},
 	},
 }
 
@@ -527,6 +1782,10 @@ func updateMarketValue() {
 	fundC.Lock()
 
 	for k, fund := range fundC.Funds {
+		// funds in their NFO stay at the offer nav until their purchases are allotted
+		if fund.inNFO() {
+			continue
+		}
 		fund.MarketValue = fund.NavMin + rand.Float64()*(fund.NavMax-fund.NavMin)
 		fundC.Funds[k] = fund
 	}
@@ -560,111 +1819,102 @@ func (a *App) signupHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "User created successfully")
 }
 
+// loginHandler answers the login without an OTP, which never started a session, with 410 Gone
 func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) {
-	var user struct {
-		PhoneNumber string `json:"phoneNumber"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	http.Error(w, "Login without an OTP is no longer supported, request an OTP with POST /login/otp and verify it with POST /login/verify", http.StatusGone)
+}
+
+// Handler function to get aggregated order data by phone number
+func (a *App) getAggregatedOrdersByPhoneNumber(w http.ResponseWriter, r *http.Request) {
+	// Get the phone number of the logged in user, the query parameter is optional
+	phoneNumber, ok := callerPhoneNumber(w, r, r.URL.Query().Get("phoneNumber"))
+	if !ok {
 		return
 	}
 
-	// Query the database to check if the user exists
-	var count int
-	err := a.db.QueryRow("SELECT COUNT(*) FROM users WHERE phone_number = ?", user.PhoneNumber).Scan(&count)
+	aggregatedOrdersMap, err := a.aggregateOrders(phoneNumber)
+	if errors.Is(err, errFundNotFound) {
+		http.Error(w, "Fund not found", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error checking user", http.StatusInternalServerError)
+		log.Default().Println("Error aggregating orders:", err)
+		http.Error(w, "Error retrieving aggregated order data", http.StatusInternalServerError)
 		return
 	}
 
-	if count == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
+	// Convert aggregated order data map to JSON
+	jsonAggregatedOrders, err := json.Marshal(aggregatedOrdersMap)
+	if err != nil {
+		http.Error(w, "Error encoding aggregated order data", http.StatusInternalServerError)
 		return
 	}
 
-	// Return success message on successful login
-	fmt.Fprintln(w, "User logged in successfully")
+	// Set response headers and write JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonAggregatedOrders)
 }
 
-// Handler function to get aggregated order data by phone number
-func (a *App) getAggregatedOrdersByPhoneNumber(w http.ResponseWriter, r *http.Request) {
-    // Get the phone number from the query parameters
-    phoneNumber := r.URL.Query().Get("phoneNumber")
+var errFundNotFound = errors.New("fund not found")
+
+// aggregateOrders returns the invested amount and current market value of every fund
+// held by the phone number, keyed by fund name
+func (a *App) aggregateOrders(phoneNumber string) (map[string]map[string]float64, error) {
+	// Execute the SQL query to get aggregated order data from the open purchase lots,
+	// so units already redeemed are left out along with their cost
+	rows, err := a.db.Query(`
+		SELECT 
+			fund, 
+			phone_number, 
+			SUM(remaining_units * cost_per_unit) AS total_amount, 
+			SUM(remaining_units) AS total_units
+		FROM 
+			purchase_lots
+		WHERE 
+			phone_number = ? and remaining_units > 0
+		GROUP BY 
+			fund, phone_number;
+	`, phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-    if phoneNumber == "" {
-        http.Error(w, "Phone number parameter is required", http.StatusBadRequest)
-        return
-    }
+	// Create a map to store the aggregated order data in the desired format
+	aggregatedOrdersMap := make(map[string]map[string]float64)
 
-    // Execute the SQL query to get aggregated order data
-    rows, err := a.db.Query(`
-        SELECT 
-            fund, 
-            phone_number, 
-            SUM(amount) AS total_amount, 
-            SUM(units) AS total_units
-        FROM 
-            orders
-        WHERE 
-            phone_number = ? and status = "Succeeded"
-        GROUP BY 
-            fund, phone_number;
-    `, phoneNumber)
-    
-    if err != nil {
-        http.Error(w, "Error retrieving aggregated order data", http.StatusInternalServerError)
-        return
-    }
-    defer rows.Close()
-
-    // Create a map to store the aggregated order data in the desired format
-    aggregatedOrdersMap := make(map[string]map[string]float64)
-
-    // Iterate through the rows and aggregate the data
-    for rows.Next() {
-        var fundName, phoneNumber string
-        var totalAmount, totalUnits float64
-        err := rows.Scan(&fundName, &phoneNumber, &totalAmount, &totalUnits)
-        if err != nil {
-            http.Error(w, "Error parsing aggregated order data", http.StatusInternalServerError)
-            return
-        }
+	// Iterate through the rows and aggregate the data
+	for rows.Next() {
+		var fundName, phoneNumber string
+		var totalAmount float64
+		var totalUnits Units
+		err := rows.Scan(&fundName, &phoneNumber, &totalAmount, &totalUnits)
+		if err != nil {
+			return nil, err
+		}
 
-        // Fetch the fund market value from the cache
-        fundC.Lock()
-        fund, ok := fundC.Funds[fundName]
-        fundC.Unlock()
-        if !ok {
-            http.Error(w, "Fund not found", http.StatusBadRequest)
-            return
-        }
+		// Fetch the fund market value from the cache
+		fundC.Lock()
+		fund, ok := fundC.Funds[fundName]
+		fundC.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errFundNotFound, fundName)
+		}
 
-        
 		// Calculate the market value
-		fundMarketValue := totalUnits * fund.MarketValue
-
+		fundMarketValue := totalUnits.valueAt(fund.MarketValue).Rupees()
 
+		// Create a map for the current fund, the cost is per unit and remaining units are in thousandths
+		fundData := make(map[string]float64)
+		fundData["total_amount"] = rupees(totalAmount / float64(Unit)).Rupees()
+		fundData["market_value"] = fundMarketValue
 
-        // Create a map for the current fund
-        fundData := make(map[string]float64)
-        fundData["total_amount"] = totalAmount
-        fundData["market_value"] = fundMarketValue
-
-        // Store the fund data in the aggregatedOrdersMap
-        aggregatedOrdersMap[fundName] = fundData
-    }
-
-    // Convert aggregated order data map to JSON
-    jsonAggregatedOrders, err := json.Marshal(aggregatedOrdersMap)
-    if err != nil {
-        http.Error(w, "Error encoding aggregated order data", http.StatusInternalServerError)
-        return
-    }
+		// Store the fund data in the aggregatedOrdersMap
+		aggregatedOrdersMap[fundName] = fundData
+	}
 
-    // Set response headers and write JSON response
-    w.Header().Set("Content-Type", "application/json")
-    w.WriteHeader(http.StatusOK)
-    w.Write(jsonAggregatedOrders)
+	return aggregatedOrdersMap, rows.Err()
 }
 
 // Fund represents a fund in an investment strategy.
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Money is an amount in paise. Amounts are kept in whole paise so sums and comparisons are
+// exact, and are encoded in json as rupees with two decimals.
+//
+// Rounding rules
+//   - amounts given in rupees are rounded to the nearest paisa, halves away from zero
+//   - charges, exit loads and the value of units at a nav are rounded the same way
+//   - units bought or redeemed for an amount are rounded down to the thousandth, so no more
+//     units change hands than the amount pays for
+//   - units given as a number are rounded to the nearest thousandth
+type Money int64
+
+// Units are mutual fund units in thousandths, the precision units are allotted in. They are
+// encoded in json with three decimals.
+type Units int64
+
+const (
+	// Rupee is one rupee
+	Rupee Money = 100
+	// Crore is ten million rupees, the unit fund sizes are quoted in
+	Crore = 10000000 * Rupee
+	// Unit is one unit
+	Unit Units = 1000
+)
+
+// rupees converts an amount in rupees to Money
+func rupees(v float64) Money {
+	return Money(math.Round(v * float64(Rupee)))
+}
+
+// Rupees returns the amount in rupees
+func (m Money) Rupees() float64 {
+	return float64(m) / float64(Rupee)
+}
+
+// String formats the amount in rupees with two decimals
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, int64(m/Rupee), int64(m%Rupee))
+}
+
+// percent returns p percent of the amount
+func (m Money) percent(p float64) Money {
+	return Money(math.Round(float64(m) * p / 100))
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts rupees as a number or a string
+func (m *Money) UnmarshalJSON(b []byte) error {
+	v, err := parseJSONNumber(b)
+	if err != nil {
+		return fmt.Errorf("invalid amount %s", b)
+	}
+	if v != nil {
+		*m = rupees(*v)
+	}
+	return nil
+}
+
+// Scan implements sql.Scanner, columns hold paise
+func (m *Money) Scan(src any) error {
+	n, err := scanInt(src)
+	*m = Money(n)
+	return err
+}
+
+// Value implements driver.Valuer
+func (m Money) Value() (driver.Value, error) {
+	return int64(m), nil
+}
+
+// units converts a number of units to Units
+func units(v float64) Units {
+	return Units(math.Round(v * float64(Unit)))
+}
+
+// unitsFor returns the units the amount buys at the nav, rounded down
+func unitsFor(m Money, nav float64) Units {
+	if nav <= 0 {
+		return 0
+	}
+	// the small margin keeps exact results from being rounded down a thousandth by float error
+	return Units(math.Floor(m.Rupees()/nav*float64(Unit) + 1e-6))
+}
+
+// Float returns the number of units
+func (u Units) Float() float64 {
+	return float64(u) / float64(Unit)
+}
+
+// valueAt returns the value of the units at the nav
+func (u Units) valueAt(nav float64) Money {
+	return rupees(u.Float() * nav)
+}
+
+// String formats the units with three decimals
+func (u Units) String() string {
+	sign := ""
+	if u < 0 {
+		sign, u = "-", -u
+	}
+	return fmt.Sprintf("%s%d.%03d", sign, int64(u/Unit), int64(u%Unit))
+}
+
+func (u Units) MarshalJSON() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+// UnmarshalJSON accepts units as a number or a string
+func (u *Units) UnmarshalJSON(b []byte) error {
+	v, err := parseJSONNumber(b)
+	if err != nil {
+		return fmt.Errorf("invalid units %s", b)
+	}
+	if v != nil {
+		*u = units(*v)
+	}
+	return nil
+}
+
+// Scan implements sql.Scanner, columns hold thousandths of units
+func (u *Units) Scan(src any) error {
+	n, err := scanInt(src)
+	*u = Units(n)
+	return err
+}
+
+// Value implements driver.Valuer
+func (u Units) Value() (driver.Value, error) {
+	return int64(u), nil
+}
+
+// parseJSONNumber reads a json number or a string holding one, nil for null
+func parseJSONNumber(b []byte) (*float64, error) {
+	if string(b) == "null" {
+		return nil, nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		s = string(b)
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("invalid number %s", b)
+	}
+	return &v, nil
+}
+
+// scanInt reads an integer column. Columns created before amounts were stored in paise have
+// a REAL type, so whole numbers stored in them come back as floats. NULL reads as 0.
+func scanInt(src any) (int64, error) {
+	switch v := src.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(math.Round(v)), nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("unsupported %T", src)
+}
+
+// migrateToPaise converts the amounts and units stored as floats, in rupees and units, to
+// integer paise and thousandths of units. It runs once, recorded in schema_migrations.
+func migrateToPaise(db *sql.DB) error {
+	const name = "money_in_paise"
+	var applied int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE name = ?", name).Scan(&applied); err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		`UPDATE orders SET amount = CAST(ROUND(amount * 100) AS INTEGER), units = CAST(ROUND(units * 1000) AS INTEGER),
+			gross_amount = CAST(ROUND(gross_amount * 100) AS INTEGER), exit_load = CAST(ROUND(exit_load * 100) AS INTEGER),
+			net_amount = CAST(ROUND(net_amount * 100) AS INTEGER)`,
+		`UPDATE purchase_lots SET units = CAST(ROUND(units * 1000) AS INTEGER), remaining_units = CAST(ROUND(remaining_units * 1000) AS INTEGER)`,
+		`UPDATE lot_redemptions SET units = CAST(ROUND(units * 1000) AS INTEGER), exit_load = CAST(ROUND(exit_load * 100) AS INTEGER)`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO schema_migrations (name, applied_at) VALUES (?, ?)", name, time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
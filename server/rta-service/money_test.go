@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestRupees(t *testing.T) {
+	tests := []struct {
+		rupees float64
+		want   Money
+	}{
+		{1000, 100000},
+		{1000.5, 100050},
+		{0.01, 1},
+		// halves of a paisa are rounded away from zero
+		{0.005, 1},
+		{-0.005, -1},
+		{1000.125, 100013},
+		{0.004, 0},
+	}
+
+	for _, tt := range tests {
+		if got := rupees(tt.rupees); got != tt.want {
+			t.Errorf("rupees(%v) = %d, want %d", tt.rupees, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{123456, "1234.56"},
+		{-50, "-0.50"},
+		{-123456, "-1234.56"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(tt.m), got, tt.want)
+		}
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		json string
+		want Money
+		err  bool
+	}{
+		{json: `1000`, want: 100000},
+		{json: `1000.5`, want: 100050},
+		{json: `"1000.50"`, want: 100050},
+		{json: `0.005`, want: 1},
+		{json: `null`, want: 0},
+		{json: `"ten"`, err: true},
+		{json: `"NaN"`, err: true},
+		{json: `true`, err: true},
+	}
+
+	for _, tt := range tests {
+		var m Money
+		err := m.UnmarshalJSON([]byte(tt.json))
+		if (err != nil) != tt.err {
+			t.Errorf("UnmarshalJSON(%s) error = %v, want error %v", tt.json, err, tt.err)
+			continue
+		}
+		if m != tt.want {
+			t.Errorf("UnmarshalJSON(%s) = %d, want %d", tt.json, m, tt.want)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Money
+		p    float64
+		want Money
+	}{
+		{"whole paise", 100000, 1, 1000},
+		{"exit load", 45000, 1, 450},
+		{"stamp duty", 100000, 0.005, 5},
+		{"stamp duty half a paisa rounded up", 90000, 0.005, 5},
+		{"stamp duty under half a paisa rounded down", 89900, 0.005, 4},
+		{"under half a paisa", 99, 0.5, 0},
+		{"negative half a paisa", -100, 0.5, -1},
+		{"no rate", 100000, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.m.percent(tt.p); got != tt.want {
+				t.Errorf("Money(%d).percent(%v) = %d, want %d", int64(tt.m), tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnitsFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount Money
+		nav    float64
+		want   Units
+	}{
+		{"whole units", 1000 * Rupee, 10, 100 * Unit},
+		{"rounded down", 1000 * Rupee, 3, 333333},
+		{"rounded down not to the nearest", 2000 * Rupee, 3, 666666},
+		{"exact despite float error", rupees(100.10), 10.01, 10 * Unit},
+		{"exact at a fractional nav", rupees(1234.56), 12.3456, 100 * Unit},
+		{"exact at a nav under a rupee", rupees(0.3), 0.1, 3 * Unit},
+		{"just under a whole unit", rupees(999.99), 33.3333, 29999},
+		{"less than a thousandth", 1, 100, 0},
+		{"no nav", 1000 * Rupee, 0, 0},
+		{"negative nav", 1000 * Rupee, -10, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unitsFor(tt.amount, tt.nav); got != tt.want {
+				t.Errorf("unitsFor(%s, %v) = %s, want %s", tt.amount, tt.nav, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValueAt(t *testing.T) {
+	tests := []struct {
+		units Units
+		nav   float64
+		want  Money
+	}{
+		{100 * Unit, 10, 1000 * Rupee},
+		{Unit / 2, 15, rupees(7.5)},
+		{1001, 10.005, rupees(10.02)},
+		// half a paisa is rounded up, less is rounded down
+		{1, 5, 1},
+		{1, 4.99, 0},
+	}
+
+	for _, tt := range tests {
+		if got := tt.units.valueAt(tt.nav); got != tt.want {
+			t.Errorf("Units(%s).valueAt(%v) = %s, want %s", tt.units, tt.nav, got, tt.want)
+		}
+	}
+}
+
+func TestMigrateToPaise(t *testing.T) {
+	inTempDir(t)
+
+	// a database written before amounts were stored in paise, with amounts in rupees and units as floats
+	db, err := sql.Open("sqlite3", "orders.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE orders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			phone_number TEXT,
+			uuid TEXT,
+			fund TEXT,
+			amount FLOAT,
+			units FLOAT,
+			price_per_unit FLOAT,
+			status TEXT DEFAULT 'Submitted',
+			payment_id TEXT,
+			submitted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			succeeded_at TIMESTAMP,
+			order_type TEXT DEFAULT 'Purchase',
+			folio_number TEXT,
+			gross_amount FLOAT,
+			exit_load FLOAT,
+			net_amount FLOAT
+		)`,
+		`CREATE TABLE purchase_lots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_uuid TEXT UNIQUE,
+			phone_number TEXT,
+			fund TEXT,
+			purchased_at TIMESTAMP,
+			units FLOAT,
+			remaining_units FLOAT,
+			cost_per_unit FLOAT,
+			folio_number TEXT
+		)`,
+		`CREATE TABLE lot_redemptions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			redemption_order_uuid TEXT,
+			lot_id INTEGER,
+			phone_number TEXT,
+			fund TEXT,
+			units FLOAT,
+			purchased_at TIMESTAMP,
+			cost_per_unit FLOAT,
+			redeemed_at TIMESTAMP,
+			redemption_price FLOAT,
+			folio_number TEXT,
+			exit_load_rate FLOAT,
+			exit_load FLOAT
+		)`,
+		`INSERT INTO orders (uuid, phone_number, fund, amount, units, price_per_unit, status, order_type, succeeded_at, net_amount)
+			VALUES ('purchase', '9000000002', 'Growth Fund 1', 1000.5, 33.33333, 30, 'Succeeded', 'Purchase', '2024-06-01 10:00:00', 1000.45)`,
+		`INSERT INTO orders (uuid, phone_number, fund, amount, units, price_per_unit, status, order_type, succeeded_at, gross_amount, exit_load)
+			VALUES ('redemption', '9000000002', 'Growth Fund 1', 445.5, 15, 30, 'Succeeded', 'Redemption', '2024-07-01 10:00:00', 450, 4.5)`,
+		`INSERT INTO orders (uuid, phone_number, fund, amount, status, order_type)
+			VALUES ('pending', '9000000002', 'Growth Fund 1', 0.015, 'Submitted', 'Purchase')`,
+		`INSERT INTO lot_redemptions (redemption_order_uuid, lot_id, phone_number, fund, units, purchased_at, cost_per_unit, redeemed_at, redemption_price, exit_load_rate, exit_load)
+			VALUES ('redemption', 1, '9000000002', 'Growth Fund 1', 15, '2024-06-01 10:00:00', 30, '2024-07-01 10:00:00', 30, 1, 4.5)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// starting the service opens the lot of the purchase and converts the amounts
+	db, err = initializeDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	type order struct {
+		amount, grossAmount, exitLoad, netAmount Money
+		units                                    Units
+		nulls                                    int
+	}
+	wantOrders := map[string]order{
+		"purchase":   {amount: 100050, netAmount: 100045, units: 33333, nulls: 2},
+		"redemption": {amount: 44550, grossAmount: 45000, exitLoad: 450, units: 15 * Unit, nulls: 1},
+		// half a paisa is rounded away from zero, NULLs stay NULL
+		"pending": {amount: 2, nulls: 4},
+	}
+	check := func() {
+		t.Helper()
+		for id, want := range wantOrders {
+			var got order
+			err := db.QueryRow(`SELECT amount, gross_amount, exit_load, net_amount, units,
+				(gross_amount IS NULL) + (exit_load IS NULL) + (net_amount IS NULL) + (units IS NULL) FROM orders WHERE uuid = ?`, id).
+				Scan(&got.amount, &got.grossAmount, &got.exitLoad, &got.netAmount, &got.units, &got.nulls)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("order %s = %+v, want %+v", id, got, want)
+			}
+		}
+
+		var units, remaining Units
+		if err := db.QueryRow("SELECT units, remaining_units FROM purchase_lots WHERE order_uuid = 'purchase'").Scan(&units, &remaining); err != nil {
+			t.Fatal(err)
+		}
+		if units != 33333 || remaining != 33333 {
+			t.Errorf("lot has %s units, %s remaining, want 33.333 and 33.333", units, remaining)
+		}
+
+		var exitLoad Money
+		if err := db.QueryRow("SELECT units, exit_load FROM lot_redemptions WHERE redemption_order_uuid = 'redemption'").Scan(&units, &exitLoad); err != nil {
+			t.Fatal(err)
+		}
+		if units != 15*Unit || exitLoad != 450 {
+			t.Errorf("lot redemption has %s units and an exit load of %s, want 15.000 and 4.50", units, exitLoad)
+		}
+	}
+	check()
+
+	// the migration runs only once
+	if err := migrateToPaise(db); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	var applied int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE name = 'money_in_paise'").Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != 1 {
+		t.Errorf("migration recorded %d times, want 1", applied)
+	}
+}
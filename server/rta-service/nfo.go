@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// NFO is the new fund offer of a launched fund. Units are offered at OfferNav from OpenDate to
+// CloseDate, the purchases are collected and allotted together on AllotmentDate, after which the
+// nav of the fund is updated like any other fund's. Dates are in IST.
+type NFO struct {
+	OpenDate      string  `json:"openDate"`
+	CloseDate     string  `json:"closeDate"`
+	AllotmentDate string  `json:"allotmentDate"`
+	OfferNav      float64 `json:"offerNav"`
+	// AllottedAt is set once the purchases are allotted
+	AllottedAt *string `json:"allottedAt"`
+}
+
+// Statuses of an NFO, derived from its dates
+const (
+	NFOStatusUpcoming = "Upcoming"
+	NFOStatusOpen     = "Open"
+	// Closed NFOs take no more purchases and wait for the allotment date
+	NFOStatusClosed   = "Closed"
+	NFOStatusAllotted = "Allotted"
+)
+
+// defaultOfferNav is the nav units of an NFO are offered at unless the launch sets another
+const defaultOfferNav = 10.0
+
+// ErrorCodeNFONotOpen is returned for purchases of a fund whose NFO is not open
+const ErrorCodeNFONotOpen = "NFO_NOT_OPEN"
+
+var errNFONotOpen = errors.New("the NFO of the fund is not open")
+
+// status returns the status of the NFO on the date of the given time
+func (n *NFO) status(now time.Time) string {
+	if n.AllottedAt != nil {
+		return NFOStatusAllotted
+	}
+	today := now.In(ist).Format(time.DateOnly)
+	switch {
+	case today < n.OpenDate:
+		return NFOStatusUpcoming
+	case today <= n.CloseDate:
+		return NFOStatusOpen
+	default:
+		return NFOStatusClosed
+	}
+}
+
+// MarshalJSON adds the current status of the NFO
+func (n NFO) MarshalJSON() ([]byte, error) {
+	type nfo NFO
+	return json.Marshal(struct {
+		nfo
+		Status string `json:"status"`
+	}{nfo(n), n.status(time.Now())})
+}
+
+// inNFO reports whether the fund is launched and its NFO purchases are not allotted yet
+func (f Fund) inNFO() bool {
+	return f.NFO != nil && f.NFO.AllottedAt == nil
+}
+
+// checkNFO returns errNFONotOpen unless purchases of the fund are taken, which they are for
+// funds without an NFO or whose NFO is open or allotted
+func checkNFO(fundName string, now time.Time) error {
+	fundC.Lock()
+	fund, ok := fundC.Funds[fundName]
+	fundC.Unlock()
+	if !ok || !fund.inNFO() {
+		return nil
+	}
+	switch fund.NFO.status(now) {
+	case NFOStatusUpcoming:
+		return fmt.Errorf("%w: it opens on %s", errNFONotOpen, fund.NFO.OpenDate)
+	case NFOStatusClosed:
+		return fmt.Errorf("%w: it closed on %s, units are allotted on %s", errNFONotOpen, fund.NFO.CloseDate, fund.NFO.AllotmentDate)
+	}
+	return nil
+}
+
+// loadLaunchedFunds adds the funds launched through the admin API to the fund cache. Funds in
+// their NFO are valued at the offer nav.
+func loadLaunchedFunds(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name, amc, asset_class, nav_min, nav_max, min_first_purchase, min_additional_purchase, purchase_multiple,
+		open_date, close_date, allotment_date, offer_nav, allotted_at, COALESCE(category, asset_class), COALESCE(sub_category, ''), COALESCE(riskometer, ''),
+		COALESCE(expense_ratio, 0), COALESCE(aum, 0), COALESCE(benchmark, '') FROM launched_funds`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fundC.Lock()
+	defer fundC.Unlock()
+	for rows.Next() {
+		f := Fund{NFO: &NFO{}, ExitLoads: []ExitLoad{}}
+		err := rows.Scan(&f.Name, &f.AMC, &f.AssetClass, &f.NavMin, &f.NavMax, &f.MinFirstPurchase, &f.MinAdditionalPurchase, &f.PurchaseMultiple,
+			&f.NFO.OpenDate, &f.NFO.CloseDate, &f.NFO.AllotmentDate, &f.NFO.OfferNav, &f.NFO.AllottedAt, &f.Category, &f.SubCategory, &f.Riskometer,
+			&f.ExpenseRatio, &f.AUM, &f.Benchmark)
+		if err != nil {
+			return err
+		}
+		f.InceptionDate = f.NFO.AllotmentDate
+		f.MarketValue = f.NFO.OfferNav
+		fundC.Funds[f.Name] = f
+	}
+	return rows.Err()
+}
+
+// launchFundRequest is the payload to launch a fund, the fields are the ones of Fund
+type launchFundRequest struct {
+	Name                  string     `json:"name"`
+	AMC                   string     `json:"amc"`
+	AssetClass            string     `json:"assetClass"`
+	NavMin                float64    `json:"navMin"`
+	NavMax                float64    `json:"navMax"`
+	MinFirstPurchase      Money      `json:"minFirstPurchase"`
+	MinAdditionalPurchase Money      `json:"minAdditionalPurchase"`
+	PurchaseMultiple      Money      `json:"purchaseMultiple"`
+	ExitLoads             []ExitLoad `json:"exitLoads"`
+	NFO                   NFO        `json:"nfo"`
+	Category              string     `json:"category"`
+	SubCategory           string     `json:"subCategory"`
+	Riskometer            string     `json:"riskometer"`
+	ExpenseRatio          float64    `json:"expenseRatio"`
+	AUM                   Money      `json:"aum"`
+	Benchmark             string     `json:"benchmark"`
+}
+
+// validate returns what is wrong with the launch
+func (req *launchFundRequest) validate(now time.Time) string {
+	if req.Name == "" || req.AMC == "" {
+		return "name and amc are required"
+	}
+	if req.AssetClass != AssetClassEquity && req.AssetClass != AssetClassDebt {
+		return "assetClass must be Equity or Debt"
+	}
+	if req.NavMin <= 0 || req.NavMax < req.NavMin {
+		return "navMin must be more than 0 and navMax at least navMin"
+	}
+	if req.MinFirstPurchase <= 0 || req.MinAdditionalPurchase <= 0 || req.PurchaseMultiple <= 0 {
+		return "minFirstPurchase, minAdditionalPurchase and purchaseMultiple must be more than 0"
+	}
+	if !isMultiple(req.MinFirstPurchase, req.PurchaseMultiple) || !isMultiple(req.MinAdditionalPurchase, req.PurchaseMultiple) {
+		return "minFirstPurchase and minAdditionalPurchase must be multiples of purchaseMultiple"
+	}
+	if msg := validateExitLoads(req.ExitLoads); msg != "" {
+		return msg
+	}
+	// the category defaults to the asset class, the categories include both
+	if req.Category == "" {
+		req.Category = req.AssetClass
+	}
+	if !slices.Contains(fundCategories, req.Category) {
+		return "category must be one of " + strings.Join(fundCategories, ", ")
+	}
+	if !slices.Contains(riskometerLevels, req.Riskometer) {
+		return "riskometer must be one of " + strings.Join(riskometerLevels, ", ")
+	}
+	if req.ExpenseRatio < 0 || req.ExpenseRatio > maxExpenseRatio {
+		return fmt.Sprintf("expenseRatio must be between 0 and %.2f", maxExpenseRatio)
+	}
+	if req.AUM < 0 {
+		return "aum must not be negative"
+	}
+
+	for _, d := range []string{req.NFO.OpenDate, req.NFO.CloseDate, req.NFO.AllotmentDate} {
+		if _, err := time.Parse(time.DateOnly, d); err != nil {
+			return "nfo openDate, closeDate and allotmentDate must be YYYY-MM-DD dates"
+		}
+	}
+	if req.NFO.OpenDate < now.In(ist).Format(time.DateOnly) {
+		return "nfo openDate must not be before today"
+	}
+	if req.NFO.CloseDate < req.NFO.OpenDate || req.NFO.AllotmentDate <= req.NFO.CloseDate {
+		return "nfo closeDate must not be before openDate, and allotmentDate must be after closeDate"
+	}
+	if req.NFO.OfferNav == 0 {
+		req.NFO.OfferNav = defaultOfferNav
+	}
+	if req.NFO.OfferNav < 0 {
+		return "nfo offerNav must be more than 0"
+	}
+	return ""
+}
+
+// handler function for operators to launch a fund with a new fund offer
+func (a *App) launchFundHandler(w http.ResponseWriter, r *http.Request) {
+	var req launchFundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ExitLoads == nil {
+		req.ExitLoads = []ExitLoad{}
+	}
+	req.NFO.AllottedAt = nil
+	if msg := req.validate(time.Now()); msg != "" {
+		http.Error(w, "Invalid fund, "+msg, http.StatusBadRequest)
+		return
+	}
+
+	fund := Fund{
+		Name:                  req.Name,
+		NavMin:                req.NavMin,
+		NavMax:                req.NavMax,
+		MarketValue:           req.NFO.OfferNav,
+		AssetClass:            req.AssetClass,
+		AMC:                   req.AMC,
+		MinFirstPurchase:      req.MinFirstPurchase,
+		MinAdditionalPurchase: req.MinAdditionalPurchase,
+		PurchaseMultiple:      req.PurchaseMultiple,
+		ExitLoads:             req.ExitLoads,
+		NFO:                   &req.NFO,
+		Category:              req.Category,
+		SubCategory:           req.SubCategory,
+		Riskometer:            req.Riskometer,
+		ExpenseRatio:          req.ExpenseRatio,
+		AUM:                   req.AUM,
+		// the fund starts on the day its units are allotted
+		InceptionDate: req.NFO.AllotmentDate,
+		Benchmark:     req.Benchmark,
+	}
+	schedule, err := json.Marshal(fund.ExitLoads)
+	if err != nil {
+		log.Default().Println("Error encoding exit loads:", err)
+		http.Error(w, "Error launching fund", http.StatusInternalServerError)
+		return
+	}
+
+	// the fund is added to the cache while it is locked, so two launches of a name can't both pass
+	fundC.Lock()
+	defer fundC.Unlock()
+	if _, ok := fundC.Funds[fund.Name]; ok {
+		http.Error(w, fmt.Sprintf("Fund '%s' already exists", fund.Name), http.StatusConflict)
+		return
+	}
+
+	launchedBy := identity(r).PhoneNumber
+	tx, err := a.db.Begin()
+	if err != nil {
+		log.Default().Println("Error launching fund:", err)
+		http.Error(w, "Error launching fund", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO launched_funds (name, amc, asset_class, nav_min, nav_max, min_first_purchase, min_additional_purchase, purchase_multiple,
+		open_date, close_date, allotment_date, offer_nav, launched_by, launched_at, category, sub_category, riskometer, expense_ratio, aum, benchmark)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)`,
+		fund.Name, fund.AMC, fund.AssetClass, fund.NavMin, fund.NavMax, fund.MinFirstPurchase, fund.MinAdditionalPurchase, fund.PurchaseMultiple,
+		fund.NFO.OpenDate, fund.NFO.CloseDate, fund.NFO.AllotmentDate, fund.NFO.OfferNav, launchedBy,
+		fund.Category, fund.SubCategory, fund.Riskometer, fund.ExpenseRatio, fund.AUM, fund.Benchmark)
+	if err == nil {
+		_, err = tx.Exec("INSERT OR REPLACE INTO fund_exit_loads (fund, schedule, updated_by, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)",
+			fund.Name, string(schedule), launchedBy)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Default().Println("Error launching fund:", err)
+		http.Error(w, "Error launching fund", http.StatusInternalServerError)
+		return
+	}
+	fundC.Funds[fund.Name] = fund
+	log.Default().Println(launchedBy, "launched", fund.Name, "with an NFO from", fund.NFO.OpenDate, "to", fund.NFO.CloseDate, "allotted on", fund.NFO.AllotmentDate)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(fund)
+}
+
+// allotDueNFOs allots the purchases of the funds whose NFO allotment date has come
+func (a *App) allotDueNFOs(now time.Time) {
+	today := now.In(ist).Format(time.DateOnly)
+	var due []Fund
+	fundC.Lock()
+	for _, f := range fundC.Funds {
+		if f.inNFO() && f.NFO.AllotmentDate <= today {
+			due = append(due, f)
+		}
+	}
+	fundC.Unlock()
+
+	for _, f := range due {
+		if err := a.allotNFO(f, now); err != nil {
+			log.Default().Println("Error allotting the NFO of", f.Name+":", err)
+		}
+	}
+}
+
+// allotNFO allots every Submitted purchase of the fund at its offer nav, in the order they were
+// placed, and ends the NFO. Purchases whose payment wasn't verified when they were processed,
+// e.g. because the service restarted, are verified now and fail like they do outside an NFO if
+// it wasn't collected. So does a payment already used by a Succeeded order.
+func (a *App) allotNFO(fund Fund, now time.Time) error {
+	rows, err := a.db.Query("SELECT uuid, amount, payment_id, phone_number, payment_verified_at IS NOT NULL FROM orders WHERE fund = ? AND order_type = ? AND status = 'Submitted' ORDER BY id",
+		fund.Name, OrderTypePurchase)
+	if err != nil {
+		return err
+	}
+	type purchase struct {
+		id, paymentID, phoneNumber string
+		amount                     Money
+		verified                   bool
+	}
+	var purchases []purchase
+	for rows.Next() {
+		var p purchase
+		if err := rows.Scan(&p.id, &p.amount, &p.paymentID, &p.phoneNumber, &p.verified); err != nil {
+			rows.Close()
+			return err
+		}
+		purchases = append(purchases, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	nav := fund.NFO.OfferNav
+	allotted := 0
+	for _, p := range purchases {
+		var failure *orderFailure
+		var used int
+		if err := a.db.QueryRow("SELECT COUNT(*) FROM orders WHERE payment_id = ? AND status = 'Succeeded'", p.paymentID).Scan(&used); err != nil {
+			return err
+		}
+		if used > 0 {
+			failure = &orderFailure{FailureDuplicatePayment, fmt.Sprintf("payment %s has already been used by another order", p.paymentID)}
+		} else if !p.verified {
+			failure = a.verifyPayment(p.id, p.paymentID, p.phoneNumber)
+		}
+		charges, netAmount := applyCharges(a.chargeRules, fund.Name, p.amount)
+		units := unitsFor(netAmount, nav)
+		if failure == nil && units < Unit {
+			failure = &orderFailure{FailureUnitsBelowMinimum, fmt.Sprintf("amount %s buys %s units at offer nav %.4f after charges of %s, at least 1 unit is required", p.amount, units, nav, p.amount-netAmount)}
+		}
+
+		var updated bool
+		if failure == nil {
+			updated, err = a.allotPurchase(p.id, units, nav, netAmount, charges)
+			if updated {
+				allotted++
+			}
+		} else {
+			updated, err = a.failOrder(p.id, failure)
+		}
+		if err != nil {
+			return err
+		}
+		if updated {
+			orderChanges.notify(p.id)
+			a.publishOrderUpdate(p.id)
+		}
+	}
+
+	if _, err := a.db.Exec("UPDATE launched_funds SET allotted_at = ? WHERE name = ?", now.UTC().Format(time.DateTime), fund.Name); err != nil {
+		return err
+	}
+	fundC.Lock()
+	f := fundC.Funds[fund.Name]
+	nfo := *f.NFO
+	allottedAt := now.UTC().Format(time.RFC3339)
+	nfo.AllottedAt = &allottedAt
+	f.NFO = &nfo
+	fundC.Funds[fund.Name] = f
+	fundC.Unlock()
+	log.Default().Println("Allotted", allotted, "of", len(purchases), "NFO purchases of", fund.Name, "at", nav)
+	return nil
+}
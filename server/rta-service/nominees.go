@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrorCodeNominationRequired is returned when a user who has neither nominated anyone nor
+// opted out places a purchase
+const ErrorCodeNominationRequired = "NOMINATION_REQUIRED"
+
+// maxNominees is the most nominees a user can have, their shares add up to 100%
+const maxNominees = 3
+
+// nomineeRelationships are the relationships a nominee or guardian can have
+var nomineeRelationships = []string{"Spouse", "Father", "Mother", "Son", "Daughter", "Brother", "Sister", "Other"}
+
+// Nomination is who receives the units of a user's folios after them, either nominees or
+// an explicit opt-out. It applies to every folio of the user.
+type Nomination struct {
+	PhoneNumber string    `json:"phoneNumber"`
+	OptedOut    bool      `json:"optedOut"`
+	Nominees    []Nominee `json:"nominees"`
+	UpdatedAt   string    `json:"updatedAt"`
+}
+
+// Nominee is a person nominated for a share of the user's units
+type Nominee struct {
+	ID           int64  `json:"id"`
+	Name         string `json:"name"`
+	Relationship string `json:"relationship"`
+	// DateOfBirth is YYYY-MM-DD
+	DateOfBirth     string  `json:"dateOfBirth"`
+	SharePercentage float64 `json:"sharePercentage"`
+	// Guardian is required when the nominee is a minor
+	Guardian *Guardian `json:"guardian"`
+}
+
+// Guardian acts for a minor nominee
+type Guardian struct {
+	Name         string `json:"name"`
+	Relationship string `json:"relationship"`
+}
+
+var (
+	errNominationNotFound = errors.New("nomination not found")
+	errNominationRequired = errors.New("purchases need nominees or an opt-out")
+)
+
+// isMinor reports whether someone born on dob is under 18 at t
+func isMinor(dob, t time.Time) bool {
+	return dob.AddDate(18, 0, 0).After(t)
+}
+
+// nomination returns the nomination of the user, errNominationNotFound if they haven't made one
+func (a *App) nomination(phoneNumber string) (*Nomination, error) {
+	n := Nomination{PhoneNumber: phoneNumber, Nominees: []Nominee{}}
+	err := a.db.QueryRow("SELECT opted_out, updated_at FROM nominations WHERE phone_number = ?", phoneNumber).Scan(&n.OptedOut, &n.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNominationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := a.db.Query(`SELECT id, name, relationship, date_of_birth, share_percentage, guardian_name, guardian_relationship
+		FROM nominees WHERE phone_number = ? ORDER BY id`, phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var nominee Nominee
+		var guardianName, guardianRelationship sql.NullString
+		if err := rows.Scan(&nominee.ID, &nominee.Name, &nominee.Relationship, &nominee.DateOfBirth, &nominee.SharePercentage, &guardianName, &guardianRelationship); err != nil {
+			return nil, err
+		}
+		if guardianName.Valid {
+			nominee.Guardian = &Guardian{Name: guardianName.String, Relationship: guardianRelationship.String}
+		}
+		n.Nominees = append(n.Nominees, nominee)
+	}
+	return &n, rows.Err()
+}
+
+// checkNomination returns errNominationRequired, wrapped with the reason, unless the user
+// has nominees or has opted out
+func (a *App) checkNomination(phoneNumber string) error {
+	_, err := a.nomination(phoneNumber)
+	if errors.Is(err, errNominationNotFound) {
+		return fmt.Errorf("%s has not added nominees or opted out, %w", phoneNumber, errNominationRequired)
+	}
+	return err
+}
+
+// validateNominees checks the nominees of a nomination and returns what is wrong with them
+func validateNominees(nominees []Nominee, now time.Time) string {
+	if len(nominees) == 0 {
+		return "At least one nominee is required, or opt out with optOut"
+	}
+	if len(nominees) > maxNominees {
+		return fmt.Sprintf("At most %d nominees are allowed", maxNominees)
+	}
+
+	total := 0.0
+	for i, n := range nominees {
+		if n.Name == "" {
+			return fmt.Sprintf("Name of nominee %d is required", i+1)
+		}
+		if !slices.Contains(nomineeRelationships, n.Relationship) {
+			return fmt.Sprintf("Relationship of nominee %d must be one of %s", i+1, strings.Join(nomineeRelationships, ", "))
+		}
+		dob, err := time.Parse(time.DateOnly, n.DateOfBirth)
+		if err != nil || !dob.Before(now) {
+			return fmt.Sprintf("Date of birth of nominee %d must be a past date in YYYY-MM-DD format", i+1)
+		}
+		if n.SharePercentage <= 0 {
+			return fmt.Sprintf("Share of nominee %d must be positive", i+1)
+		}
+		total += n.SharePercentage
+
+		if !isMinor(dob, now) {
+			continue
+		}
+		if n.Guardian == nil || n.Guardian.Name == "" {
+			return fmt.Sprintf("Nominee %d is a minor, guardian name is required", i+1)
+		}
+		if !slices.Contains(nomineeRelationships, n.Guardian.Relationship) {
+			return fmt.Sprintf("Relationship of the guardian of nominee %d must be one of %s", i+1, strings.Join(nomineeRelationships, ", "))
+		}
+	}
+	if math.Abs(total-100) > 0.005 {
+		return fmt.Sprintf("Shares of the nominees must add up to 100%%, they add up to %.2f%%", total)
+	}
+	return ""
+}
+
+// handler function to get the nomination of a user
+func (a *App) getNomineesHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := callerPhoneNumber(w, r, r.URL.Query().Get("phoneNumber"))
+	if !ok {
+		return
+	}
+	a.writeNomination(w, phoneNumber)
+}
+
+// handler function to add or update the nominees of a user, or to opt out of nomination.
+// The nominees given replace the ones the user had.
+func (a *App) setNomineesHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PhoneNumber string    `json:"phoneNumber"`
+		OptOut      bool      `json:"optOut"`
+		Nominees    []Nominee `json:"nominees"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	phoneNumber, ok := callerPhoneNumber(w, r, req.PhoneNumber)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	for i := range req.Nominees {
+		n := &req.Nominees[i]
+		n.Name = strings.TrimSpace(n.Name)
+		if n.Guardian != nil {
+			n.Guardian.Name = strings.TrimSpace(n.Guardian.Name)
+		}
+	}
+	if req.OptOut && len(req.Nominees) > 0 {
+		http.Error(w, "Either nominees or optOut is allowed, not both", http.StatusBadRequest)
+		return
+	}
+	if !req.OptOut {
+		if msg := validateNominees(req.Nominees, now); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := a.setNomination(phoneNumber, req.OptOut, req.Nominees, now); err != nil {
+		log.Default().Println("Error saving nominees:", err)
+		http.Error(w, "Error saving nominees", http.StatusInternalServerError)
+		return
+	}
+	if req.OptOut {
+		log.Default().Println(phoneNumber, "opted out of nomination")
+	} else {
+		log.Default().Println(phoneNumber, "nominated", len(req.Nominees), "nominees")
+	}
+
+	a.writeNomination(w, phoneNumber)
+}
+
+// setNomination replaces the nomination of the user
+func (a *App) setNomination(phoneNumber string, optOut bool, nominees []Nominee, now time.Time) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO nominations (phone_number, opted_out, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (phone_number) DO UPDATE SET opted_out = excluded.opted_out, updated_at = excluded.updated_at`,
+		phoneNumber, optOut, now.Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM nominees WHERE phone_number = ?", phoneNumber)
+	if err != nil {
+		return err
+	}
+	for _, n := range nominees {
+		// a guardian is only kept for minors
+		var guardianName, guardianRelationship *string
+		if dob, _ := time.Parse(time.DateOnly, n.DateOfBirth); isMinor(dob, now) {
+			guardianName, guardianRelationship = &n.Guardian.Name, &n.Guardian.Relationship
+		}
+		_, err = tx.Exec(`INSERT INTO nominees (phone_number, name, relationship, date_of_birth, share_percentage, guardian_name, guardian_relationship)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			phoneNumber, n.Name, n.Relationship, n.DateOfBirth, n.SharePercentage, guardianName, guardianRelationship)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// writeNomination responds with the nomination of the user
+func (a *App) writeNomination(w http.ResponseWriter, phoneNumber string) {
+	nomination, err := a.nomination(phoneNumber)
+	if errors.Is(err, errNominationNotFound) {
+		http.Error(w, "Nomination not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Default().Println("Error getting nominees:", err)
+		http.Error(w, "Error retrieving nominees", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    nomination,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
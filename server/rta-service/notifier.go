@@ -0,0 +1,50 @@
+package main
+
+import "sync"
+
+// orderNotifier lets requests wait for an order to change instead of polling the database.
+// processOrder and cancelOrder signal it whenever they change the status of an order.
+type orderNotifier struct {
+	sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+}
+
+var orderChanges = &orderNotifier{
+	waiters: map[string]map[chan struct{}]struct{}{},
+}
+
+// wait returns a channel closed on the next change of the order, and a function
+// to call once the caller stops waiting
+func (n *orderNotifier) wait(orderID string) (<-chan struct{}, func()) {
+	n.Lock()
+	defer n.Unlock()
+
+	ch := make(chan struct{})
+	if n.waiters[orderID] == nil {
+		n.waiters[orderID] = map[chan struct{}]struct{}{}
+	}
+	n.waiters[orderID][ch] = struct{}{}
+
+	return ch, func() {
+		n.Lock()
+		defer n.Unlock()
+		if _, ok := n.waiters[orderID][ch]; !ok {
+			return
+		}
+		delete(n.waiters[orderID], ch)
+		if len(n.waiters[orderID]) == 0 {
+			delete(n.waiters, orderID)
+		}
+	}
+}
+
+// notify wakes up everyone waiting on the order
+func (n *orderNotifier) notify(orderID string) {
+	n.Lock()
+	defer n.Unlock()
+
+	for ch := range n.waiters[orderID] {
+		close(ch)
+	}
+	delete(n.waiters, orderID)
+}
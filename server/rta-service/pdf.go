@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// pdfDocument writes plain text pages as a PDF using the standard Courier fonts,
+// which every PDF reader has, so no font needs to be embedded. The fixed width font
+// keeps text tables aligned.
+type pdfDocument struct {
+	pages [][]pdfLine
+}
+
+type pdfLine struct {
+	text string
+	bold bool
+}
+
+const (
+	// A4 in points
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+	pdfMargin     = 40
+	pdfFontSize   = 8
+	pdfLeading    = 11
+	// Courier glyphs are 0.6 em wide
+	pdfLineWidth    = (pdfPageWidth - 2*pdfMargin) * 10 / (pdfFontSize * 6)
+	pdfLinesPerPage = (pdfPageHeight - 2*pdfMargin) / pdfLeading
+)
+
+// addLine appends a line of text, starting a new page when the current one is full.
+// Lines longer than the page are cut.
+func (d *pdfDocument) addLine(text string, bold bool) {
+	if len(d.pages) == 0 || len(d.pages[len(d.pages)-1]) == pdfLinesPerPage {
+		d.pages = append(d.pages, nil)
+	}
+	if len(text) > pdfLineWidth {
+		text = text[:pdfLineWidth]
+	}
+	d.pages[len(d.pages)-1] = append(d.pages[len(d.pages)-1], pdfLine{text, bold})
+}
+
+// bytes renders the document
+func (d *pdfDocument) bytes() []byte {
+	pages := d.pages
+	if len(pages) == 0 {
+		pages = [][]pdfLine{nil}
+	}
+
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+
+	// objects 1 to 4 are the catalog, the page tree and the fonts, then a page and its content for every page
+	const firstPage = 5
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, lines := range pages {
+		var content strings.Builder
+		fmt.Fprintf(&content, "BT\n%d TL\n%d %d Td\n", pdfLeading, pdfMargin, pdfPageHeight-pdfMargin)
+		for _, line := range lines {
+			font := "F1"
+			if line.bold {
+				font = "F2"
+			}
+			fmt.Fprintf(&content, "/%s %d Tf\n(%s) Tj\nT*\n", font, pdfFontSize, pdfEscape(line.text))
+		}
+		footer := fmt.Sprintf("Page %d of %d", i+1, len(pages))
+		fmt.Fprintf(&content, "ET\nBT\n/F1 %d Tf\n%d %d Td\n(%s) Tj\nET", pdfFontSize, pdfMargin, pdfMargin/2, footer)
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, firstPage+2*i+1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+// pdfEscape escapes a string for a PDF literal string, replacing what the font can't show
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
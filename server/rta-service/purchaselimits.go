@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrorCodeInvalidPurchaseAmount is returned when a purchase amount is below the fund's
+// minimum or not a multiple of its purchase multiple
+const ErrorCodeInvalidPurchaseAmount = "INVALID_PURCHASE_AMOUNT"
+
+// purchaseLimitError is returned for purchases whose amount the fund doesn't accept
+type purchaseLimitError struct {
+	msg string
+}
+
+func (e *purchaseLimitError) Error() string {
+	return e.msg
+}
+
+// isMultiple reports whether amount is a whole number of multiples
+func isMultiple(amount, multiple Money) bool {
+	return multiple <= 0 || amount%multiple == 0
+}
+
+// purchaseMinimum returns the least amount of the fund the user can buy into the folio, the
+// minimum first purchase unless they already bought the fund in it. Without a folio the user's
+// default folio with the fund's AMC is used, the one the purchase would go to.
+func (a *App) purchaseMinimum(phoneNumber string, fund Fund, folioNumber *string) (Money, bool, error) {
+	folio := ""
+	if folioNumber != nil && *folioNumber != "" {
+		folio = *folioNumber
+	} else {
+		err := a.db.QueryRow("SELECT folio_number FROM folios WHERE phone_number = ? AND amc = ? ORDER BY id LIMIT 1", phoneNumber, fund.AMC).Scan(&folio)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fund.MinFirstPurchase, true, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	// orders that are Submitted count, so the legs of a basket placed together aren't all first purchases
+	var count int
+	err := a.db.QueryRow("SELECT COUNT(*) FROM orders WHERE phone_number = ? AND folio_number = ? AND fund = ? AND order_type = ? AND status IN ('Submitted', 'Succeeded')",
+		phoneNumber, folio, fund.Name, OrderTypePurchase).Scan(&count)
+	if err != nil {
+		return 0, false, err
+	}
+	if count == 0 {
+		return fund.MinFirstPurchase, true, nil
+	}
+	return fund.MinAdditionalPurchase, false, nil
+}
+
+// checkPurchaseLimits returns a purchaseLimitError unless the amount is at least the fund's
+// minimum purchase and a multiple of its purchase multiple. Unknown funds are not checked,
+// their orders fail when processed.
+func (a *App) checkPurchaseLimits(phoneNumber, fundName string, folioNumber *string, amount Money) error {
+	fundC.Lock()
+	fund, ok := fundC.Funds[fundName]
+	fundC.Unlock()
+	if !ok {
+		return nil
+	}
+
+	minimum, first, err := a.purchaseMinimum(phoneNumber, fund, folioNumber)
+	if err != nil {
+		return err
+	}
+	if amount < minimum {
+		kind := "additional"
+		if first {
+			kind = "first"
+		}
+		return &purchaseLimitError{fmt.Sprintf("Minimum %s purchase of '%s' is %s", kind, fund.Name, minimum)}
+	}
+	if !isMultiple(amount, fund.PurchaseMultiple) {
+		return &purchaseLimitError{fmt.Sprintf("Purchases of '%s' must be in multiples of %s", fund.Name, fund.PurchaseMultiple)}
+	}
+	return nil
+}
+
+// strategyLeg is the amount of a strategy going to one of its funds
+type strategyLeg struct {
+	fund   Fund
+	amount Money
+}
+
+// splitStrategy splits the amount over the funds of the strategy by their percentage. Each leg
+// is rounded down to its fund's purchase multiple and what is left over goes to the largest legs
+// that can take it. It returns a purchaseLimitError, with the least amount the strategy can be
+// bought for, if any leg would be below its fund's minimum.
+func (a *App) splitStrategy(phoneNumber string, strategy []Funds, amount Money) ([]strategyLeg, error) {
+	legs := make([]strategyLeg, 0, len(strategy))
+	fundC.Lock()
+	for _, f := range strategy {
+		fund, ok := fundC.Funds[f.Name]
+		if !ok {
+			fundC.Unlock()
+			return nil, fmt.Errorf("%w: %s", errFundNotFound, f.Name)
+		}
+		legs = append(legs, strategyLeg{fund: fund, amount: amount * Money(f.Percentage) / 100})
+	}
+	fundC.Unlock()
+
+	leftover := amount
+	for i := range legs {
+		if m := legs[i].fund.PurchaseMultiple; m > 0 {
+			legs[i].amount = legs[i].amount / m * m
+		}
+		leftover -= legs[i].amount
+	}
+	byPercentage := make([]int, len(legs))
+	for i := range byPercentage {
+		byPercentage[i] = i
+	}
+	sort.SliceStable(byPercentage, func(i, j int) bool {
+		return strategy[byPercentage[i]].Percentage > strategy[byPercentage[j]].Percentage
+	})
+	for _, i := range byPercentage {
+		m := legs[i].fund.PurchaseMultiple
+		if m <= 0 {
+			m = 1
+		}
+		extra := leftover / m * m
+		legs[i].amount += extra
+		leftover -= extra
+	}
+	if leftover > 0 {
+		return nil, &purchaseLimitError{fmt.Sprintf("Amount %s can't be split into the purchase multiples of the strategy's funds, %s is left over", amount, leftover)}
+	}
+
+	var below []string
+	least := Money(0)
+	for i, leg := range legs {
+		minimum, _, err := a.purchaseMinimum(phoneNumber, leg.fund, nil)
+		if err != nil {
+			return nil, err
+		}
+		if leg.amount < minimum {
+			below = append(below, fmt.Sprintf("'%s' gets %s of its minimum %s", leg.fund.Name, leg.amount, minimum))
+		}
+		if p := Money(strategy[i].Percentage); p > 0 {
+			// the least amount whose share is the minimum, rounded up to the rupee
+			least = max(least, (minimum*100+p*Rupee-1)/(p*Rupee)*Rupee)
+		}
+	}
+	if len(below) > 0 {
+		return nil, &purchaseLimitError{fmt.Sprintf("Amount %s is too small for the strategy, %s. Invest at least %s", amount, strings.Join(below, ", "), least)}
+	}
+	return legs, nil
+}
@@ -0,0 +1,9 @@
+package main
+
+import "payment-gateway/internal/ratelimit"
+
+// defaultRateLimits apply unless RATE_LIMITS overrides them, "*" is the limit of every other route
+var defaultRateLimits = map[string]ratelimit.Limit{
+	"*":           {Rate: 2, Burst: 60},
+	"POST /order": {Rate: 0.5, Burst: 10},
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Refund statuses of cancelled purchases and of purchases that failed after they were paid for.
+// A refund is Pending until the payment gateway has refunded it, or Failed when the gateway
+// refused it, e.g. because the payment never succeeded.
+const (
+	RefundStatusPending  = "Pending"
+	RefundStatusRefunded = "Refunded"
+	RefundStatusFailed   = "Failed"
+)
+
+// Refund is a refund made by the payment gateway
+type Refund struct {
+	ID     string `json:"id"`
+	Amount Money  `json:"amount"`
+	Status string `json:"status"`
+}
+
+// refundOrder asks the payment gateway to refund a cancelled or failed purchase to the account it
+// was paid from and records the outcome on the order. The refund stays Pending when the gateway
+// can't be reached or fails, it is retried when the service restarts.
+func (a *App) refundOrder(orderID string) {
+	var amount Money
+	var paymentID string
+	err := a.db.QueryRow("SELECT amount, payment_id FROM orders WHERE uuid = ? AND refund_status = ?", orderID, RefundStatusPending).
+		Scan(&amount, &paymentID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Default().Println("Error getting refund details:", err)
+		}
+		return
+	}
+
+	status := RefundStatusFailed
+	var refundID *string
+	refund, code, err := a.retryRequestRefund(paymentID, amount, orderID, 3)
+	// the gateway refuses refunds of payments it doesn't have or that didn't succeed, other errors are retried later
+	if err != nil && code != http.StatusNotFound && code != http.StatusUnprocessableEntity {
+		log.Default().Println("Refund of order", orderID, "is still pending:", err)
+		return
+	}
+	if err != nil {
+		log.Default().Println("Error refunding order", orderID+":", err)
+	} else if refund.Status == "Success" {
+		status, refundID = RefundStatusRefunded, &refund.ID
+	}
+
+	_, err = a.db.Exec("UPDATE orders SET refund_status = ?, refund_id = ? WHERE uuid = ? AND refund_status = ?", status, refundID, orderID, RefundStatusPending)
+	if err != nil {
+		log.Default().Println("Error updating refund status:", err)
+		return
+	}
+	orderChanges.notify(orderID)
+	a.publishOrderUpdate(orderID)
+	log.Default().Println("Refund of order", orderID, "is", status)
+}
+
+// refundPendingOrders retries the refunds left Pending, e.g. by a restart
+func (a *App) refundPendingOrders() {
+	rows, err := a.db.Query("SELECT uuid FROM orders WHERE refund_status = ?", RefundStatusPending)
+	if err != nil {
+		log.Default().Println("Error getting pending refunds:", err)
+		return
+	}
+	var orderIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Default().Println("Error reading pending refund:", err)
+			rows.Close()
+			return
+		}
+		orderIDs = append(orderIDs, id)
+	}
+	rows.Close()
+
+	for _, id := range orderIDs {
+		a.refundOrder(id)
+	}
+}
+
+// retryRequestRefund requests the refund until the gateway answers with anything but a server
+// error. On error it also returns the status code of the last answer, 0 if there was none.
+func (a *App) retryRequestRefund(paymentID string, amount Money, reference string, retryCount int) (*Refund, int, error) {
+	var refund *Refund
+	var code int
+	var err error
+	for i := 0; i < retryCount; i++ {
+		refund, code, err = a.requestRefund(paymentID, amount, reference)
+		if err == nil || (code != 0 && code < http.StatusInternalServerError) {
+			return refund, code, err
+		}
+		log.Printf("Error requesting refund (attempt %d/%d): %v", i+1, retryCount, err)
+		time.Sleep(1 * time.Second) // Add a delay between retries
+	}
+	return nil, code, err
+}
+
+func (a *App) requestRefund(paymentID string, amount Money, reference string) (*Refund, int, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"amount":    amount,
+		"reference": reference,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := a.postToGateway("/payment/"+paymentID+"/refund", body)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("error reading refund response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("refund returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var refund Refund
+	if err := json.Unmarshal(respBody, &refund); err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("error decoding refund response: %w. response %+v", err, string(respBody))
+	}
+	return &refund, resp.StatusCode, nil
+}
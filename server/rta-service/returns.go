@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Returns of a set of transactions valued at the current market value.
+// Percentages are expressed as percent, e.g. 12.5 for 12.5%.
+type Returns struct {
+	// Amount paid for purchases
+	InvestedAmount float64 `json:"investedAmount"`
+	// Amount received from redemptions and dividend payouts
+	WithdrawnAmount float64 `json:"withdrawnAmount"`
+	// Market value of the units still held
+	CurrentValue float64 `json:"currentValue"`
+	// Current value less the average cost of the units still held
+	UnrealisedGain float64 `json:"unrealisedGain"`
+	// (current value + withdrawn - invested) / invested
+	AbsoluteReturn *float64 `json:"absoluteReturn"`
+	// Absolute return annualised over the time since the first purchase
+	CAGR *float64 `json:"cagr"`
+	// Annualised return taking the date of every cash flow into account
+	XIRR *float64 `json:"xirr"`
+}
+
+// cashFlow is money paid (negative) or received (positive) on a date
+type cashFlow struct {
+	Date   time.Time
+	Amount float64
+}
+
+// returnsAccumulator builds the Returns of a set of transactions, fed in date order
+type returnsAccumulator struct {
+	flows         []cashFlow
+	invested      float64
+	withdrawn     float64
+	firstPurchase time.Time
+	units         map[string]float64
+	costBasis     map[string]float64
+}
+
+func newReturnsAccumulator() *returnsAccumulator {
+	return &returnsAccumulator{
+		units:     map[string]float64{},
+		costBasis: map[string]float64{},
+	}
+}
+
+func (acc *returnsAccumulator) add(t transaction) {
+	switch t.OrderType {
+	case OrderTypePurchase:
+		acc.flows = append(acc.flows, cashFlow{t.Date, -t.Amount})
+		acc.invested += t.Amount
+		acc.units[t.Fund] += t.Units
+		acc.costBasis[t.Fund] += t.Amount
+		if acc.firstPurchase.IsZero() {
+			acc.firstPurchase = t.Date
+		}
+	case OrderTypeRedemption:
+		acc.flows = append(acc.flows, cashFlow{t.Date, t.Amount})
+		acc.withdrawn += t.Amount
+		// redeemed units leave at their average cost
+		if held := acc.units[t.Fund]; held > 0 {
+			acc.costBasis[t.Fund] -= acc.costBasis[t.Fund] * math.Min(t.Units/held, 1)
+		}
+		acc.units[t.Fund] -= t.Units
+	case OrderTypeDividendPayout:
+		acc.flows = append(acc.flows, cashFlow{t.Date, t.Amount})
+		acc.withdrawn += t.Amount
+	case OrderTypeDividendReinvestment:
+		// no money changes hands, the dividend becomes the cost of the new units
+		acc.units[t.Fund] += t.Units
+		acc.costBasis[t.Fund] += t.Amount
+	}
+}
+
+// returns values the held units at the given market values
+func (acc *returnsAccumulator) returns(navs map[string]float64, now time.Time) Returns {
+	r := Returns{
+		InvestedAmount:  acc.invested,
+		WithdrawnAmount: acc.withdrawn,
+	}
+	costBasis := 0.0
+	for fund, units := range acc.units {
+		r.CurrentValue += units * navs[fund]
+		costBasis += acc.costBasis[fund]
+	}
+	r.UnrealisedGain = r.CurrentValue - costBasis
+
+	if acc.invested <= 0 {
+		return r
+	}
+
+	absolute := (r.CurrentValue + r.WithdrawnAmount - r.InvestedAmount) / r.InvestedAmount * 100
+	r.AbsoluteReturn = &absolute
+
+	years := now.Sub(acc.firstPurchase).Hours() / 24 / 365
+	if years > 0 {
+		cagr := (math.Pow((r.CurrentValue+r.WithdrawnAmount)/r.InvestedAmount, 1/years) - 1) * 100
+		if !math.IsInf(cagr, 0) && !math.IsNaN(cagr) {
+			r.CAGR = &cagr
+		}
+	}
+
+	// xirr sorts the flows in place, clone them so the accumulator can be valued again
+	flows := append(slices.Clone(acc.flows), cashFlow{now, r.CurrentValue})
+	if rate, ok := xirr(flows); ok {
+		rate *= 100
+		r.XIRR = &rate
+	}
+	return r
+}
+
+// xirr finds the annual rate at which the net present value of the cash flows is zero.
+// It returns false when the flows have no such rate or it can't be found.
+func xirr(flows []cashFlow) (float64, bool) {
+	if len(flows) < 2 {
+		return 0, false
+	}
+	sort.SliceStable(flows, func(i, j int) bool { return flows[i].Date.Before(flows[j].Date) })
+
+	hasIn, hasOut := false, false
+	for _, f := range flows {
+		hasIn = hasIn || f.Amount > 0
+		hasOut = hasOut || f.Amount < 0
+	}
+	if !hasIn || !hasOut {
+		return 0, false
+	}
+	// flows on a single day are worth the same at every rate
+	start := flows[0].Date
+	if !flows[len(flows)-1].Date.After(start) {
+		return 0, false
+	}
+
+	npv := func(rate float64) float64 {
+		total := 0.0
+		for _, f := range flows {
+			years := f.Date.Sub(start).Hours() / 24 / 365
+			total += f.Amount / math.Pow(1+rate, years)
+		}
+		return total
+	}
+
+	// Newton's method converges quickly for the usual rates
+	rate := 0.1
+	for i := 0; i < 100; i++ {
+		value := npv(rate)
+		const h = 1e-6
+		derivative := (npv(rate+h) - value) / h
+		if derivative == 0 || math.IsNaN(derivative) || math.IsInf(derivative, 0) {
+			break
+		}
+		next := rate - value/derivative
+		if next <= -1 || math.IsNaN(next) || math.IsInf(next, 0) {
+			break
+		}
+		if math.Abs(next-rate) < 1e-10 {
+			return next, true
+		}
+		rate = next
+	}
+
+	// fall back to bisection, which copes with the extreme rates of short holding periods
+	low, high := -0.999999, 1.0
+	for npv(high) > 0 && high < 1e12 {
+		high *= 10
+	}
+	if npv(low)*npv(high) > 0 {
+		return 0, false
+	}
+	for i := 0; i < 200; i++ {
+		mid := (low + high) / 2
+		if npv(low)*npv(mid) <= 0 {
+			high = mid
+		} else {
+			low = mid
+		}
+	}
+	rate = (low + high) / 2
+	if math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return 0, false
+	}
+	return rate, true
+}
+
+// transaction is a completed order as it affects the holdings of a user
+type transaction struct {
+	Fund         string
+	FolioNumber  string
+	StrategyName string
+	OrderType    string
+	Amount       float64
+	Units        float64
+	Date         time.Time
+}
+
+// transactions returns the completed orders of the phone number, oldest first
+func (a *App) transactions(phoneNumber string) ([]transaction, error) {
+	rows, err := a.db.Query(`SELECT fund, folio_number, strategy_name, order_type, amount, units, submitted_at, succeeded_at
+		FROM orders WHERE phone_number = ? AND status = 'Succeeded' ORDER BY id`, phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transactions []transaction
+	for rows.Next() {
+		var t transaction
+		var folioNumber, strategyName sql.NullString
+		var submittedAt, succeededAt sql.NullTime
+		var amount Money
+		var units Units
+		if err := rows.Scan(&t.Fund, &folioNumber, &strategyName, &t.OrderType, &amount, &units, &submittedAt, &succeededAt); err != nil {
+			return nil, err
+		}
+		t.Amount, t.Units = amount.Rupees(), units.Float()
+		t.FolioNumber = folioNumber.String
+		t.StrategyName = strategyName.String
+		t.Date = submittedAt.Time
+		if succeededAt.Valid {
+			t.Date = succeededAt.Time
+		}
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(transactions, func(i, j int) bool { return transactions[i].Date.Before(transactions[j].Date) })
+	return transactions, nil
+}
+
+// handler function to get the returns of the portfolio of a user, per fund, per folio, per strategy and overall
+func (a *App) portfolioReturnsHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := callerPhoneNumber(w, r, r.URL.Query().Get("phoneNumber"))
+	if !ok {
+		return
+	}
+
+	transactions, err := a.transactions(phoneNumber)
+	if err != nil {
+		log.Default().Println("Error getting transactions:", err)
+		http.Error(w, "Error retrieving orders", http.StatusInternalServerError)
+		return
+	}
+
+	portfolio := newReturnsAccumulator()
+	funds := map[string]*returnsAccumulator{}
+	folios := map[string]*returnsAccumulator{}
+	strategies := map[string]*returnsAccumulator{}
+	for _, t := range transactions {
+		portfolio.add(t)
+
+		if funds[t.Fund] == nil {
+			funds[t.Fund] = newReturnsAccumulator()
+		}
+		funds[t.Fund].add(t)
+
+		if t.FolioNumber != "" {
+			if folios[t.FolioNumber] == nil {
+				folios[t.FolioNumber] = newReturnsAccumulator()
+			}
+			folios[t.FolioNumber].add(t)
+		}
+
+		if t.StrategyName == "" {
+			continue
+		}
+		if strategies[t.StrategyName] == nil {
+			strategies[t.StrategyName] = newReturnsAccumulator()
+		}
+		strategies[t.StrategyName].add(t)
+	}
+
+	fundNames := make([]string, 0, len(funds))
+	for name := range funds {
+		fundNames = append(fundNames, name)
+	}
+	navs, err := currentNavs(fundNames)
+	if err != nil {
+		http.Error(w, "Fund not found", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	fundReturns := map[string]Returns{}
+	for name, acc := range funds {
+		fundReturns[name] = acc.returns(navs, now)
+	}
+	folioReturns := map[string]Returns{}
+	for folioNumber, acc := range folios {
+		folioReturns[folioNumber] = acc.returns(navs, now)
+	}
+	strategyReturns := map[string]Returns{}
+	for name, acc := range strategies {
+		strategyReturns[name] = acc.returns(navs, now)
+	}
+
+	resp := map[string]interface{}{
+		"data": map[string]interface{}{
+			"portfolio":  portfolio.returns(navs, now),
+			"strategies": strategyReturns,
+			"folios":     folioReturns,
+			"funds":      fundReturns,
+		},
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// currentNavs returns the market value of the given funds from the cache
+func currentNavs(fundNames []string) (map[string]float64, error) {
+	fundC.Lock()
+	defer fundC.Unlock()
+
+	navs := map[string]float64{}
+	for _, name := range fundNames {
+		fund, ok := fundC.Funds[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errFundNotFound, name)
+		}
+		navs[name] = fund.MarketValue
+	}
+	return navs, nil
+}
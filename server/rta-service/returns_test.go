@@ -0,0 +1,237 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+// day returns the date n days after testStart
+func day(n int) time.Time {
+	return testStart.AddDate(0, 0, n)
+}
+
+func TestXIRR(t *testing.T) {
+	tests := []struct {
+		name  string
+		flows []cashFlow
+		want  float64
+		ok    bool
+	}{
+		{
+			name:  "one year at 10%",
+			flows: []cashFlow{{day(0), -1000}, {day(365), 1100}},
+			want:  0.1,
+			ok:    true,
+		},
+		{
+			name:  "two purchases a year apart at 10%",
+			flows: []cashFlow{{day(0), -1000}, {day(365), -1000}, {day(730), 2310}},
+			want:  0.1,
+			ok:    true,
+		},
+		{
+			name:  "flows out of order",
+			flows: []cashFlow{{day(730), 2310}, {day(365), -1000}, {day(0), -1000}},
+			want:  0.1,
+			ok:    true,
+		},
+		{
+			name:  "loss of half in a year",
+			flows: []cashFlow{{day(0), -1000}, {day(365), 500}},
+			want:  -0.5,
+			ok:    true,
+		},
+		{
+			name:  "no gain",
+			flows: []cashFlow{{day(0), -1000}, {day(200), 1000}},
+			want:  0,
+			ok:    true,
+		},
+		{
+			name:  "10% in a month",
+			flows: []cashFlow{{day(0), -1000}, {day(30), 1100}},
+			want:  math.Pow(1.1, 365.0/30) - 1,
+			ok:    true,
+		},
+		{
+			name:  "single flow",
+			flows: []cashFlow{{day(0), -1000}},
+		},
+		{
+			name:  "no flows",
+			flows: nil,
+		},
+		{
+			name:  "only money paid",
+			flows: []cashFlow{{day(0), -1000}, {day(365), -500}},
+		},
+		{
+			name:  "only money received",
+			flows: []cashFlow{{day(0), 1000}, {day(365), 500}},
+		},
+		{
+			name:  "flows on one day",
+			flows: []cashFlow{{day(0), -1000}, {day(0), 1000}},
+		},
+		{
+			name:  "no rate makes the value zero",
+			flows: []cashFlow{{day(0), 100}, {day(365), -100}, {day(730), 100}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := xirr(tt.flows)
+			if ok != tt.ok {
+				t.Fatalf("xirr() ok = %v, want %v (rate %v)", ok, tt.ok, got)
+			}
+			if ok && math.Abs(got-tt.want) > 1e-6*math.Max(1, math.Abs(tt.want)) {
+				t.Errorf("xirr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReturnsAccumulator(t *testing.T) {
+	tests := []struct {
+		name         string
+		transactions []transaction
+		navs         map[string]float64
+		now          time.Time
+
+		invested, withdrawn, current, unrealised float64
+		absolute, cagr, xirr                     *float64
+	}{
+		{
+			name: "purchase held a year",
+			transactions: []transaction{
+				{Fund: "A", OrderType: OrderTypePurchase, Amount: 1000, Units: 100, Date: day(0)},
+			},
+			navs:       map[string]float64{"A": 11},
+			now:        day(365),
+			invested:   1000,
+			current:    1100,
+			unrealised: 100,
+			absolute:   ptr(10.0),
+			cagr:       ptr(10.0),
+			xirr:       ptr(10.0),
+		},
+		{
+			name: "half redeemed at a gain",
+			transactions: []transaction{
+				{Fund: "A", OrderType: OrderTypePurchase, Amount: 1000, Units: 100, Date: day(0)},
+				{Fund: "A", OrderType: OrderTypeRedemption, Amount: 600, Units: 50, Date: day(365)},
+			},
+			navs:       map[string]float64{"A": 12},
+			now:        day(365),
+			invested:   1000,
+			withdrawn:  600,
+			current:    600,
+			unrealised: 100,
+			absolute:   ptr(20.0),
+			cagr:       ptr(20.0),
+			xirr:       ptr(20.0),
+		},
+		{
+			name: "reinvested dividend adds units at their cost",
+			transactions: []transaction{
+				{Fund: "A", OrderType: OrderTypePurchase, Amount: 1000, Units: 100, Date: day(0)},
+				{Fund: "A", OrderType: OrderTypeDividendReinvestment, Amount: 100, Units: 10, Date: day(100)},
+			},
+			navs:       map[string]float64{"A": 10},
+			now:        day(365),
+			invested:   1000,
+			current:    1100,
+			unrealised: 0,
+			absolute:   ptr(10.0),
+			cagr:       ptr(10.0),
+			xirr:       ptr(10.0),
+		},
+		{
+			name: "dividend payout is withdrawn",
+			transactions: []transaction{
+				{Fund: "A", OrderType: OrderTypePurchase, Amount: 1000, Units: 100, Date: day(0)},
+				{Fund: "A", OrderType: OrderTypeDividendPayout, Amount: 100, Date: day(365)},
+			},
+			navs:      map[string]float64{"A": 10},
+			now:       day(365),
+			invested:  1000,
+			withdrawn: 100,
+			current:   1000,
+			absolute:  ptr(10.0),
+			cagr:      ptr(10.0),
+			xirr:      ptr(10.0),
+		},
+		{
+			name: "valued on the day of purchase",
+			transactions: []transaction{
+				{Fund: "A", OrderType: OrderTypePurchase, Amount: 1000, Units: 100, Date: day(0)},
+			},
+			navs:     map[string]float64{"A": 10},
+			now:      day(0),
+			invested: 1000,
+			current:  1000,
+			absolute: ptr(0.0),
+		},
+		{
+			name: "nothing invested",
+			transactions: []transaction{
+				{Fund: "A", OrderType: OrderTypeDividendPayout, Amount: 100, Date: day(0)},
+			},
+			now:       day(365),
+			withdrawn: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acc := newReturnsAccumulator()
+			for _, tr := range tt.transactions {
+				acc.add(tr)
+			}
+			flows := slices.Clone(acc.flows)
+			// valuing twice must give the same result, xirr sorts the flows it is given
+			for i := 0; i < 2; i++ {
+				r := acc.returns(tt.navs, tt.now)
+				checkAmount(t, "InvestedAmount", r.InvestedAmount, tt.invested)
+				checkAmount(t, "WithdrawnAmount", r.WithdrawnAmount, tt.withdrawn)
+				checkAmount(t, "CurrentValue", r.CurrentValue, tt.current)
+				checkAmount(t, "UnrealisedGain", r.UnrealisedGain, tt.unrealised)
+				checkRate(t, "AbsoluteReturn", r.AbsoluteReturn, tt.absolute)
+				checkRate(t, "CAGR", r.CAGR, tt.cagr)
+				checkRate(t, "XIRR", r.XIRR, tt.xirr)
+			}
+			if !slices.Equal(acc.flows, flows) {
+				t.Errorf("returns() changed the flows of the accumulator from %v to %v", flows, acc.flows)
+			}
+		})
+	}
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
+
+func checkAmount(t *testing.T, name string, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 1e-6 {
+		t.Errorf("%s = %v, want %v", name, got, want)
+	}
+}
+
+func checkRate(t *testing.T, name string, got, want *float64) {
+	t.Helper()
+	switch {
+	case got == nil && want == nil:
+	case got == nil:
+		t.Errorf("%s = nil, want %v", name, *want)
+	case want == nil:
+		t.Errorf("%s = %v, want nil", name, *got)
+	case math.Abs(*got-*want) > 1e-4:
+		t.Errorf("%s = %v, want %v", name, *got, *want)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Roles of users. Every user is an investor acting on their own account, the other roles
+// are granted through the admin API.
+const (
+	RoleInvestor = "investor"
+	// support can look at the accounts of any user
+	RoleSupport = "support"
+	// operator runs the day to day operations like reviewing KYC
+	RoleOperator = "operator"
+	// admin can do everything, including managing roles
+	RoleAdmin = "admin"
+)
+
+// Permissions checked on routes, see rolePermissions for the roles that have them
+const (
+	// PermViewAccounts allows reading the account of any user
+	PermViewAccounts = "accounts:view"
+	// PermReviewKYC allows approving and rejecting KYC profiles
+	PermReviewKYC = "kyc:review"
+	// PermRunOperations allows maintenance like rebuilding the portfolio history
+	PermRunOperations = "operations:run"
+	// PermManageRoles allows granting and revoking roles
+	PermManageRoles = "roles:manage"
+)
+
+var rolePermissions = map[string][]string{
+	RoleInvestor: {},
+	RoleSupport:  {PermViewAccounts},
+	RoleOperator: {PermViewAccounts, PermReviewKYC, PermRunOperations},
+	RoleAdmin:    {PermViewAccounts, PermReviewKYC, PermRunOperations, PermManageRoles},
+}
+
+var errLastAdmin = errors.New("can't revoke the role of the last admin")
+
+// can reports whether any role of the user has the permission
+func (id *Identity) can(permission string) bool {
+	for _, role := range id.Roles {
+		if slices.Contains(rolePermissions[role], permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize only lets authenticated users with the permission through, denials are logged
+func (a *App) authorize(permission string, f func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return a.authenticate(func(w http.ResponseWriter, r *http.Request) {
+		id := identity(r)
+		if !id.can(permission) {
+			log.Default().Println("Denied", r.Method, r.URL.Path, "to", id.PhoneNumber, "with roles", id.Roles, "missing", permission)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		f(w, r)
+	})
+}
+
+// userRoles returns the roles of the user, investor and the ones granted to them
+func userRoles(db *sql.DB, phoneNumber string) ([]string, error) {
+	rows, err := db.Query("SELECT role FROM user_roles WHERE phone_number = ? ORDER BY role", phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{RoleInvestor}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// bootstrapAdmins grants admin to the comma separated phone numbers of the ADMIN_PHONE_NUMBERS
+// environment variable, so the first admin can manage the roles of everyone else
+func bootstrapAdmins(db *sql.DB) error {
+	for _, phoneNumber := range strings.Split(os.Getenv("ADMIN_PHONE_NUMBERS"), ",") {
+		phoneNumber = strings.TrimSpace(phoneNumber)
+		if phoneNumber == "" {
+			continue
+		}
+		res, err := db.Exec("INSERT OR IGNORE INTO user_roles (phone_number, role, granted_by, granted_at) VALUES (?, ?, ?, ?)",
+			phoneNumber, RoleAdmin, "ADMIN_PHONE_NUMBERS", time.Now().UTC().Format(time.DateTime))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Default().Println("Granted admin to", phoneNumber)
+		}
+	}
+	return nil
+}
+
+// RoleGrant is a role granted to a user
+type RoleGrant struct {
+	PhoneNumber string `json:"phoneNumber"`
+	Role        string `json:"role"`
+	GrantedBy   string `json:"grantedBy"`
+	GrantedAt   string `json:"grantedAt"`
+}
+
+// handler function to list the granted roles, optionally of one role
+func (a *App) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT phone_number, role, granted_by, granted_at FROM user_roles"
+	var args []any
+	if role := r.URL.Query().Get("role"); role != "" {
+		query += " WHERE role = ?"
+		args = append(args, role)
+	}
+	query += " ORDER BY phone_number, role"
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		log.Default().Println("Error listing roles:", err)
+		http.Error(w, "Error retrieving roles", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	grants := []RoleGrant{}
+	for rows.Next() {
+		var g RoleGrant
+		if err := rows.Scan(&g.PhoneNumber, &g.Role, &g.GrantedBy, &g.GrantedAt); err != nil {
+			log.Default().Println("Error reading role:", err)
+			http.Error(w, "Error retrieving roles", http.StatusInternalServerError)
+			return
+		}
+		grants = append(grants, g)
+	}
+	if err := rows.Err(); err != nil {
+		log.Default().Println("Error listing roles:", err)
+		http.Error(w, "Error retrieving roles", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data":    grants,
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handler function to get the roles of a user
+func (a *App) getUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	a.writeUserRoles(w, r.PathValue("phoneNumber"))
+}
+
+func (a *App) writeUserRoles(w http.ResponseWriter, phoneNumber string) {
+	roles, err := userRoles(a.db, phoneNumber)
+	if err != nil {
+		log.Default().Println("Error getting roles:", err)
+		http.Error(w, "Error retrieving roles", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"data": map[string]interface{}{
+			"phoneNumber": phoneNumber,
+			"roles":       roles,
+		},
+		"success": true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handler function to grant a role to a registered user
+func (a *App) grantRoleHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, role := r.PathValue("phoneNumber"), r.PathValue("role")
+	if _, ok := rolePermissions[role]; !ok || role == RoleInvestor {
+		http.Error(w, "Invalid role, must be support, operator or admin", http.StatusBadRequest)
+		return
+	}
+
+	var count int
+	err := a.db.QueryRow("SELECT COUNT(*) FROM users WHERE phone_number = ?", phoneNumber).Scan(&count)
+	if err != nil {
+		log.Default().Println("Error checking user:", err)
+		http.Error(w, "Error granting role", http.StatusInternalServerError)
+		return
+	}
+	if count == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	granter := identity(r).PhoneNumber
+	_, err = a.db.Exec("INSERT OR IGNORE INTO user_roles (phone_number, role, granted_by, granted_at) VALUES (?, ?, ?, ?)",
+		phoneNumber, role, granter, time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		log.Default().Println("Error granting role:", err)
+		http.Error(w, "Error granting role", http.StatusInternalServerError)
+		return
+	}
+	log.Default().Println(granter, "granted", role, "to", phoneNumber)
+
+	a.writeUserRoles(w, phoneNumber)
+}
+
+// handler function to revoke a role from a user. The last admin can't be revoked,
+// so there is always someone to manage the roles.
+func (a *App) revokeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, role := r.PathValue("phoneNumber"), r.PathValue("role")
+
+	err := a.revokeRole(phoneNumber, role)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Role not granted", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errLastAdmin) {
+		http.Error(w, "Can't revoke the role of the last admin", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Default().Println("Error revoking role:", err)
+		http.Error(w, "Error revoking role", http.StatusInternalServerError)
+		return
+	}
+	log.Default().Println(identity(r).PhoneNumber, "revoked", role, "from", phoneNumber)
+
+	a.writeUserRoles(w, phoneNumber)
+}
+
+func (a *App) revokeRole(phoneNumber, role string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if role == RoleAdmin {
+		var admins int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM user_roles WHERE role = ?", RoleAdmin).Scan(&admins); err != nil {
+			return err
+		}
+		if admins == 1 {
+			var count int
+			err := tx.QueryRow("SELECT COUNT(*) FROM user_roles WHERE role = ? AND phone_number = ?", RoleAdmin, phoneNumber).Scan(&count)
+			if err != nil {
+				return err
+			}
+			if count == 1 {
+				return errLastAdmin
+			}
+		}
+	}
+
+	res, err := tx.Exec("DELETE FROM user_roles WHERE phone_number = ? AND role = ?", phoneNumber, role)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accountStatement lists the transactions of a user in a period with the opening and
+// closing balance of every fund in every folio
+type accountStatement struct {
+	PhoneNumber string
+	From        time.Time
+	To          time.Time
+	Funds       []*fundStatement
+}
+
+type fundStatement struct {
+	FolioNumber  string
+	Fund         string
+	OpeningUnits Units
+	OpeningNav   float64
+	Entries      []statementEntry
+	ClosingUnits Units
+	ClosingNav   float64
+}
+
+type statementEntry struct {
+	Date        time.Time
+	Transaction string
+	Amount      Money
+	// ExitLoad is the load deducted from a redemption, Amount is then the net payout
+	ExitLoad Money
+	// Tds is the tax deducted from a dividend, Amount is then what is paid out or reinvested
+	Tds          Money
+	Units        Units
+	PricePerUnit float64
+	// UnitBalance is the units held after the transaction
+	UnitBalance Units
+}
+
+// unitChange returns how a completed order of the given type changes the units held
+func unitChange(orderType string, units Units) Units {
+	switch orderType {
+	case OrderTypeRedemption:
+		return -units
+	case OrderTypeDividendPayout:
+		return 0
+	default:
+		return units
+	}
+}
+
+// handler function to get the account statement of a user as a pdf or csv file
+func (a *App) statementHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := callerPhoneNumber(w, r, r.URL.Query().Get("phoneNumber"))
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "pdf"
+	}
+	if format != "pdf" && format != "csv" {
+		http.Error(w, "Invalid format, must be pdf or csv", http.StatusBadRequest)
+		return
+	}
+
+	var from time.Time
+	to := time.Now()
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, _, err := parseTimeParam(v)
+		if err != nil {
+			http.Error(w, "Invalid from, expected RFC3339 time or YYYY-MM-DD date", http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, dateOnly, err := parseTimeParam(v)
+		if err != nil {
+			http.Error(w, "Invalid to, expected RFC3339 time or YYYY-MM-DD date", http.StatusBadRequest)
+			return
+		}
+		// a bare date includes the whole day
+		if dateOnly {
+			t = t.AddDate(0, 0, 1).Add(-time.Second)
+		}
+		if t.Before(to) {
+			to = t
+		}
+	}
+	if to.Before(from) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	statement, err := a.accountStatement(phoneNumber, from, to)
+	if err != nil {
+		log.Default().Println("Error building statement:", err)
+		http.Error(w, "Error building statement", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("statement-%s-%s-%s.%s", phoneNumber, from.Format("20060102"), to.Format("20060102"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		statement.writeCSV(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Write(statement.pdf())
+}
+
+// accountStatement builds the statement of the user between from and to from their completed
+// orders, valuing the opening and closing balances with the nav history
+func (a *App) accountStatement(phoneNumber string, from, to time.Time) (*accountStatement, error) {
+	rows, err := a.db.Query(`SELECT folio_number, fund, order_type, amount, COALESCE(exit_load, 0), COALESCE(tds, 0), units, price_per_unit, succeeded_at FROM orders
+		WHERE phone_number = ? AND status = 'Succeeded' AND succeeded_at <= ? ORDER BY succeeded_at, id`,
+		phoneNumber, to.UTC().Format(time.DateTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type holding struct{ folioNumber, fund string }
+	funds := map[holding]*fundStatement{}
+	for rows.Next() {
+		var folioNumber sql.NullString
+		var fund, orderType string
+		var e statementEntry
+		if err := rows.Scan(&folioNumber, &fund, &orderType, &e.Amount, &e.ExitLoad, &e.Tds, &e.Units, &e.PricePerUnit, &e.Date); err != nil {
+			return nil, err
+		}
+		h := holding{folioNumber.String, fund}
+		f := funds[h]
+		if f == nil {
+			f = &fundStatement{FolioNumber: folioNumber.String, Fund: fund}
+			funds[h] = f
+		}
+
+		change := unitChange(orderType, e.Units)
+		if e.Date.Before(from) {
+			f.OpeningUnits += change
+			continue
+		}
+		e.Transaction = orderType
+		e.UnitBalance = f.OpeningUnits + change
+		if n := len(f.Entries); n > 0 {
+			e.UnitBalance = f.Entries[n-1].UnitBalance + change
+		}
+		f.Entries = append(f.Entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	statement := &accountStatement{PhoneNumber: phoneNumber, From: from, To: to}
+	for _, f := range funds {
+		f.ClosingUnits = f.OpeningUnits
+		if n := len(f.Entries); n > 0 {
+			f.ClosingUnits = f.Entries[n-1].UnitBalance
+		}
+		if f.OpeningUnits == 0 && len(f.Entries) == 0 {
+			// nothing held or done in the period
+			continue
+		}
+		if f.OpeningNav, err = a.navAt(f.Fund, from); err != nil {
+			return nil, err
+		}
+		if f.ClosingNav, err = a.navAt(f.Fund, to); err != nil {
+			return nil, err
+		}
+		statement.Funds = append(statement.Funds, f)
+	}
+	sort.Slice(statement.Funds, func(i, j int) bool {
+		fi, fj := statement.Funds[i], statement.Funds[j]
+		if fi.FolioNumber != fj.FolioNumber {
+			return fi.FolioNumber < fj.FolioNumber
+		}
+		return fi.Fund < fj.Fund
+	})
+	return statement, nil
+}
+
+// navAt returns the nav of the fund in effect at the given time, the last one declared before it.
+// The current market value is used when the nav history has nothing that old.
+func (a *App) navAt(fund string, at time.Time) (float64, error) {
+	var nav float64
+	err := a.db.QueryRow("SELECT nav FROM nav_history WHERE fund = ? AND declared_at <= ? ORDER BY declared_at DESC LIMIT 1", fund, at.UTC().Format(time.DateTime)).Scan(&nav)
+	if err == nil {
+		return nav, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	fundC.Lock()
+	defer fundC.Unlock()
+	return fundC.Funds[fund].MarketValue, nil
+}
+
+func formatAmount(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// formatLoad leaves the exit load or TDS blank for transactions without one
+func formatLoad(v Money) string {
+	if v == 0 {
+		return ""
+	}
+	return v.String()
+}
+
+func formatUnits(v Units) string {
+	return v.String()
+}
+
+func formatStatementDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(ist).Format("02-Jan-2006")
+}
+
+// writeCSV writes the statement with one row per transaction, preceded by the opening
+// balance and followed by the closing balance of each fund of each folio
+func (s *accountStatement) writeCSV(w io.Writer) {
+	out := csv.NewWriter(w)
+	out.Write([]string{"Folio", "Fund", "Date", "Transaction", "Amount", "Exit Load", "TDS", "Units", "Price Per Unit", "Unit Balance", "Value"})
+	for _, f := range s.Funds {
+		out.Write([]string{f.FolioNumber, f.Fund, formatStatementDate(s.From), "Opening Balance", "", "", "", "", formatAmount(f.OpeningNav), formatUnits(f.OpeningUnits), f.OpeningUnits.valueAt(f.OpeningNav).String()})
+		for _, e := range f.Entries {
+			out.Write([]string{f.FolioNumber, f.Fund, formatStatementDate(e.Date), e.Transaction, e.Amount.String(), formatLoad(e.ExitLoad), formatLoad(e.Tds), formatUnits(e.Units), formatAmount(e.PricePerUnit), formatUnits(e.UnitBalance), ""})
+		}
+		out.Write([]string{f.FolioNumber, f.Fund, formatStatementDate(s.To), "Closing Balance", "", "", "", "", formatAmount(f.ClosingNav), formatUnits(f.ClosingUnits), f.ClosingUnits.valueAt(f.ClosingNav).String()})
+	}
+	out.Flush()
+}
+
+// pdf renders the statement as a pdf, one section per folio listing its funds
+func (s *accountStatement) pdf() []byte {
+	var doc pdfDocument
+	row := "%-12s %-22s %12s %9s %9s %12s %10s %12s"
+
+	doc.addLine("CONSOLIDATED ACCOUNT STATEMENT", true)
+	doc.addLine("", false)
+	doc.addLine("Investor       : "+s.PhoneNumber, false)
+	period := "Beginning"
+	if !s.From.IsZero() {
+		period = formatStatementDate(s.From)
+	}
+	doc.addLine("Period         : "+period+" to "+formatStatementDate(s.To), false)
+	doc.addLine("Generated on   : "+time.Now().In(ist).Format("02-Jan-2006 15:04 MST"), false)
+	doc.addLine("Amounts in Rs. Values are computed at the nav in effect on the date.", false)
+
+	total := Money(0)
+	folio := ""
+	for i, f := range s.Funds {
+		if i == 0 || f.FolioNumber != folio {
+			folio = f.FolioNumber
+			amc, _ := fundAMC(f.Fund)
+			doc.addLine("", false)
+			doc.addLine(strings.Repeat("=", pdfLineWidth), false)
+			doc.addLine(fmt.Sprintf("Folio No: %s    %s", folio, amc), true)
+			doc.addLine(strings.Repeat("=", pdfLineWidth), false)
+		}
+		doc.addLine("", false)
+		doc.addLine(f.Fund, true)
+		doc.addLine(fmt.Sprintf(row, "Date", "Transaction", "Amount", "Exit Load", "TDS", "Units", "Price", "Unit Balance"), true)
+		doc.addLine(fmt.Sprintf(row, formatStatementDate(s.From), "Opening Balance", "", "", "", "", formatAmount(f.OpeningNav), formatUnits(f.OpeningUnits)), false)
+		for _, e := range f.Entries {
+			doc.addLine(fmt.Sprintf(row, formatStatementDate(e.Date), e.Transaction, e.Amount.String(), formatLoad(e.ExitLoad), formatLoad(e.Tds), formatUnits(e.Units), formatAmount(e.PricePerUnit), formatUnits(e.UnitBalance)), false)
+		}
+		doc.addLine(fmt.Sprintf(row, formatStatementDate(s.To), "Closing Balance", "", "", "", "", formatAmount(f.ClosingNav), formatUnits(f.ClosingUnits)), false)
+		value := f.ClosingUnits.valueAt(f.ClosingNav)
+		total += value
+		doc.addLine(fmt.Sprintf("Valuation on %s: %s units x %s = Rs. %s", formatStatementDate(s.To), formatUnits(f.ClosingUnits), formatAmount(f.ClosingNav), value), false)
+	}
+
+	doc.addLine("", false)
+	if len(s.Funds) == 0 {
+		doc.addLine("No holdings or transactions in the period.", false)
+	}
+	doc.addLine("Total valuation: Rs. "+total.String(), true)
+	return doc.bytes()
+}